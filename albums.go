@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// HandleAlbums lists the albums of the logged in user (GET) or creates a new one (POST).
+func HandleAlbums(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := PrincipalFrom(r.Context()).ID
+
+		switch r.Method {
+		case http.MethodGet:
+			albums, err := listAlbums(db, `a.userID = ?`, userID)
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(albums)
+
+		case http.MethodPost:
+			var req CreateAlbumRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			name := strings.TrimSpace(req.Name)
+			if name == "" {
+				http.Error(w, "Album name is required", http.StatusBadRequest)
+				return
+			}
+
+			res, err := db.Exec(`INSERT INTO albums (userID, name, isPublic) VALUES (?, ?, ?)`, userID, name, boolInt(req.Public == 1))
+			if err != nil {
+				http.Error(w, "Failed to create album", http.StatusInternalServerError)
+				return
+			}
+			id, _ := res.LastInsertId()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(Album{ID: id, Name: name, Public: req.Public == 1, Photos: []Photo{}})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandlePublicAlbums lists public albums of users that are not banned.
+func HandlePublicAlbums(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, err := listAlbums(db, `a.isPublic = 1 AND u.isBanned = 0`)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		// Covers of other users are only shown when the photo itself is public
+		for i := range albums {
+			if albums[i].CoverPhotoID != nil && !isPublicPhoto(db, *albums[i].CoverPhotoID) {
+				albums[i].CoverPhotoID = nil
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(albums)
+	}
+}
+
+// HandleAlbum serves /api/albums/{id}, /api/albums/{id}/photos[/{photoID}] and /api/albums/{id}/order.
+// Public albums can be viewed by anyone, every other operation requires the owner.
+func HandleAlbum(cfg *Config, db *sql.DB) http.HandlerFunc {
+	mutate := AuthMiddlewareAPIKeys(cfg, db, handleAlbumChange(db))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			mutate(w, r)
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		albumID, ok := parsePhotoID(parts[2])
+		if !ok {
+			http.Error(w, "Invalid album ID", http.StatusBadRequest)
+			return
+		}
+
+		albums, err := listAlbums(db, `a.ID = ?`, albumID)
+		if err != nil || len(albums) == 0 {
+			http.Error(w, "Forbidden or not found", http.StatusForbidden)
+			return
+		}
+		album := albums[0]
+
+		var ownerBanned int
+		db.QueryRow(`SELECT isBanned FROM users WHERE login = ?`, album.Owner).Scan(&ownerBanned)
+
+		owner := isPhotoOwner(cfg, db, r, album.Owner)
+		if !owner && (!album.Public || ownerBanned != 0) {
+			http.Error(w, "Forbidden or not found", http.StatusForbidden)
+			return
+		}
+
+		album.Photos, err = albumPhotos(db, albumID, !owner)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if !owner && album.CoverPhotoID != nil && !isPublicPhoto(db, *album.CoverPhotoID) {
+			album.CoverPhotoID = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(album)
+	}
+}
+
+func handleAlbumChange(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := PrincipalFrom(r.Context()).ID
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 3 {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		albumID, ok := parsePhotoID(parts[2])
+		if !ok {
+			http.Error(w, "Invalid album ID", http.StatusBadRequest)
+			return
+		}
+
+		var ownerID int64
+		err := db.QueryRow(`SELECT userID FROM albums WHERE ID = ?`, albumID).Scan(&ownerID)
+		if err != nil || ownerID != userID {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case len(parts) == 3 && r.Method == http.MethodPatch:
+			updateAlbum(w, r, db, userID, albumID)
+		case len(parts) == 3 && r.Method == http.MethodDelete:
+			db.Exec(`DELETE FROM album_photos WHERE albumID = ?`, albumID)
+			if _, err := db.Exec(`DELETE FROM albums WHERE ID = ?`, albumID); err != nil {
+				http.Error(w, "Failed to delete album", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"message": "Album deleted"})
+		case len(parts) == 4 && parts[3] == "photos" && r.Method == http.MethodPost:
+			addAlbumPhoto(w, r, db, userID, albumID)
+		case len(parts) == 5 && parts[3] == "photos" && r.Method == http.MethodDelete:
+			photoID, ok := parsePhotoID(parts[4])
+			if !ok {
+				http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+				return
+			}
+			removeAlbumPhoto(db, albumID, photoID)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Photo removed from album"})
+		case len(parts) == 4 && parts[3] == "order" && r.Method == http.MethodPut:
+			reorderAlbum(w, r, db, albumID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func updateAlbum(w http.ResponseWriter, r *http.Request, db *sql.DB, userID, albumID int64) {
+	var req UpdateAlbumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" {
+			http.Error(w, "Album name is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Nothing is written until every field is validated, the cover check runs in the
+	// transaction so the photo cannot leave the album in between
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.CoverPhotoID != nil && *req.CoverPhotoID != 0 {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM album_photos WHERE albumID = ? AND photoID = ?`, albumID, *req.CoverPhotoID).Scan(&n); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "Cover photo must belong to the album", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Name != nil {
+		if _, err := tx.Exec(`UPDATE albums SET name = ? WHERE ID = ?`, name, albumID); err != nil {
+			http.Error(w, "Failed to update album", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Public != nil {
+		if _, err := tx.Exec(`UPDATE albums SET isPublic = ? WHERE ID = ?`, boolInt(*req.Public == 1), albumID); err != nil {
+			http.Error(w, "Failed to update album", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.CoverPhotoID != nil {
+		var cover any
+		if *req.CoverPhotoID != 0 {
+			cover = *req.CoverPhotoID
+		}
+		if _, err := tx.Exec(`UPDATE albums SET coverPhotoID = ? WHERE ID = ?`, cover, albumID); err != nil {
+			http.Error(w, "Failed to update album", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update album", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Album updated"})
+}
+
+func addAlbumPhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, userID, albumID int64) {
+	var req AlbumPhotoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int64
+	err := db.QueryRow(`SELECT userID FROM photos WHERE ID = ?`, req.PhotoID).Scan(&ownerID)
+	if err != nil || ownerID != userID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO album_photos (albumID, photoID, position)
+		VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM album_photos WHERE albumID = ?))`,
+		albumID, req.PhotoID, albumID)
+	if err != nil {
+		http.Error(w, "Failed to add photo", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Photo added to album"})
+}
+
+func removeAlbumPhoto(db *sql.DB, albumID, photoID int64) {
+	db.Exec(`DELETE FROM album_photos WHERE albumID = ? AND photoID = ?`, albumID, photoID)
+	db.Exec(`UPDATE albums SET coverPhotoID = NULL WHERE ID = ? AND coverPhotoID = ?`, albumID, photoID)
+}
+
+// reorderAlbum expects every photo of the album exactly once, in the new order.
+func reorderAlbum(w http.ResponseWriter, r *http.Request, db *sql.DB, albumID int64) {
+	var req ReorderAlbumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	current, err := albumPhotos(db, albumID, false)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	inAlbum := map[int64]bool{}
+	for _, p := range current {
+		inAlbum[p.ID] = true
+	}
+	if len(req.PhotoIDs) != len(inAlbum) {
+		http.Error(w, "Order must list every photo of the album", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.PhotoIDs {
+		if !inAlbum[id] {
+			http.Error(w, "Order must list every photo of the album", http.StatusBadRequest)
+			return
+		}
+		delete(inAlbum, id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for i, id := range req.PhotoIDs {
+		if _, err := tx.Exec(`UPDATE album_photos SET position = ? WHERE albumID = ? AND photoID = ?`, i+1, albumID, id); err != nil {
+			http.Error(w, "Failed to reorder album", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reorder album", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Album reordered"})
+}
+
+func listAlbums(db *sql.DB, where string, args ...any) ([]Album, error) {
+	rows, err := db.Query(`
+		SELECT a.ID, u.login, a.name, a.isPublic, a.coverPhotoID
+		FROM albums a
+		JOIN users u ON a.userID = u.ID
+		WHERE `+where+`
+		ORDER BY a.ID DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := []Album{}
+	for rows.Next() {
+		var a Album
+		var isPublic int
+		var cover sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.Owner, &a.Name, &isPublic, &cover); err != nil {
+			return nil, err
+		}
+		a.Public = isPublic != 0
+		if cover.Valid {
+			a.CoverPhotoID = &cover.Int64
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+func albumPhotos(db *sql.DB, albumID int64, publicOnly bool) ([]Photo, error) {
+	rows, err := db.Query(`
+		SELECT p.ID, p.originalName, p.imageIsPublic
+		FROM album_photos ap
+		JOIN photos p ON ap.photoID = p.ID
+		WHERE ap.albumID = ? AND (? = 0 OR p.imageIsPublic = 1)
+		ORDER BY ap.position`, albumID, boolInt(publicOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	for rows.Next() {
+		var p Photo
+		var imageIsPublic int
+		if err := rows.Scan(&p.ID, &p.Filename, &imageIsPublic); err != nil {
+			return nil, err
+		}
+		p.Public = imageIsPublic != 0
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+func isPublicPhoto(db *sql.DB, photoID int64) bool {
+	var imageIsPublic int
+	db.QueryRow(`SELECT imageIsPublic FROM photos WHERE ID = ?`, photoID).Scan(&imageIsPublic)
+	return imageIsPublic != 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAlbums(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		JWT:      JWTConfig{SecretKey: "test_secret_key_for_jwt", TimeoutMinutes: 15},
+		Photos:   PhotosConfig{Directory: t.TempDir()},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	RegisterUser(db, &User{Login: "other", Password: "pass"})
+
+	db.Exec(`INSERT INTO photos (imagePath, originalName, imageIsPublic, userID) VALUES
+		('testadmin/1.png', 'one.png', 1, 1),
+		('testadmin/2.png', 'two.png', 0, 1),
+		('testadmin/3.png', 'three.png', 1, 1),
+		('other/4.png', 'four.png', 1, 2)`)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/albums", AuthMiddleware(cfg, db, HandleAlbums(db)))
+	mux.HandleFunc("/api/albums/", HandleAlbum(cfg, db))
+	mux.HandleFunc("/api/public-albums", HandlePublicAlbums(db))
+
+	send := func(method, url, login, body string, out any) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if login != "" {
+			var id int64 = 1
+			if login == "other" {
+				id = 2
+			}
+			sessionID, _, _ := CreateSession(cfg, db, id, "")
+			token, _ := GenerateJWT(cfg, id, login, sessionID, "csrf")
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+			req.Header.Set(CSRFHeader, "csrf")
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if out != nil {
+			json.NewDecoder(rec.Body).Decode(out)
+		}
+		return rec.Code
+	}
+
+	var album Album
+	if code := send("POST", "/api/albums", "testadmin", `{"name":" Holiday ","public":0}`, &album); code != http.StatusCreated || album.Name != "Holiday" {
+		t.Fatalf("Expected album to be created, got %d %+v", code, album)
+	}
+	url := fmt.Sprintf("/api/albums/%d", album.ID)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if code := send("POST", url+"/photos", "testadmin", `{"photoId":`+id+`}`, nil); code != http.StatusCreated {
+			t.Fatalf("Expected photo %s to be added, got %d", id, code)
+		}
+	}
+	if code := send("POST", url+"/photos", "testadmin", `{"photoId":4}`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected adding another user's photo to be forbidden, got %d", code)
+	}
+	if code := send("PATCH", url, "other", `{"name":"Mine"}`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected rename by another user to be forbidden, got %d", code)
+	}
+
+	if code := send("PUT", url+"/order", "testadmin", `{"photoIds":[3,1]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected incomplete order to be rejected, got %d", code)
+	}
+	if code := send("PUT", url+"/order", "testadmin", `{"photoIds":[3,1,2]}`, nil); code != http.StatusOK {
+		t.Errorf("Expected reorder to succeed, got %d", code)
+	}
+	if code := send("PATCH", url, "testadmin", `{"name":"Broken","public":1,"coverPhotoId":4}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected cover outside the album to be rejected, got %d", code)
+	}
+	if code := send("PATCH", url, "testadmin", `{"name":"Summer","coverPhotoId":2}`, nil); code != http.StatusOK {
+		t.Errorf("Expected update to succeed, got %d", code)
+	}
+
+	album = Album{}
+	send("GET", url, "testadmin", "", &album)
+	if album.Public {
+		t.Error("Expected a rejected update to leave the album unchanged")
+	}
+	if album.Name != "Summer" || len(album.Photos) != 3 || album.Photos[0].ID != 3 || album.Photos[2].ID != 2 {
+		t.Errorf("Unexpected album for the owner: %+v", album)
+	}
+
+	// Private albums are hidden from everyone else
+	if code := send("GET", url, "other", "", nil); code != http.StatusForbidden {
+		t.Errorf("Expected private album to be hidden, got %d", code)
+	}
+
+	send("PATCH", url, "testadmin", `{"public":1}`, nil)
+	album = Album{}
+	if code := send("GET", url, "", "", &album); code != http.StatusOK {
+		t.Fatalf("Expected public album to be visible, got %d", code)
+	}
+	if len(album.Photos) != 2 || album.Photos[0].ID != 3 || album.Photos[1].ID != 1 {
+		t.Errorf("Expected only public photos, got %+v", album.Photos)
+	}
+	if album.CoverPhotoID != nil {
+		t.Errorf("Expected private cover photo to be hidden, got %d", *album.CoverPhotoID)
+	}
+
+	var public []Album
+	send("GET", "/api/public-albums", "", "", &public)
+	if len(public) != 1 {
+		t.Errorf("Expected one public album, got %d", len(public))
+	}
+
+	// Albums of banned users are hidden like their photos in the public gallery
+	db.Exec(`UPDATE users SET isBanned = 1 WHERE ID = 1`)
+	if code := send("GET", url, "other", "", nil); code != http.StatusForbidden {
+		t.Errorf("Expected album of banned user to be hidden, got %d", code)
+	}
+	public = nil
+	send("GET", "/api/public-albums", "", "", &public)
+	if len(public) != 0 {
+		t.Errorf("Expected no public albums, got %d", len(public))
+	}
+	db.Exec(`UPDATE users SET isBanned = 0 WHERE ID = 1`)
+
+	store, _ := NewLocalPhotoStore(cfg.Photos.Directory)
+	if err := DeletePhoto(db, store, 2); err != nil {
+		t.Fatalf("DeletePhoto failed: %v", err)
+	}
+	album = Album{}
+	send("GET", url, "testadmin", "", &album)
+	if len(album.Photos) != 2 || album.CoverPhotoID != nil {
+		t.Errorf("Expected deleted photo to leave the album, got %+v", album)
+	}
+
+	if code := send("DELETE", url, "testadmin", "", nil); code != http.StatusOK {
+		t.Errorf("Expected album to be deleted, got %d", code)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM album_photos`).Scan(&n)
+	if n != 0 {
+		t.Errorf("Expected album entries to be removed, got %d", n)
+	}
+}
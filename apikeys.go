@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Personal API keys for scripts and sync clients. A key is sent as
+// "Authorization: Bearer pm_..." and only its SHA-256 hash is stored. Keys are limited
+// to their scopes and to the endpoints wrapped in AuthMiddlewareAPIKeys.
+
+const (
+	ScopeRead   = "read"   // GET requests
+	ScopeUpload = "upload" // adding and editing photos and albums
+	ScopeDelete = "delete" // DELETE requests
+
+	apiKeyPrefix       = "pm_"
+	apiKeyDisplayChars = 8
+	maxAPIKeyName      = 100
+)
+
+var apiKeyScopes = map[string]bool{ScopeRead: true, ScopeUpload: true, ScopeDelete: true}
+
+var (
+	ErrInvalidAPIKey     = errors.New("invalid or expired API key")
+	ErrAPIKeyNotAllowed  = errors.New("API keys cannot be used for this endpoint")
+	ErrInsufficientScope = errors.New("API key lacks the scope for this request")
+)
+
+// requiredScope returns the scope an API key needs for the request.
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return ScopeRead
+	case http.MethodDelete:
+		return ScopeDelete
+	}
+	return ScopeUpload
+}
+
+// HasScope reports whether the principal may make requests needing the scope. Sessions
+// are not limited by scopes.
+func (p *Principal) HasScope(scope string) bool {
+	return p.Scopes == nil || p.Scopes[scope]
+}
+
+// getAPIKeyFromHeader returns the key of an "Authorization: Bearer" header.
+func getAPIKeyFromHeader(r *http.Request) (string, bool) {
+	scheme, key, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	key = strings.TrimSpace(key)
+	return key, strings.HasPrefix(key, apiKeyPrefix)
+}
+
+// CreateAPIKey issues a key for the user. The key itself is returned only here.
+func CreateAPIKey(db *sql.DB, userID int64, name string, scopes []string, expires *time.Time) (APIKey, string, error) {
+	key := apiKeyPrefix + randomToken(32)
+	k := APIKey{
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+apiKeyDisplayChars],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Format(sessionTimeLayout),
+	}
+	var expiresAt sql.NullString
+	if expires != nil {
+		k.ExpiresAt = expires.UTC().Format(sessionTimeLayout)
+		expiresAt = nullString(k.ExpiresAt)
+	}
+
+	res, err := db.Exec(`INSERT INTO api_keys (userID, name, prefix, keyHash, scopes, createdAt, expiresAt, revoked) VALUES (?, ?, ?, ?, ?, ?, ?, 0)`,
+		userID, k.Name, k.Prefix, hashToken(key), strings.Join(scopes, ","), k.CreatedAt, expiresAt)
+	if err != nil {
+		return k, "", err
+	}
+	k.ID, _ = res.LastInsertId()
+	return k, key, nil
+}
+
+// authenticateAPIKey loads the user of a valid key and records its use.
+func authenticateAPIKey(db *sql.DB, key string) (*Principal, error) {
+	var keyID, userID int64
+	var scopes string
+	var expiresAt sql.NullString
+	now := time.Now().UTC().Format(sessionTimeLayout)
+	err := db.QueryRow(`SELECT ID, userID, scopes, expiresAt FROM api_keys WHERE keyHash = ? AND revoked = 0`,
+		hashToken(key)).Scan(&keyID, &userID, &scopes, &expiresAt)
+	if err != nil || (expiresAt.Valid && expiresAt.String <= now) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	p, err := LoadPrincipal(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	p.APIKeyID = keyID
+	p.Scopes = map[string]bool{}
+	for _, scope := range strings.Split(scopes, ",") {
+		p.Scopes[scope] = true
+	}
+	db.Exec(`UPDATE api_keys SET lastUsedAt = ? WHERE ID = ?`, now, keyID)
+	return p, nil
+}
+
+// ListAPIKeys returns the keys of the user that are not revoked, newest first.
+func ListAPIKeys(db *sql.DB, userID int64) ([]APIKey, error) {
+	rows, err := db.Query(`SELECT ID, name, prefix, scopes, createdAt, expiresAt, lastUsedAt FROM api_keys
+		WHERE userID = ? AND revoked = 0 ORDER BY ID DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes = strings.Split(scopes, ",")
+		k.ExpiresAt, k.LastUsedAt = expiresAt.String, lastUsedAt.String
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// normalizeScopes checks the requested scopes and removes duplicates.
+func normalizeScopes(scopes []string) ([]string, bool) {
+	set := map[string]bool{}
+	for _, scope := range scopes {
+		if !apiKeyScopes[scope] {
+			return nil, false
+		}
+		set[scope] = true
+	}
+	list := make([]string, 0, len(set))
+	for scope := range set {
+		list = append(list, scope)
+	}
+	sort.Strings(list)
+	return list, len(list) > 0
+}
+
+// HandleAPIKeys lists the API keys of the logged in user (GET) or creates a new one (POST).
+func HandleAPIKeys(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := PrincipalFrom(r.Context()).ID
+
+		switch r.Method {
+		case http.MethodGet:
+			keys, err := ListAPIKeys(db, userID)
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(keys)
+
+		case http.MethodPost:
+			var req CreateAPIKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			name := strings.TrimSpace(req.Name)
+			if name == "" || len(name) > maxAPIKeyName {
+				http.Error(w, "API key name is required, at most 100 characters", http.StatusBadRequest)
+				return
+			}
+			scopes, ok := normalizeScopes(req.Scopes)
+			if !ok {
+				http.Error(w, "Scopes must be a non-empty list of read, upload, delete", http.StatusBadRequest)
+				return
+			}
+			if req.ExpiresInDays < 0 {
+				http.Error(w, "expiresInDays must not be negative", http.StatusBadRequest)
+				return
+			}
+			var expires *time.Time
+			if req.ExpiresInDays > 0 {
+				t := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+				expires = &t
+			}
+
+			k, key, err := CreateAPIKey(db, userID, name, scopes, expires)
+			if err != nil {
+				http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{
+				"apiKey": k,
+				"key":    key,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleAPIKey revokes an API key of the logged in user (DELETE /api/api-keys/{id}).
+func HandleAPIKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		keyID, ok := parsePhotoID(parts[2])
+		if !ok {
+			http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`UPDATE api_keys SET revoked = 1 WHERE ID = ? AND userID = ? AND revoked = 0`,
+			keyID, PrincipalFrom(r.Context()).ID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+	}
+}
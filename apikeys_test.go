@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bearerDo sends a request with the API key and returns the status and the error code.
+func bearerDo(mux *http.ServeMux, key, method, url, body string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var resp map[string]any
+	json.NewDecoder(rec.Body).Decode(&resp)
+	code, _ := resp["error"].(string)
+	return rec.Code, code
+}
+
+func testAPIKeyServer(t *testing.T) (*http.ServeMux, cookieJar) {
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/api-keys", AuthMiddleware(cfg, db, HandleAPIKeys(db)))
+	mux.HandleFunc("/api/api-keys/", AuthMiddleware(cfg, db, HandleAPIKey(db)))
+	mux.HandleFunc("/api/albums", AuthMiddlewareAPIKeys(cfg, db, HandleAlbums(db)))
+	mux.HandleFunc("/api/albums/", HandleAlbum(cfg, db))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	jar := cookieJar{}
+	jar.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+	return mux, jar
+}
+
+func createKey(t *testing.T, mux *http.ServeMux, jar cookieJar, body string) (APIKey, string) {
+	var created struct {
+		APIKey APIKey `json:"apiKey"`
+		Key    string `json:"key"`
+	}
+	if code := jar.postJSON(mux, "/api/api-keys", body, &created); code != http.StatusCreated {
+		t.Fatalf("Creating API key %s failed with %d", body, code)
+	}
+	return created.APIKey, created.Key
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	mux, jar := testAPIKeyServer(t)
+
+	_, readKey := createKey(t, mux, jar, `{"name":"nas","scopes":["read"]}`)
+	k, writeKey := createKey(t, mux, jar, `{"name":"camera","scopes":["upload","read","upload"],"expiresInDays":30}`)
+	if !strings.HasPrefix(writeKey, "pm_") || !strings.HasPrefix(writeKey, k.Prefix) || k.ExpiresAt == "" {
+		t.Errorf("Unexpected key %q %+v", writeKey, k)
+	}
+	if strings.Join(k.Scopes, ",") != "read,upload" {
+		t.Errorf("Expected normalized scopes, got %v", k.Scopes)
+	}
+
+	if code, _ := bearerDo(mux, readKey, "GET", "/api/albums", ""); code != http.StatusOK {
+		t.Errorf("Expected read key to list albums, got %d", code)
+	}
+	if code, errCode := bearerDo(mux, readKey, "POST", "/api/albums", `{"name":"Trip"}`); code != http.StatusForbidden || errCode != "insufficient_scope" {
+		t.Errorf("Expected insufficient_scope, got %d %q", code, errCode)
+	}
+	if code, _ := bearerDo(mux, writeKey, "POST", "/api/albums", `{"name":"Trip"}`); code != http.StatusCreated {
+		t.Fatalf("Expected upload key to create an album, got %d", code)
+	}
+	if code, errCode := bearerDo(mux, writeKey, "DELETE", "/api/albums/1", ""); code != http.StatusForbidden || errCode != "insufficient_scope" {
+		t.Errorf("Expected delete to need the delete scope, got %d %q", code, errCode)
+	}
+
+	for _, url := range []string{"/api/me", "/api/api-keys"} {
+		if code, errCode := bearerDo(mux, writeKey, "GET", url, ""); code != http.StatusForbidden || errCode != "api_key_not_allowed" {
+			t.Errorf("%s: expected api_key_not_allowed, got %d %q", url, code, errCode)
+		}
+	}
+	if code, errCode := bearerDo(mux, "pm_unknown", "GET", "/api/albums", ""); code != http.StatusUnauthorized || errCode != "invalid_api_key" {
+		t.Errorf("Expected invalid_api_key, got %d %q", code, errCode)
+	}
+
+	for _, body := range []string{`{"name":"x","scopes":[]}`, `{"name":"x","scopes":["admin"]}`, `{"name":" ","scopes":["read"]}`, `{"name":"x","scopes":["read"],"expiresInDays":-1}`} {
+		if code := jar.do(mux, "POST", "/api/api-keys", body); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, code)
+		}
+	}
+}
+
+func TestAPIKeyListAndRevoke(t *testing.T) {
+	mux, jar := testAPIKeyServer(t)
+	k, key := createKey(t, mux, jar, `{"name":"sync","scopes":["read"]}`)
+	bearerDo(mux, key, "GET", "/api/albums", "")
+
+	var keys []map[string]any
+	jar.getJSON(mux, "/api/api-keys", &keys)
+	if len(keys) != 1 || keys[0]["name"] != "sync" || keys[0]["lastUsedAt"] == nil {
+		t.Fatalf("Expected the key with its last use, got %v", keys)
+	}
+	if _, leaked := keys[0]["key"]; leaked {
+		t.Error("Expected the list not to contain the key")
+	}
+
+	other := cookieJar{}
+	other.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+	url := "/api/api-keys/" + strconv.FormatInt(k.ID, 10)
+	if code := other.do(mux, "DELETE", url, ""); code != http.StatusNotFound {
+		t.Errorf("Expected keys of other users not to be revoked, got %d", code)
+	}
+	if code := jar.do(mux, "DELETE", url, ""); code != http.StatusOK {
+		t.Fatalf("Revoke failed with %d", code)
+	}
+	if code, errCode := bearerDo(mux, key, "GET", "/api/albums", ""); code != http.StatusUnauthorized || errCode != "invalid_api_key" {
+		t.Errorf("Expected revoked key to be rejected, got %d %q", code, errCode)
+	}
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	_, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/whoami", AuthMiddlewareAPIKeys(&Config{}, db, func(w http.ResponseWriter, r *http.Request) {}))
+	past := time.Now().Add(-time.Hour)
+	_, key, err := CreateAPIKey(db, 1, "old", []string{ScopeRead}, &past)
+	if err != nil {
+		t.Fatalf("CreateAPIKey failed: %v", err)
+	}
+	if code, errCode := bearerDo(mux, key, "GET", "/api/whoami", ""); code != http.StatusUnauthorized || errCode != "invalid_api_key" {
+		t.Errorf("Expected expired key to be rejected, got %d %q", code, errCode)
+	}
+}
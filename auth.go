@@ -7,18 +7,23 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateJWT(cfg *Config, userID int64, userLogin string) (string, error) {
+// GenerateJWT issues an access token for the session, which is stored as the jti claim.
+// The hash of the CSRF token issued with it is stored as the csrf claim.
+func GenerateJWT(cfg *Config, userID int64, userLogin, sessionID, csrfToken string) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":    userID,
 		"user_login": userLogin,
+		"jti":        sessionID,
 		"exp":        time.Now().Add(cfg.JWT.Timeout()).Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(cfg.JWT.SecretKey))
+	if csrfToken != "" {
+		claims["csrf"] = hashToken(csrfToken)
+	}
+	return signToken(cfg, claims)
 }
 
-func getJWTFromCookie(r *http.Request) (string, error) {
-	c, err := r.Cookie("jwt")
+func getJWTFromCookie(cfg *Config, r *http.Request) (string, error) {
+	c, err := r.Cookie(cfg.Cookies.cookieName(jwtCookie, "/"))
 	if err != nil {
 		return "", err
 	}
@@ -26,9 +31,12 @@ func getJWTFromCookie(r *http.Request) (string, error) {
 }
 
 func parseJWT(cfg *Config, tokenStr string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
-		return []byte(cfg.JWT.SecretKey), nil
-	})
+	keyring, err := cfg.JWT.Keyring()
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse(tokenStr, keyring.verificationKey,
+		jwt.WithValidMethods(keyring.methods), jwt.WithExpirationRequired())
 	if err != nil || !token.Valid {
 		return nil, err
 	}
@@ -16,7 +16,7 @@ func TestGenerateJWT(t *testing.T) {
 	userID := int64(123)
 	userLogin := "testuser"
 
-	token, err := GenerateJWT(cfg, userID, userLogin)
+	token, err := GenerateJWT(cfg, userID, userLogin, "session-1", "")
 	if err != nil {
 		t.Fatalf("GenerateJWT failed: %v", err)
 	}
@@ -38,6 +38,10 @@ func TestGenerateJWT(t *testing.T) {
 		t.Errorf("Expected user_login %s, got %s", userLogin, claims["user_login"].(string))
 	}
 
+	if claims["jti"] != "session-1" {
+		t.Errorf("Expected jti session-1, got %v", claims["jti"])
+	}
+
 	exp := int64(claims["exp"].(float64))
 	now := time.Now().Unix()
 	if exp <= now {
@@ -53,7 +57,7 @@ func TestParseJWT(t *testing.T) {
 		},
 	}
 
-	token, _ := GenerateJWT(cfg, 123, "testuser")
+	token, _ := GenerateJWT(cfg, 123, "testuser", "session-1", "")
 	claims, err := parseJWT(cfg, token)
 	if err != nil {
 		t.Fatalf("parseJWT failed with valid token: %v", err)
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Uploaded files are stored once per content as blobs keyed by their SHA-256 hash.
+// Every photos row referencing a blob holds one reference.
+
+func hashContent(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// blobKey returns a new storage key for the content. Keys are unique per stored blob, so
+// the objects of a released blob can be deleted after the release commits without
+// touching the objects of the same content uploaded again meanwhile.
+func blobKey(hash, format string) string {
+	return fmt.Sprintf("blobs/%s/%s-%s%s", hash[:2], hash, randomToken(6), formatExtensions[format])
+}
+
+// FindOwnedDuplicate returns the photo of the user that has the given content.
+func FindOwnedDuplicate(db *sql.DB, userID int64, hash string) (int64, string, bool) {
+	var id int64
+	var name string
+	err := db.QueryRow(`SELECT ID, originalName FROM photos WHERE userID = ? AND blobHash = ? LIMIT 1`, userID, hash).Scan(&id, &name)
+	if err != nil {
+		return 0, "", false
+	}
+	return id, name, true
+}
+
+// AcquireBlob stores the content unless a blob with the same hash exists and takes a
+// reference on it. It returns the storage key of the blob.
+//
+// The lookup and the increment run in one transaction, which holds the database write
+// lock, so a blob found here cannot be released before the reference is committed. A
+// blob released just before is stored again under a new key.
+func AcquireBlob(db *sql.DB, store PhotoStore, hash, format string, r io.Reader) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRow(`UPDATE blobs SET refCount = refCount + 1 WHERE hash = ? AND refCount > 0 RETURNING storageKey`, hash).Scan(&key)
+	switch {
+	case err == nil:
+		return key, tx.Commit()
+	case err != sql.ErrNoRows:
+		return "", err
+	}
+
+	key = blobKey(hash, format)
+	if err := store.Put(key, r, "image/"+format); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO blobs (hash, storageKey, format, refCount) VALUES (?, ?, ?, 1)
+		ON CONFLICT(hash) DO UPDATE SET storageKey = excluded.storageKey, refCount = refCount + 1`, hash, key, format)
+	if err != nil {
+		return "", err
+	}
+	return key, tx.Commit()
+}
+
+// releaseBlob drops a reference to the blob in the transaction. It returns true when it
+// was the last one and the blob row has been removed.
+func releaseBlob(tx *sql.Tx, hash string) (bool, error) {
+	var refCount int
+	if err := tx.QueryRow(`UPDATE blobs SET refCount = refCount - 1 WHERE hash = ? RETURNING refCount`, hash).Scan(&refCount); err != nil {
+		return false, err
+	}
+	if refCount > 0 {
+		return false, nil
+	}
+	_, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, hash)
+	return err == nil, err
+}
+
+// ReleaseBlob drops a reference to the blob. When the last reference goes away the blob
+// row is removed and, once that is committed, the given objects are deleted from the store.
+func ReleaseBlob(db *sql.DB, store PhotoStore, hash string, keys ...string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	last, err := releaseBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !last {
+		return nil
+	}
+	return deleteObjects(store, keys)
+}
+
+// deleteObjects removes the objects from the store. Objects that fail to delete are only
+// left orphaned, the others are deleted regardless.
+func deleteObjects(store PhotoStore, keys []string) error {
+	var errs []error
+	for _, k := range keys {
+		if err := store.Delete(k); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CopyRenditions reuses the renditions of another photo with the same blob.
+// It returns false when there is nothing to copy.
+func CopyRenditions(db *sql.DB, photoID int64, hash string) bool {
+	res, err := db.Exec(`
+		INSERT INTO photo_renditions (photoID, size, imagePath, width, height)
+		SELECT ?, size, imagePath, width, height FROM photo_renditions
+		WHERE photoID = (SELECT p.ID FROM photos p WHERE p.blobHash = ? AND p.ID != ?
+			AND EXISTS (SELECT 1 FROM photo_renditions r WHERE r.photoID = p.ID) LIMIT 1)`, photoID, hash, photoID)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// DeletePhoto removes a photo with its metadata, renditions, tags and album entries in
+// one transaction. Files are deleted after it commits; files shared with other photos
+// are only removed together with the last reference.
+func DeletePhoto(db *sql.DB, store PhotoStore, photoID int64) error {
+	searchIndex := hasSearchIndex(db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	var hash sql.NullString
+	if err := tx.QueryRow(`SELECT imagePath, blobHash FROM photos WHERE ID = ?`, photoID).Scan(&key, &hash); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT imagePath FROM photo_renditions WHERE photoID = ?`, photoID)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	keys = append(keys, key)
+
+	statements := []string{
+		`DELETE FROM album_photos WHERE photoID = ?`,
+		`UPDATE albums SET coverPhotoID = NULL WHERE coverPhotoID = ?`,
+		`DELETE FROM photo_tags WHERE photoID = ?`,
+		`DELETE FROM photo_renditions WHERE photoID = ?`,
+		`DELETE FROM photo_metadata WHERE photoID = ?`,
+		`DELETE FROM photos WHERE ID = ?`,
+	}
+	if searchIndex {
+		statements = append(statements, `DELETE FROM photos_fts WHERE rowid = ?`)
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, photoID); err != nil {
+			return err
+		}
+	}
+
+	// Photos uploaded before deduplication own their files
+	last := true
+	if hash.Valid {
+		if last, err = releaseBlob(tx, hash.String); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !last {
+		return nil
+	}
+	return deleteObjects(store, keys)
+}
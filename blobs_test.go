@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPhotoDeduplication(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Photos:   PhotosConfig{Directory: t.TempDir()},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	RegisterUser(db, &User{Login: "other", Password: "pass"})
+
+	store, _ := NewLocalPhotoStore(cfg.Photos.Directory)
+	upload := HandleAddPhoto(cfg, db, store)
+	image := testPNGBytes(20, 20)
+
+	send := func(userID int64, login string) (int, map[string]any) {
+		req := uploadRequest(t, "a.png", image)
+		rec := httptest.NewRecorder()
+		upload(rec, req.WithContext(WithPrincipal(req.Context(), &Principal{ID: userID, Login: login})))
+		var body map[string]any
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body
+	}
+
+	code, first := send(1, "testadmin")
+	if code != http.StatusCreated || first["duplicate"] != false {
+		t.Fatalf("Expected new photo, got %d %v", code, first)
+	}
+
+	code, again := send(1, "testadmin")
+	if code != http.StatusOK || again["duplicate"] != true || again["id"] != first["id"] {
+		t.Errorf("Expected duplicate of photo %v, got %d %v", first["id"], code, again)
+	}
+
+	code, other := send(2, "other")
+	if code != http.StatusCreated || other["duplicate"] != false {
+		t.Fatalf("Expected new photo for another user, got %d %v", code, other)
+	}
+
+	var blobs, refCount int
+	var key string
+	db.QueryRow(`SELECT COUNT(*), MAX(refCount), MAX(storageKey) FROM blobs`).Scan(&blobs, &refCount, &key)
+	if blobs != 1 || refCount != 2 {
+		t.Errorf("Expected one blob with two references, got %d blobs, refCount %d", blobs, refCount)
+	}
+
+	del := func(userID int64, login string, id any) {
+		req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/delete-photo/%s/%v", login, id), nil)
+		req = req.WithContext(WithPrincipal(req.Context(), &Principal{ID: userID}))
+		rec := httptest.NewRecorder()
+		HandleDeletePhoto(cfg, db, store)(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Delete failed with %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	del(1, "testadmin", first["id"])
+	if _, err := store.Stat(key); err != nil {
+		t.Errorf("Expected blob to survive while still referenced, got %v", err)
+	}
+
+	del(2, "other", other["id"])
+	if _, err := store.Stat(key); err != ErrObjectNotFound {
+		t.Errorf("Expected blob to be removed with the last reference, got %v", err)
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&blobs)
+	if blobs != 0 {
+		t.Errorf("Expected blob row to be removed, got %d", blobs)
+	}
+	if list, _ := store.List("blobs/"); len(list) != 0 {
+		t.Errorf("Expected renditions to be removed, got %v", list)
+	}
+}
+
+func TestAcquireBlobStoresReleasedContentAgain(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	store, _ := NewLocalPhotoStore(t.TempDir())
+
+	data := testPNGBytes(4, 4)
+	hash, _ := hashContent(bytes.NewReader(data))
+	key, err := AcquireBlob(db, store, hash, "png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("AcquireBlob failed: %v", err)
+	}
+	if err := ReleaseBlob(db, store, hash, key); err != nil {
+		t.Fatalf("ReleaseBlob failed: %v", err)
+	}
+	if _, err := store.Stat(key); err != ErrObjectNotFound {
+		t.Fatalf("Expected object to be removed with the last reference, got %v", err)
+	}
+
+	// A row left without references must not be reused without its object
+	db.Exec(`INSERT INTO blobs (hash, storageKey, format, refCount) VALUES (?, ?, 'png', 0)`, hash, key)
+	key, err = AcquireBlob(db, store, hash, "png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("AcquireBlob failed: %v", err)
+	}
+	if _, err := store.Stat(key); err != nil {
+		t.Errorf("Expected object to be stored again, got %v", err)
+	}
+	var refCount int
+	db.QueryRow(`SELECT refCount FROM blobs WHERE hash = ?`, hash).Scan(&refCount)
+	if refCount != 1 {
+		t.Errorf("Expected one reference, got %d", refCount)
+	}
+}
+
+func TestDeletePhotoIsAtomic(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	store, _ := NewLocalPhotoStore(t.TempDir())
+
+	data := testPNGBytes(4, 4)
+	hash, _ := hashContent(bytes.NewReader(data))
+	key, err := AcquireBlob(db, store, hash, "png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("AcquireBlob failed: %v", err)
+	}
+	db.Exec(`INSERT INTO photos (ID, imagePath, originalName, imageIsPublic, userID, blobHash) VALUES (1, ?, 'a.png', 1, 1, ?)`, key, hash)
+	db.Exec(`INSERT INTO photo_tags (photoID, tag) VALUES (1, 'sea')`)
+
+	// A statement failing after the tags are deleted must leave everything in place
+	db.Exec(`CREATE TRIGGER fail_delete BEFORE DELETE ON photos BEGIN SELECT RAISE(ABORT, 'failed'); END`)
+	if err := DeletePhoto(db, store, 1); err == nil {
+		t.Fatal("Expected DeletePhoto to fail")
+	}
+	var tags, refCount int
+	db.QueryRow(`SELECT COUNT(*) FROM photo_tags WHERE photoID = 1`).Scan(&tags)
+	db.QueryRow(`SELECT refCount FROM blobs WHERE hash = ?`, hash).Scan(&refCount)
+	if tags != 1 || refCount != 1 {
+		t.Errorf("Expected the failed delete to be rolled back, got %d tags, refCount %d", tags, refCount)
+	}
+	if _, err := store.Stat(key); err != nil {
+		t.Errorf("Expected object to be kept, got %v", err)
+	}
+
+	db.Exec(`DROP TRIGGER fail_delete`)
+	if err := DeletePhoto(db, store, 1); err != nil {
+		t.Fatalf("DeletePhoto failed: %v", err)
+	}
+	if _, err := store.Stat(key); err != ErrObjectNotFound {
+		t.Errorf("Expected object to be removed after the commit, got %v", err)
+	}
+}
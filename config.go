@@ -11,8 +11,19 @@ type Config struct {
 	Database DatabaseConfig `json:"database"`
 	JWT      JWTConfig      `json:"jwt"`
 	Photos   PhotosConfig   `json:"photos"`
+	Storage  StorageConfig  `json:"storage"`
 	Admin    AdminConfig    `json:"admin"`
 	Password *PasswordConfig `json:"password,omitempty"`
+	MFA      MFAConfig      `json:"mfa"`
+	Login    LoginConfig    `json:"login"`
+	Mail     MailConfig     `json:"mail"`
+	Cookies  CookieConfig   `json:"cookies"`
+	OIDC     *OIDCConfig    `json:"oidc,omitempty"` // login through an OpenID Connect provider, disabled without it
+	Search   SearchConfig   `json:"search"`
+}
+
+type SearchConfig struct {
+	AllowLikeFallback bool `json:"allow_like_fallback"` // start without FTS5 and search with LIKE matching
 }
 
 type ServerConfig struct {
@@ -27,14 +38,92 @@ type DatabaseConfig struct {
 type JWTConfig struct {
 	SecretKey      string `json:"secret_key"`
 	TimeoutMinutes int    `json:"timeout_minutes"`
+	RefreshDays    int    `json:"refresh_days"` // refresh token lifetime, default 30
+	// Keys replace the secret key with RSA (RS256) or Ed25519 (EdDSA) keys
+	Keys         []JWTKeyConfig `json:"keys,omitempty"`
+	SigningKeyID string         `json:"signing_key_id"` // kid of new tokens, default the first key with a private key
+}
+
+type CookieConfig struct {
+	Secure     bool   `json:"secure"`      // send the cookies over HTTPS only, forced by host_prefix and same_site none
+	SameSite   string `json:"same_site"`   // lax (default), strict or none, the refresh token cookie is always strict
+	Domain     string `json:"domain"`      // e.g. example.com to share the cookies with subdomains, default the host only
+	HostPrefix bool   `json:"host_prefix"` // __Host- cookie names, which subdomains cannot overwrite
+}
+
+type JWTKeyConfig struct {
+	ID             string `json:"kid"`
+	PrivateKeyFile string `json:"private_key_file"` // PEM, PKCS#1 or PKCS#8
+	PublicKeyFile  string `json:"public_key_file"`  // PEM, for keys that only verify tokens issued before a rotation
 }
 
 func (j JWTConfig) Timeout() time.Duration {
 	return time.Duration(j.TimeoutMinutes) * time.Minute
 }
 
+type MFAConfig struct {
+	RequireForAdmins bool   `json:"require_for_admins"` // admins get no permissions until they enable 2FA
+	Issuer           string `json:"issuer"`             // shown in authenticator apps, default PhotoManager
+}
+
+type LoginConfig struct {
+	MaxFailures      int `json:"max_failures"`       // failed attempts of a login before lockout, default 5
+	IPMaxFailures    int `json:"ip_max_failures"`    // failed attempts from one IP before lockout, default 4 * max_failures
+	LockoutMinutes   int `json:"lockout_minutes"`    // lockout length, default 15
+	BaseDelaySeconds int `json:"base_delay_seconds"` // delay after the first failure, doubled after each next one, default 1
+}
+
+type OIDCConfig struct {
+	Issuer            string   `json:"issuer"` // e.g. https://sso.example.com, the discovery document is read from it
+	ClientID          string   `json:"client_id"`
+	ClientSecret      string   `json:"client_secret"`       // empty for public clients
+	RedirectURL       string   `json:"redirect_url"`        // e.g. https://photos.example.com/api/oidc/callback
+	Scopes            []string `json:"scopes,omitempty"`    // default openid, profile, email
+	AutoProvision     bool     `json:"auto_provision"`      // create accounts for unknown identities
+	LinkVerifiedEmail bool     `json:"link_verified_email"` // link unknown identities to the account with the same verified email
+	LoginClaim        string   `json:"login_claim"`         // claim the login of new accounts is made from, default preferred_username
+	SuccessURL        string   `json:"success_url"`         // where the browser goes after the login, default /
+}
+
+type MailConfig struct {
+	SMTP              *SMTPConfig `json:"smtp,omitempty"`      // password reset is disabled without it
+	ResetURL          string      `json:"reset_url"`           // the reset token is appended, e.g. https://example.com/reset?token=
+	ResetTokenMinutes int         `json:"reset_token_minutes"` // default 60
+	ResetLimit        int         `json:"reset_limit"`         // reset requests per login an hour, 4 times as many per IP, default 3
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"` // optional, PLAIN auth requires TLS unless the server is local
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
 type PhotosConfig struct {
-	Directory string `json:"directory"`
+	Directory          string         `json:"directory"`
+	RenditionSizes     map[string]int `json:"rendition_sizes,omitempty"` // size name -> longest edge in pixels
+	BackfillRenditions bool           `json:"backfill_renditions"`
+	Privacy            string         `json:"privacy"` // none, strip-location, strip-identifying (default)
+	MaxUploadMB        int            `json:"max_upload_mb"`
+	MaxPixels          int            `json:"max_pixels"`
+	AllowedFormats     []string       `json:"allowed_formats,omitempty"` // jpeg, png, gif
+}
+
+type StorageConfig struct {
+	Backend string    `json:"backend"` // local (default), s3
+	S3      *S3Config `json:"s3,omitempty"`
+}
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. http://localhost:9000
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"` // optional key prefix inside the bucket
+	// TimeoutSeconds limits each request including the transfer, default 60
+	TimeoutSeconds int `json:"timeout_seconds"`
 }
 
 type AdminConfig struct {
@@ -43,8 +132,31 @@ type AdminConfig struct {
 }
 
 type PasswordConfig struct {
-	Mode   string         `json:"mode"` // no-validation, easy, medium, restrict, custom
+	Mode   string         `json:"mode"` // no-validation, easy, medium, restrict, custom, strength
 	Custom *CustomValidator `json:"custom,omitempty"`
+	MinScore int            `json:"min_score"` // strength mode, 0-4, default 3
+	Policy []string         `json:"policy,omitempty"` // modes that all apply, instead of mode
+	History *PasswordHistoryConfig `json:"history,omitempty"`
+	Hashing *HashingConfig  `json:"hashing,omitempty"`
+	Blocklist *BlocklistConfig `json:"blocklist,omitempty"` // checked in addition to the mode
+}
+
+type BlocklistConfig struct {
+	File        string `json:"file"`         // common passwords, one per line, compared case-insensitively
+	HIBPDir     string `json:"hibp_dir"`     // SHA-1 range files named by 5 hex digit prefix, SUFFIX:COUNT lines
+	MinCount    int    `json:"min_count"`    // breach count from which a password is rejected, default 1
+	RejectLogin bool   `json:"reject_login"` // reject passwords containing the login
+}
+
+type PasswordHistoryConfig struct {
+	Remember   int `json:"remember"`     // recent passwords, the current one included, that cannot be reused
+	MaxAgeDays int `json:"max_age_days"` // password has to be changed at login after this many days, 0 disables
+}
+
+type HashingConfig struct {
+	Algorithm  string          `json:"algorithm"`   // bcrypt (default), argon2id
+	BcryptCost int             `json:"bcrypt_cost"` // default 10
+	Argon2id   *Argon2idHasher `json:"argon2id,omitempty"`
 }
 
 var appConfig *Config
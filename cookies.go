@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Cookie attributes and CSRF protection. Every access token comes with a CSRF token in
+// the csrf_token cookie, readable by the frontend, and the hash of that token in the
+// csrf claim of the access token. Requests authenticated with the jwt cookie that are
+// not GET, HEAD or OPTIONS have to repeat the token in the X-CSRF-Token header. Another
+// site can make the browser send the cookies, but cannot read the token. API keys are
+// not sent by the browser on their own and need no token.
+
+const (
+	jwtCookie  = "jwt"
+	csrfCookie = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+
+	hostCookiePrefix   = "__Host-"
+	secureCookiePrefix = "__Secure-"
+)
+
+var ErrCSRF = errors.New("missing or invalid CSRF token")
+
+var cookieSameSite = map[string]http.SameSite{
+	"":       http.SameSiteLaxMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (c CookieConfig) Validate() error {
+	if _, ok := cookieSameSite[strings.ToLower(c.SameSite)]; !ok {
+		return fmt.Errorf("cookies: unknown same_site %q, use lax, strict or none", c.SameSite)
+	}
+	if c.HostPrefix && c.Domain != "" {
+		return errors.New("cookies: __Host- cookies cannot have a domain")
+	}
+	return nil
+}
+
+func (c CookieConfig) sameSite() http.SameSite {
+	return cookieSameSite[strings.ToLower(c.SameSite)]
+}
+
+// secure is forced for prefixed cookies and SameSite=None, browsers reject them otherwise.
+func (c CookieConfig) secure() bool {
+	return c.Secure || c.HostPrefix || c.sameSite() == http.SameSiteNoneMode
+}
+
+// cookieName adds the __Host- prefix, or __Secure- for cookies limited to a path, which
+// __Host- cookies cannot be.
+func (c CookieConfig) cookieName(name, path string) string {
+	switch {
+	case !c.HostPrefix:
+		return name
+	case path == "/":
+		return hostCookiePrefix + name
+	}
+	return secureCookiePrefix + name
+}
+
+// newCookie applies the configured attributes. A non-zero sameSite replaces the configured
+// one, for cookies that need a fixed value.
+func (c CookieConfig) newCookie(name, value, path string, maxAge int, httpOnly bool, sameSite http.SameSite) *http.Cookie {
+	if sameSite == 0 {
+		sameSite = c.sameSite()
+	}
+	cookie := &http.Cookie{
+		Name:     c.cookieName(name, path),
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   c.secure(),
+		SameSite: sameSite,
+	}
+	if !c.HostPrefix {
+		cookie.Domain = c.Domain
+	}
+	return cookie
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCSRF compares the X-CSRF-Token header with the csrf claim of the access token.
+func checkCSRF(r *http.Request, claims jwt.MapClaims) error {
+	if safeMethod(r.Method) {
+		return nil
+	}
+	expected, _ := claims["csrf"].(string)
+	token := r.Header.Get(CSRFHeader)
+	if expected == "" || token == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(expected)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
+
+// checkCSRFCookie compares the X-CSRF-Token header with the csrf_token cookie, for
+// requests that may come after the access token expired, like the logout.
+func checkCSRFCookie(cfg *Config, r *http.Request) error {
+	cookie, err := r.Cookie(cfg.Cookies.cookieName(csrfCookie, "/"))
+	token := r.Header.Get(CSRFHeader)
+	if err != nil || cookie.Value == "" || token == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func loginCookies(mux *http.ServeMux) (map[string]*http.Cookie, map[string]any) {
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"login":"testadmin","password":"testpass"}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	var resp map[string]any
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return cookies, resp
+}
+
+func TestCSRFProtection(t *testing.T) {
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/whoami", AuthMiddlewareAPIKeys(cfg, db, func(w http.ResponseWriter, r *http.Request) {}))
+
+	jar := cookieJar{}
+	var login map[string]any
+	jar.postJSON(mux, "/api/login", `{"login":"testadmin","password":"testpass"}`, &login)
+	if jar[csrfCookie] == "" || login["csrfToken"] != jar[csrfCookie] {
+		t.Fatalf("Expected the CSRF token in a cookie and the response, got %v %v", jar, login["csrfToken"])
+	}
+
+	if code, _ := authErrorCode(mux, jar, "POST", "/api/whoami", ""); code != http.StatusOK {
+		t.Errorf("Expected request with the token to pass, got %d", code)
+	}
+	missing := jar.clone()
+	delete(missing, csrfCookie)
+	forged := jar.clone()
+	forged[csrfCookie] = "forged"
+	for name, j := range map[string]cookieJar{"missing": missing, "forged": forged} {
+		if code, errCode := authErrorCode(mux, j, "DELETE", "/api/whoami", ""); code != http.StatusForbidden || errCode != "csrf_token_invalid" {
+			t.Errorf("%s: expected csrf_token_invalid, got %d %q", name, code, errCode)
+		}
+		if code, _ := authErrorCode(mux, j, "GET", "/api/whoami", ""); code != http.StatusOK {
+			t.Errorf("%s: expected GET without the token to pass, got %d", name, code)
+		}
+	}
+
+	old := jar.clone()
+	if code := jar.do(mux, "POST", "/api/refresh", ""); code != http.StatusOK {
+		t.Fatalf("Refresh failed with %d", code)
+	}
+	if jar[csrfCookie] == old[csrfCookie] {
+		t.Error("Expected a new CSRF token with the new access token")
+	}
+	old["jwt"] = jar["jwt"]
+	if code, errCode := authErrorCode(mux, old, "POST", "/api/whoami", ""); code != http.StatusForbidden || errCode != "csrf_token_invalid" {
+		t.Errorf("Expected the previous CSRF token to be rejected, got %d %q", code, errCode)
+	}
+
+	_, key, _ := CreateAPIKey(db, 1, "script", []string{ScopeUpload}, nil)
+	if code, _ := bearerDo(mux, key, "POST", "/api/whoami", ""); code != http.StatusOK {
+		t.Errorf("Expected API keys to need no CSRF token, got %d", code)
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	cfg, _, mux := testSessionServer(t)
+
+	cookies, _ := loginCookies(mux)
+	jwtC, csrfC, refreshC := cookies["jwt"], cookies[csrfCookie], cookies[refreshCookie]
+	if jwtC == nil || csrfC == nil || refreshC == nil {
+		t.Fatalf("Expected jwt, csrf and refresh cookies, got %v", cookies)
+	}
+	if jwtC.Secure || jwtC.SameSite != http.SameSiteLaxMode || !jwtC.HttpOnly || csrfC.HttpOnly || refreshC.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Unexpected default attributes %+v %+v %+v", jwtC, csrfC, refreshC)
+	}
+
+	cfg.Cookies = CookieConfig{SameSite: "none", Domain: "example.com"}
+	cookies, _ = loginCookies(mux)
+	if c := cookies["jwt"]; !c.Secure || c.SameSite != http.SameSiteNoneMode || c.Domain != "example.com" {
+		t.Errorf("Expected a secure cross-site cookie for example.com, got %+v", c)
+	}
+
+	cfg.Cookies = CookieConfig{HostPrefix: true, SameSite: "strict"}
+	cookies, _ = loginCookies(mux)
+	for name, path := range map[string]string{"__Host-jwt": "/", "__Host-csrf_token": "/", "__Secure-refresh_token": "/api"} {
+		c := cookies[name]
+		if c == nil || !c.Secure || c.Domain != "" || c.Path != path || c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("Unexpected %s cookie %+v", name, c)
+		}
+	}
+
+	jar := cookieJar{}
+	jar.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+	if code := jar.do(mux, "POST", "/api/refresh", ""); code != http.StatusOK {
+		t.Errorf("Expected refresh with prefixed cookies, got %d", code)
+	}
+	if code := jar.do(mux, "POST", "/api/logout-all", ""); code != http.StatusOK {
+		t.Errorf("Expected logout with prefixed cookies, got %d", code)
+	}
+	if len(jar) != 0 {
+		t.Errorf("Expected the prefixed cookies to be cleared, got %v", jar)
+	}
+}
+
+func TestCookieConfigValidate(t *testing.T) {
+	for _, c := range []CookieConfig{{}, {SameSite: "Strict"}, {HostPrefix: true, Secure: true}} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", c, err)
+		}
+	}
+	for _, c := range []CookieConfig{{SameSite: "sometimes"}, {HostPrefix: true, Domain: "example.com"}} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", c)
+		}
+	}
+}
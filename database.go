@@ -2,18 +2,15 @@ package main
 
 import (
 	"database/sql"
-	"os"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func InitDB(cfg *Config) (*sql.DB, error) {
-	photosDir := cfg.Photos.Directory
-	if err := os.MkdirAll(photosDir, os.ModePerm); err != nil {
-		return nil, err
-	}
-
 	db, err := sql.Open("sqlite3", cfg.Database.File)
 	if err != nil {
 		return nil, err
@@ -32,12 +29,132 @@ func InitDB(cfg *Config) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := initRoles(db); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "users", "email", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "users", "mustChangePassword", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "users", "passwordChangedAt", "TEXT"); err != nil {
+		return nil, err
+	}
+	// Set only for addresses confirmed by an identity provider, /api/change-email clears it
+	if err := addColumnIfMissing(db, "users", "emailVerified", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS sessions (
+		ID TEXT PRIMARY KEY,
+		userID INTEGER NOT NULL,
+		refreshHash TEXT NOT NULL,
+		userAgent TEXT,
+		createdAt TEXT NOT NULL,
+		lastUsedAt TEXT NOT NULL,
+		expiresAt TEXT NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(userID);
+
+	CREATE TABLE IF NOT EXISTS password_resets (
+		tokenHash TEXT PRIMARY KEY,
+		userID INTEGER NOT NULL,
+		expiresAt TEXT NOT NULL,
+		used INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS password_history (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		userID INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		replacedAt TEXT NOT NULL,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_password_history_user ON password_history(userID);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		userID INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		keyHash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		createdAt TEXT NOT NULL,
+		expiresAt TEXT,
+		lastUsedAt TEXT,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(userID);
+
+	CREATE TABLE IF NOT EXISTS user_identities (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		userID INTEGER NOT NULL,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		createdAt TEXT NOT NULL,
+		lastLoginAt TEXT,
+		UNIQUE (issuer, subject),
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(userID);
+
+	CREATE TABLE IF NOT EXISTS oidc_logins (
+		stateHash TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		verifier TEXT NOT NULL,
+		expiresAt TEXT NOT NULL,
+		linkUserID INTEGER
+	);
+
+	CREATE TABLE IF NOT EXISTS failed_logins (
+		subject TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		lastFailureAt TEXT NOT NULL,
+		lockedUntil TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS user_totp (
+		userID INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		confirmed INTEGER NOT NULL DEFAULT 0,
+		lastCounter INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		userID INTEGER NOT NULL,
+		codeHash TEXT NOT NULL,
+		used INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addColumnIfMissing(db, "oidc_logins", "linkUserID", "INTEGER"); err != nil {
+		return nil, err
+	}
+
 	_, err = db.Exec(`
 	CREATE TABLE IF NOT EXISTS photos (
 		ID INTEGER PRIMARY KEY AUTOINCREMENT,
 		imagePath TEXT,
+		originalName TEXT,
 		imageIsPublic INTEGER NOT NULL,
 		userID INTEGER NOT NULL,
+		blobHash TEXT,
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		uploadedAt TEXT,
 		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE
 	);
 	`)
@@ -45,19 +162,202 @@ func InitDB(cfg *Config) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := addColumnIfMissing(db, "photos", "originalName", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err := migrateOriginalNames(db); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "photos", "blobHash", "TEXT"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "photos", "title", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "photos", "description", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	// Photos uploaded before this column existed have no upload date
+	if err := addColumnIfMissing(db, "photos", "uploadedAt", "TEXT"); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		storageKey TEXT NOT NULL,
+		format TEXT NOT NULL,
+		refCount INTEGER NOT NULL
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS photo_renditions (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		photoID INTEGER NOT NULL,
+		size TEXT NOT NULL,
+		imagePath TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		UNIQUE (photoID, size),
+		FOREIGN KEY (photoID) REFERENCES photos(ID) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS photo_metadata (
+		photoID INTEGER PRIMARY KEY,
+		captureDate TEXT,
+		cameraMake TEXT,
+		cameraModel TEXT,
+		lensModel TEXT,
+		exposureTime TEXT,
+		fNumber REAL,
+		iso INTEGER,
+		focalLength REAL,
+		orientation INTEGER,
+		latitude REAL,
+		longitude REAL,
+		altitude REAL,
+		FOREIGN KEY (photoID) REFERENCES photos(ID) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS albums (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		userID INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		isPublic INTEGER NOT NULL DEFAULT 0,
+		coverPhotoID INTEGER,
+		FOREIGN KEY (userID) REFERENCES users(ID) ON DELETE CASCADE,
+		FOREIGN KEY (coverPhotoID) REFERENCES photos(ID) ON DELETE SET NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS album_photos (
+		albumID INTEGER NOT NULL,
+		photoID INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (albumID, photoID),
+		FOREIGN KEY (albumID) REFERENCES albums(ID) ON DELETE CASCADE,
+		FOREIGN KEY (photoID) REFERENCES photos(ID) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS photo_tags (
+		photoID INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (photoID, tag),
+		FOREIGN KEY (photoID) REFERENCES photos(ID) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_photo_tags_tag ON photo_tags(tag);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateStorageKeys(db, cfg.Photos.Directory); err != nil {
+		return nil, err
+	}
+	if err := initSearchIndex(db); err != nil {
+		return nil, err
+	}
+
 	var count int
 	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
 		return nil, err
 	}
 	if count == 0 {
-		hash, _ := bcrypt.GenerateFromPassword([]byte(cfg.Admin.DefaultPassword), bcrypt.DefaultCost)
-		_, _ = db.Exec("INSERT INTO users (login, password, isAdmin, isBanned) VALUES (?, ?, ?, ?)",
-			cfg.Admin.DefaultLogin, string(hash), 1, 0)
+		hash, _ := HashPassword(cfg.Admin.DefaultPassword)
+		_, _ = db.Exec("INSERT INTO users (login, password, isAdmin, isBanned, role) VALUES (?, ?, ?, ?, ?)",
+			cfg.Admin.DefaultLogin, hash, 1, 0, RoleAdmin)
+	}
+	// The maximum password age of accounts created before the column existed counts from now,
+	// accounts of single sign-on users have no password to expire
+	if _, err := db.Exec("UPDATE users SET passwordChangedAt = ? WHERE passwordChangedAt IS NULL AND password IS NOT NULL",
+		time.Now().UTC().Format(sessionTimeLayout)); err != nil {
+		return nil, err
 	}
 
 	return db, nil
 }
 
+// addColumnIfMissing extends tables created by older versions of the application.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrateOriginalNames fills the display name of photos stored before it was tracked,
+// when the file was named after the upload.
+func migrateOriginalNames(db *sql.DB) error {
+	rows, err := db.Query(`SELECT ID, imagePath FROM photos WHERE originalName IS NULL`)
+	if err != nil {
+		return err
+	}
+	names := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var path string
+		rows.Scan(&id, &path)
+		names[id] = filepath.Base(path)
+	}
+	rows.Close()
+
+	for id, name := range names {
+		if _, err := db.Exec(`UPDATE photos SET originalName = ? WHERE ID = ?`, name, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateStorageKeys converts paths stored by older versions ("<directory>/login/file")
+// into keys relative to the photo store ("login/file").
+func migrateStorageKeys(db *sql.DB, directory string) error {
+	prefix := strings.TrimSuffix(filepath.ToSlash(directory), "/") + "/"
+	for _, table := range []string{"photos", "photo_renditions"} {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE %s SET imagePath = substr(imagePath, ?) WHERE substr(imagePath, 1, ?) = ?`, table),
+			len(prefix)+1, len(prefix), prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func FindUser(db *sql.DB, u *User) (DBUser, bool) {
 	var dbU DBUser
 	err := db.QueryRow("SELECT ID, password FROM users WHERE login = ?", u.Login).Scan(&dbU.ID, &dbU.Password)
@@ -69,13 +369,69 @@ func FindUser(db *sql.DB, u *User) (DBUser, bool) {
 }
 
 func LoginUser(hash, password string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	return verifyPasswordHash(hash, password)
+}
+
+var globalPasswordHasher PasswordHasher
+
+func InitPasswordHasher(cfg *Config) error {
+	h, err := GetPasswordHasher(cfg)
+	if err != nil {
+		return err
+	}
+	globalPasswordHasher = h
+	return nil
+}
+
+func passwordHasher() PasswordHasher {
+	if globalPasswordHasher == nil {
+		globalPasswordHasher = &BcryptHasher{}
+	}
+	return globalPasswordHasher
+}
+
+// HashPassword hashes a password with the configured algorithm.
+func HashPassword(password string) (string, error) {
+	return passwordHasher().Hash(password)
+}
+
+// RehashPasswordIfNeeded replaces a verified hash made with an outdated algorithm or
+// parameters. It needs the plain password, so it runs right after a successful login.
+func RehashPasswordIfNeeded(db *sql.DB, userID int64, hash, password string) error {
+	if !passwordHasher().NeedsRehash(hash) {
+		return nil
+	}
+	newHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = ? WHERE ID = ? AND password = ?", newHash, userID, hash)
+	return err
 }
 
 var globalPasswordValidator PasswordValidator
 
-func InitPasswordValidator(cfg *Config) {
+// InitPasswordValidator builds the password policy: the configured modes followed by
+// the blocklist and the password history.
+func InitPasswordValidator(cfg *Config) error {
 	globalPasswordValidator = GetPasswordValidator(cfg)
+	globalPasswordHistory = passwordHistoryConfig(cfg)
+
+	policy := &PasswordPolicy{Validators: []PasswordValidator{globalPasswordValidator}}
+	if cfg.Password != nil && cfg.Password.Blocklist != nil {
+		v, err := NewBlocklistValidator(*cfg.Password.Blocklist)
+		if err != nil {
+			return err
+		}
+		policy.Validators = append(policy.Validators, v)
+	}
+	if globalPasswordHistory.Remember > 0 {
+		policy.Validators = append(policy.Validators, &HistoryValidator{Remember: globalPasswordHistory.Remember})
+	}
+	if len(policy.Validators) > 1 {
+		globalPasswordValidator = policy
+	}
+	return nil
 }
 
 func ValidatePassword(password string) error {
@@ -86,12 +442,21 @@ func ValidatePassword(password string) error {
 	return globalPasswordValidator.Validate(password)
 }
 
+// ValidatePasswordFor validates a password the subject is about to set.
+func ValidatePasswordFor(password string, subject PasswordSubject) error {
+	if globalPasswordValidator == nil {
+		globalPasswordValidator = &EasyValidator{}
+	}
+	return validateFor(globalPasswordValidator, password, subject)
+}
+
 func RegisterUser(db *sql.DB, u *User) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	hash, err := HashPassword(u.Password)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT INTO users (login, password, isAdmin, isBanned) VALUES (?, ?, ?, ?)", u.Login, string(hash), 0, 0)
+	_, err = db.Exec("INSERT INTO users (login, password, isAdmin, isBanned, role, email, passwordChangedAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		u.Login, hash, 0, 0, RoleUser, nullString(u.Email), time.Now().UTC().Format(sessionTimeLayout))
 	return err
 }
 
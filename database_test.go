@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"golang.org/x/crypto/bcrypt"
@@ -183,3 +185,82 @@ func TestValidatePassword(t *testing.T) {
 	}
 }
 
+
+func TestInitDBMigratesPhotos(t *testing.T) {
+	tmpDB := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite3", tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE photos (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		imagePath TEXT,
+		imageIsPublic INTEGER NOT NULL,
+		userID INTEGER NOT NULL
+	);
+	INSERT INTO photos (imagePath, imageIsPublic, userID) VALUES ('photos/user/holiday.jpg', 1, 1);
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	cfg := &Config{
+		Database: DatabaseConfig{File: tmpDB},
+		Photos:   PhotosConfig{Directory: "photos"},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	var key, name string
+	if err := db.QueryRow(`SELECT imagePath, originalName FROM photos WHERE ID = 1`).Scan(&key, &name); err != nil {
+		t.Fatalf("Failed to read migrated photo: %v", err)
+	}
+	if name != "holiday.jpg" {
+		t.Errorf("Expected original name holiday.jpg, got %s", name)
+	}
+	if key != "user/holiday.jpg" {
+		t.Errorf("Expected storage key user/holiday.jpg, got %s", key)
+	}
+}
+
+func TestInitDBMigratesAdminsToRoles(t *testing.T) {
+	tmpDB := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite3", tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE users (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		login TEXT UNIQUE,
+		password TEXT,
+		isAdmin INTEGER NOT NULL,
+		isBanned INTEGER NOT NULL
+	);
+	INSERT INTO users (login, password, isAdmin, isBanned) VALUES ('boss', 'x', 1, 0), ('user', 'x', 0, 0);
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	db, err := InitDB(&Config{Database: DatabaseConfig{File: tmpDB}})
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	for login, want := range map[string]string{"boss": RoleAdmin, "user": RoleUser} {
+		var role string
+		db.QueryRow(`SELECT role FROM users WHERE login = ?`, login).Scan(&role)
+		if role != want {
+			t.Errorf("Expected %s to have role %s, got %s", login, want, role)
+		}
+	}
+}
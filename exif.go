@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNoEXIF = errors.New("no EXIF data found")
+
+type PhotoMetadata struct {
+	CaptureDate  string   `json:"captureDate,omitempty"`
+	CameraMake   string   `json:"cameraMake,omitempty"`
+	CameraModel  string   `json:"cameraModel,omitempty"`
+	LensModel    string   `json:"lensModel,omitempty"`
+	ExposureTime string   `json:"exposureTime,omitempty"`
+	FNumber      float64  `json:"fNumber,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focalLength,omitempty"`
+	Orientation  int      `json:"orientation,omitempty"`
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	Altitude     *float64 `json:"altitude,omitempty"`
+}
+
+// EXIF tags read by ParseEXIF
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagExifIFD          = 0x8769
+	tagISO              = 0x8827
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// Sizes in bytes of the TIFF field types, indexed by type id
+var tiffTypeSize = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(b []byte) (*tiffReader, error) {
+	if len(b) < 8 {
+		return nil, ErrNoEXIF
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, ErrNoEXIF
+	}
+	if order.Uint16(b[2:4]) != 42 {
+		return nil, ErrNoEXIF
+	}
+	return &tiffReader{b: b, order: order}, nil
+}
+
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.b[4:8])
+}
+
+// readIFD returns the entries of the IFD at offset. Malformed entries are skipped.
+func (t *tiffReader) readIFD(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if offset == 0 || uint64(offset)+2 > uint64(len(t.b)) {
+		return entries
+	}
+
+	n := uint32(t.order.Uint16(t.b[offset:]))
+	for i := uint32(0); i < n; i++ {
+		pos := uint64(offset) + 2 + uint64(i)*12
+		if pos+12 > uint64(len(t.b)) {
+			break
+		}
+		e := t.b[pos : pos+12]
+		tag := t.order.Uint16(e[0:2])
+		typ := t.order.Uint16(e[2:4])
+		count := t.order.Uint32(e[4:8])
+
+		size, ok := tiffTypeSize[typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(count)
+		var data []byte
+		if total <= 4 {
+			data = e[8 : 8+total]
+		} else {
+			off := uint64(t.order.Uint32(e[8:12]))
+			if off+total > uint64(len(t.b)) {
+				continue
+			}
+			data = t.b[off : off+total]
+		}
+		entries[tag] = tiffEntry{typ: typ, count: count, data: data}
+	}
+	return entries
+}
+
+func (t *tiffReader) ascii(e tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (t *tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch e.typ {
+	case 1, 7:
+		if len(e.data) >= 1 {
+			return uint32(e.data[0]), true
+		}
+	case 3:
+		if len(e.data) >= 2 {
+			return uint32(t.order.Uint16(e.data)), true
+		}
+	case 4, 9:
+		if len(e.data) >= 4 {
+			return t.order.Uint32(e.data), true
+		}
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rational(e tiffEntry, i int) (num, den int64, ok bool) {
+	if (e.typ != 5 && e.typ != 10) || len(e.data) < (i+1)*8 {
+		return 0, 0, false
+	}
+	n := t.order.Uint32(e.data[i*8:])
+	d := t.order.Uint32(e.data[i*8+4:])
+	if e.typ == 10 {
+		return int64(int32(n)), int64(int32(d)), d != 0
+	}
+	return int64(n), int64(d), d != 0
+}
+
+func (t *tiffReader) float(e tiffEntry, i int) (float64, bool) {
+	num, den, ok := t.rational(e, i)
+	if !ok {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+func (t *tiffReader) gpsCoordinate(e tiffEntry, ref tiffEntry, negative string) (*float64, bool) {
+	deg, ok1 := t.float(e, 0)
+	minutes, ok2 := t.float(e, 1)
+	seconds, ok3 := t.float(e, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, false
+	}
+	v := deg + minutes/60 + seconds/3600
+	if strings.EqualFold(t.ascii(ref), negative) {
+		v = -v
+	}
+	return &v, true
+}
+
+func formatExposure(num, den int64) string {
+	if num <= 0 || den <= 0 {
+		return ""
+	}
+	if num < den {
+		return fmt.Sprintf("1/%d", (den+num/2)/num)
+	}
+	return fmt.Sprintf("%g", float64(num)/float64(den))
+}
+
+// normalizeEXIFDate converts "2006:01:02 15:04:05" into "2006-01-02T15:04:05".
+func normalizeEXIFDate(s string) string {
+	d, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return ""
+	}
+	return d.Format("2006-01-02T15:04:05")
+}
+
+// ParseTIFFMetadata reads the metadata from a TIFF structure (the payload of a JPEG
+// APP1 Exif segment or a whole TIFF file).
+func ParseTIFFMetadata(b []byte) (*PhotoMetadata, error) {
+	t, err := newTIFFReader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &PhotoMetadata{}
+	ifd0 := t.readIFD(t.firstIFD())
+	if e, ok := ifd0[tagMake]; ok {
+		md.CameraMake = t.ascii(e)
+	}
+	if e, ok := ifd0[tagModel]; ok {
+		md.CameraModel = t.ascii(e)
+	}
+	if e, ok := ifd0[tagOrientation]; ok {
+		if v, ok := t.uint(e); ok {
+			md.Orientation = int(v)
+		}
+	}
+	if e, ok := ifd0[tagDateTime]; ok {
+		md.CaptureDate = normalizeEXIFDate(t.ascii(e))
+	}
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			exif := t.readIFD(off)
+			if e, ok := exif[tagDateTimeOriginal]; ok {
+				if d := normalizeEXIFDate(t.ascii(e)); d != "" {
+					md.CaptureDate = d
+				}
+			}
+			if e, ok := exif[tagExposureTime]; ok {
+				if num, den, ok := t.rational(e, 0); ok {
+					md.ExposureTime = formatExposure(num, den)
+				}
+			}
+			if e, ok := exif[tagFNumber]; ok {
+				md.FNumber, _ = t.float(e, 0)
+			}
+			if e, ok := exif[tagISO]; ok {
+				if v, ok := t.uint(e); ok {
+					md.ISO = int(v)
+				}
+			}
+			if e, ok := exif[tagFocalLength]; ok {
+				md.FocalLength, _ = t.float(e, 0)
+			}
+			if e, ok := exif[tagLensModel]; ok {
+				md.LensModel = t.ascii(e)
+			}
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			gps := t.readIFD(off)
+			if e, ok := gps[tagGPSLatitude]; ok {
+				md.Latitude, _ = t.gpsCoordinate(e, gps[tagGPSLatitudeRef], "S")
+			}
+			if e, ok := gps[tagGPSLongitude]; ok {
+				md.Longitude, _ = t.gpsCoordinate(e, gps[tagGPSLongitudeRef], "W")
+			}
+			if e, ok := gps[tagGPSAltitude]; ok {
+				if v, ok := t.float(e, 0); ok {
+					if ref, ok := t.uint(gps[tagGPSAltitudeRef]); ok && ref == 1 {
+						v = -v
+					}
+					md.Altitude = &v
+				}
+			}
+		}
+	}
+
+	return md, nil
+}
+
+// findJPEGExif returns the TIFF payload of the first APP1 Exif segment of a JPEG file.
+func findJPEGExif(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, ErrNoEXIF
+	}
+	pos := 2
+	for pos+4 <= len(b) {
+		if b[pos] != 0xFF {
+			return nil, ErrNoEXIF
+		}
+		marker := b[pos+1]
+		// Start of scan - no more metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(b[pos+2:]))
+		if length < 2 || pos+2+length > len(b) {
+			return nil, ErrNoEXIF
+		}
+		payload := b[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:], nil
+		}
+		pos += 2 + length
+	}
+	return nil, ErrNoEXIF
+}
+
+// ParseEXIF extracts the photo metadata from JPEG or TIFF-based image data.
+func ParseEXIF(b []byte) (*PhotoMetadata, error) {
+	if len(b) >= 2 && (string(b[:2]) == "II" || string(b[:2]) == "MM") {
+		return ParseTIFFMetadata(b)
+	}
+	tiff, err := findJPEGExif(b)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTIFFMetadata(tiff)
+}
+
+// ExtractMetadata reads the metadata of an image.
+func ExtractMetadata(r io.Reader) (*PhotoMetadata, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseEXIF(b)
+}
+
+func SavePhotoMetadata(db *sql.DB, photoID int64, md *PhotoMetadata) error {
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO photo_metadata
+			(photoID, captureDate, cameraMake, cameraModel, lensModel, exposureTime, fNumber, iso, focalLength, orientation, latitude, longitude, altitude)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		photoID, md.CaptureDate, md.CameraMake, md.CameraModel, md.LensModel, md.ExposureTime,
+		md.FNumber, md.ISO, md.FocalLength, md.Orientation, md.Latitude, md.Longitude, md.Altitude)
+	return err
+}
+
+func GetPhotoMetadata(db *sql.DB, photoID int64) (*PhotoMetadata, bool) {
+	var md PhotoMetadata
+	var lat, lon, alt sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT captureDate, cameraMake, cameraModel, lensModel, exposureTime, fNumber, iso, focalLength, orientation, latitude, longitude, altitude
+		FROM photo_metadata WHERE photoID = ?`, photoID).Scan(
+		&md.CaptureDate, &md.CameraMake, &md.CameraModel, &md.LensModel, &md.ExposureTime,
+		&md.FNumber, &md.ISO, &md.FocalLength, &md.Orientation, &lat, &lon, &alt)
+	if err != nil {
+		return nil, false
+	}
+	if lat.Valid {
+		md.Latitude = &lat.Float64
+	}
+	if lon.Valid {
+		md.Longitude = &lon.Float64
+	}
+	if alt.Valid {
+		md.Altitude = &alt.Float64
+	}
+	return &md, true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+type testTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(tag uint16, v uint16) testTag {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return testTag{tag, 3, 1, b}
+}
+
+func longTag(tag uint16, v uint32) testTag {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return testTag{tag, 4, 1, b}
+}
+
+func rationalTag(tag uint16, vals ...uint32) testTag {
+	b := make([]byte, len(vals)*4)
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+	return testTag{tag, 5, uint32(len(vals) / 2), b}
+}
+
+// buildTestTIFF creates a little-endian TIFF structure with IFD0, an Exif IFD and a GPS IFD.
+func buildTestTIFF(ifd0, exif, gps []testTag) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{'I', 'I', 42, 0, 8, 0, 0, 0})
+
+	ifdSize := func(tags []testTag) int { return 2 + len(tags)*12 + 4 }
+	// IFD0 gets two extra pointer entries
+	exifOff := 8 + ifdSize(ifd0) + 24
+	gpsOff := exifOff + ifdSize(exif)
+	dataOff := gpsOff + ifdSize(gps)
+	ifd0 = append(ifd0, longTag(tagExifIFD, uint32(exifOff)), longTag(tagGPSIFD, uint32(gpsOff)))
+
+	var data []byte
+	writeIFD := func(tags []testTag) {
+		binary.Write(buf, binary.LittleEndian, uint16(len(tags)))
+		for _, tg := range tags {
+			binary.Write(buf, binary.LittleEndian, tg.tag)
+			binary.Write(buf, binary.LittleEndian, tg.typ)
+			binary.Write(buf, binary.LittleEndian, tg.count)
+			value := make([]byte, 4)
+			if len(tg.data) <= 4 {
+				copy(value, tg.data)
+			} else {
+				binary.LittleEndian.PutUint32(value, uint32(dataOff+len(data)))
+				data = append(data, tg.data...)
+			}
+			buf.Write(value)
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(0))
+	}
+	writeIFD(ifd0)
+	writeIFD(exif)
+	writeIFD(gps)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func testEXIFTIFF() []byte {
+	return buildTestTIFF(
+		[]testTag{asciiTag(tagMake, "Canon"), asciiTag(tagModel, "EOS R6"), shortTag(tagOrientation, 6)},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2024:05:17 10:20:30"),
+			rationalTag(tagExposureTime, 1, 250),
+			rationalTag(tagFNumber, 28, 10),
+			shortTag(tagISO, 400),
+			rationalTag(tagFocalLength, 50, 1),
+			asciiTag(tagLensModel, "RF50mm F1.8 STM"),
+		},
+		[]testTag{
+			asciiTag(tagGPSLatitudeRef, "N"),
+			rationalTag(tagGPSLatitude, 52, 1, 13, 1, 48, 1),
+			asciiTag(tagGPSLongitudeRef, "E"),
+			rationalTag(tagGPSLongitude, 21, 1, 0, 1, 36, 1),
+		},
+	)
+}
+
+// testJPEGWithEXIF returns a small JPEG with the APP1 Exif segment inserted after SOI.
+func testJPEGWithEXIF(t *testing.T, tiff []byte) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+
+	out := append([]byte{}, img.Bytes()[:2]...)
+	out = append(out, seg...)
+	out = append(out, payload...)
+	return append(out, img.Bytes()[2:]...)
+}
+
+func TestParseEXIF(t *testing.T) {
+	md, err := ParseEXIF(testJPEGWithEXIF(t, testEXIFTIFF()))
+	if err != nil {
+		t.Fatalf("ParseEXIF failed: %v", err)
+	}
+
+	if md.CameraMake != "Canon" || md.CameraModel != "EOS R6" {
+		t.Errorf("Unexpected camera %q %q", md.CameraMake, md.CameraModel)
+	}
+	if md.LensModel != "RF50mm F1.8 STM" {
+		t.Errorf("Unexpected lens %q", md.LensModel)
+	}
+	if md.CaptureDate != "2024-05-17T10:20:30" {
+		t.Errorf("Unexpected capture date %q", md.CaptureDate)
+	}
+	if md.ExposureTime != "1/250" {
+		t.Errorf("Unexpected exposure time %q", md.ExposureTime)
+	}
+	if md.FNumber != 2.8 || md.ISO != 400 || md.FocalLength != 50 || md.Orientation != 6 {
+		t.Errorf("Unexpected exposure values %+v", md)
+	}
+	if md.Latitude == nil || math.Abs(*md.Latitude-52.23) > 0.001 {
+		t.Errorf("Unexpected latitude %v", md.Latitude)
+	}
+	if md.Longitude == nil || math.Abs(*md.Longitude-21.01) > 0.001 {
+		t.Errorf("Unexpected longitude %v", md.Longitude)
+	}
+}
+
+func TestParseEXIFWithoutMetadata(t *testing.T) {
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+
+	if _, err := ParseEXIF(img.Bytes()); err != ErrNoEXIF {
+		t.Errorf("Expected ErrNoEXIF, got %v", err)
+	}
+
+	if _, err := ParseEXIF([]byte("not an image")); err != ErrNoEXIF {
+		t.Errorf("Expected ErrNoEXIF for garbage, got %v", err)
+	}
+}
+
+func TestPhotoMetadataStorage(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Photos:   PhotosConfig{Directory: t.TempDir()},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	md, _ := ParseTIFFMetadata(testEXIFTIFF())
+	if err := SavePhotoMetadata(db, 1, md); err != nil {
+		t.Fatalf("SavePhotoMetadata failed: %v", err)
+	}
+
+	got, found := GetPhotoMetadata(db, 1)
+	if !found {
+		t.Fatal("Expected stored metadata")
+	}
+	if got.CameraModel != "EOS R6" || got.Latitude == nil || *got.Latitude != *md.Latitude {
+		t.Errorf("Stored metadata differs: %+v", got)
+	}
+
+	if _, found := GetPhotoMetadata(db, 2); found {
+		t.Error("Expected no metadata for unknown photo")
+	}
+}
@@ -7,3 +7,5 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.32
 	golang.org/x/crypto v0.45.0
 )
+
+require golang.org/x/sys v0.38.0 // indirect
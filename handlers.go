@@ -3,15 +3,15 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
-func HandleLogin(cfg *Config, db *sql.DB) http.HandlerFunc {
+func HandleLogin(cfg *Config, db *sql.DB, limiter *LoginLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -24,31 +24,98 @@ func HandleLogin(cfg *Config, db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		attempt, wait, err := limiter.Reserve(clientIP(r), user.Login)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+
+		// The attempt already counts as failed, it is taken back once the password matches
 		dbU, found := FindUser(db, &user)
 		if !found || !LoginUser(dbU.Password, user.Password) {
 			http.Error(w, "Invalid login or password", http.StatusUnauthorized)
 			return
 		}
+		if err := RehashPasswordIfNeeded(db, dbU.ID, dbU.Password, user.Password); err != nil {
+			fmt.Printf("Password rehash for %s failed: %v\n", dbU.Login, err)
+		}
 
-		token, _ := GenerateJWT(cfg, dbU.ID, dbU.Login)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "jwt",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-		})
+		principal, err := LoadPrincipal(db, dbU.ID)
+		if err != nil {
+			attempt.Cancel()
+			writeAuthError(w, err)
+			return
+		}
 
-		var isAdmin int
-		_ = db.QueryRow("SELECT isAdmin FROM users WHERE ID = ?", dbU.ID).Scan(&isAdmin)
+		if TOTPEnabled(db, dbU.ID) {
+			attempt.Cancel()
+			mfaToken, err := GenerateMFAToken(cfg, dbU.ID, false)
+			if err != nil {
+				http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":   "mfa_required",
+				"mfaToken": mfaToken,
+			})
+			return
+		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"status":  "ok",
-			"isAdmin": isAdmin != 0,
-		})
+		// With 2FA the failures are cleared only after a valid code, otherwise knowing the
+		// password would allow resetting the counter between guessed codes
+		attempt.Succeed()
+		completeLogin(w, r, cfg, db, principal, false)
+	}
+}
+
+// completeLogin starts a session for the authenticated user and sets the auth cookies.
+// A user with an expired password gets a token to set a new one instead, unless the
+// login went through the identity provider.
+func completeLogin(w http.ResponseWriter, r *http.Request, cfg *Config, db *sql.DB, principal *Principal, sso bool) {
+	changedAt, expired, err := passwordExpiry(cfg, db, principal.ID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if expired && !sso {
+		writePasswordExpired(w, cfg, principal.ID, changedAt)
+		return
+	}
+
+	sessionID, refreshToken, err := CreateSession(cfg, db, principal.ID, r.UserAgent())
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	csrfToken, err := setAuthCookies(w, cfg, principal.ID, principal.Login, sessionID, refreshToken)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	mfaEnabled := TOTPEnabled(db, principal.ID)
+	enrollmentRequired := cfg.MFA.RequireForAdmins && principal.Role == RoleAdmin && !mfaEnabled
+	permissions := permissionList(principal.Permissions)
+	if enrollmentRequired {
+		permissions = []string{}
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":                "ok",
+		"isAdmin":               principal.Role == RoleAdmin,
+		"role":                  principal.Role,
+		"permissions":           permissions,
+		"mfaEnabled":            mfaEnabled,
+		"mfaEnrollmentRequired": enrollmentRequired,
+		"mustChangePassword":    principal.MustChangePassword,
+		"csrfToken":             csrfToken,
+	})
 }
 
 func HandleRegister(db *sql.DB) http.HandlerFunc {
@@ -64,10 +131,16 @@ func HandleRegister(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if err := ValidatePassword(user.Password); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := ValidatePasswordFor(user.Password, PasswordSubject{Login: user.Login}); err != nil {
+			writePasswordError(w, r, err)
 			return
 		}
+		if user.Email != "" {
+			if err := validateEmail(user.Email); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
 		if err := RegisterUser(db, &user); err != nil {
 			http.Error(w, "Registration failed", http.StatusBadRequest)
@@ -78,15 +151,24 @@ func HandleRegister(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func HandleAddPhoto(cfg *Config, db *sql.DB) http.HandlerFunc {
+func HandleAddPhoto(cfg *Config, db *sql.DB, store PhotoStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userID := r.Context().Value(ctxKeyID).(int64)
-		userLogin := r.Context().Value(ctxKeyLogin).(string)
+		userID := PrincipalFrom(r.Context()).ID
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.Photos.MaxUploadBytes()+multipartOverhead)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			if status := uploadErrorStatus(err); status == http.StatusRequestEntityTooLarge {
+				http.Error(w, ErrUploadTooLarge.Error(), status)
+				return
+			}
+			http.Error(w, "Failed to read photo", http.StatusBadRequest)
+			return
+		}
 
 		publicStr := r.FormValue("public")
 		imageIsPublic := 0
@@ -94,6 +176,18 @@ func HandleAddPhoto(cfg *Config, db *sql.DB) http.HandlerFunc {
 			imageIsPublic = 1
 		}
 
+		details := PhotoDetailsRequest{
+			Title:       r.FormValue("title"),
+			Description: r.FormValue("description"),
+		}
+		if tags := r.FormValue("tags"); tags != "" {
+			details.Tags = strings.Split(tags, ",")
+		}
+		if msg, ok := validatePhotoDetails(&details); !ok {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
 		file, header, err := r.FormFile("photo")
 		if err != nil {
 			http.Error(w, "Failed to read photo", http.StatusBadRequest)
@@ -101,22 +195,78 @@ func HandleAddPhoto(cfg *Config, db *sql.DB) http.HandlerFunc {
 		}
 		defer file.Close()
 
-		userDir := fmt.Sprintf("%s/%s", cfg.Photos.Directory, userLogin)
-		os.MkdirAll(userDir, os.ModePerm)
+		if header.Size > cfg.Photos.MaxUploadBytes() {
+			http.Error(w, ErrUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		format, err := ValidateImage(cfg, file)
+		if err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+
+		hash, err := hashContent(file)
+		if err != nil {
+			http.Error(w, "Failed to read photo", http.StatusBadRequest)
+			return
+		}
+		originalName := displayFilename(header.Filename)
+
+		if existingID, existingName, found := FindOwnedDuplicate(db, userID, hash); found {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]any{
+				"message":   "Photo already uploaded",
+				"id":        existingID,
+				"filename":  existingName,
+				"duplicate": true,
+			})
+			return
+		}
+
+		// The client filename is only kept for display, content is stored under its hash
+		key, err := AcquireBlob(db, store, hash, format, file)
+		if err != nil {
+			http.Error(w, "Failed to save photo", http.StatusInternalServerError)
+			return
+		}
+
+		res, err := db.Exec("INSERT INTO photos (imagePath, originalName, imageIsPublic, userID, blobHash, uploadedAt) VALUES (?, ?, ?, ?, ?, ?)",
+			key, originalName, imageIsPublic, userID, hash, time.Now().UTC().Format(uploadedAtLayout))
+		if err != nil {
+			ReleaseBlob(db, store, hash, key)
+			http.Error(w, "Failed to save photo", http.StatusInternalServerError)
+			return
+		}
 
-		filename := fmt.Sprintf("%s/%s", userDir, header.Filename)
-		out, _ := os.Create(filename)
-		defer out.Close()
-		io.Copy(out, file)
+		photoID, _ := res.LastInsertId()
+		if details.Title != "" || details.Description != "" || len(details.Tags) > 0 {
+			SetPhotoDetails(db, photoID, details.Title, details.Description, details.Tags)
+		} else {
+			indexPhoto(db, photoID)
+		}
 
-		db.Exec("INSERT INTO photos (imagePath, imageIsPublic, userID) VALUES (?, ?, ?)", filename, imageIsPublic, userID)
+		file.Seek(0, io.SeekStart)
+		if md, err := ExtractMetadata(file); err == nil {
+			SavePhotoMetadata(db, photoID, md)
+		}
+		if !CopyRenditions(db, photoID, hash) {
+			file.Seek(0, io.SeekStart)
+			if err := GenerateRenditions(cfg, db, store, photoID, key, file); err != nil {
+				fmt.Printf("Failed to generate renditions for %s: %v\n", key, err)
+			}
+		}
 
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Photo uploaded"})
+		json.NewEncoder(w).Encode(map[string]any{
+			"message":   "Photo uploaded",
+			"id":        photoID,
+			"filename":  originalName,
+			"duplicate": false,
+		})
 	}
 }
 
-func HandleGetPhotos(cfg *Config, db *sql.DB) http.HandlerFunc {
+func HandleGetPhotos(cfg *Config, db *sql.DB, store PhotoStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		parts := strings.Split(r.URL.Path, "/")
 		if len(parts) < 4 {
@@ -125,54 +275,155 @@ func HandleGetPhotos(cfg *Config, db *sql.DB) http.HandlerFunc {
 		}
 
 		userLogin := parts[3]
-		var filename string
-		if len(parts) >= 5 {
-			filename = parts[4]
-		}
+		owner, canViewPrivate := photoAccess(cfg, db, r, userLogin)
 
-		var authorized bool
-		if cookie, err := r.Cookie("jwt"); err == nil {
-			if claims, err := parseJWT(cfg, cookie.Value); err == nil {
-				authorized = claims["user_login"] == userLogin
+		if len(parts) >= 5 && parts[4] != "" {
+			photoID, ok := parsePhotoID(parts[4])
+			if !ok {
+				http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+				return
 			}
-		}
 
-		if filename != "" {
 			var imagePath string
 			var imageIsPublic int
-			err := db.QueryRow(`SELECT imagePath, imageIsPublic FROM photos p JOIN users u ON p.userID=u.ID WHERE u.login=? AND p.imagePath LIKE ?`, userLogin, "%/"+filename).Scan(&imagePath, &imageIsPublic)
-			if err != nil || (imageIsPublic == 0 && !authorized) {
+			err := db.QueryRow(`SELECT imagePath, imageIsPublic FROM photos p JOIN users u ON p.userID=u.ID WHERE u.login=? AND p.ID=?`, userLogin, photoID).Scan(&imagePath, &imageIsPublic)
+			if err != nil || (imageIsPublic == 0 && !canViewPrivate) {
 				http.Error(w, "Forbidden or not found", http.StatusForbidden)
 				return
 			}
-			http.ServeFile(w, r, imagePath)
+
+			originalPath := imagePath
+			if size := r.URL.Query().Get("size"); size != "" && size != "original" {
+				if _, ok := cfg.Photos.Sizes()[size]; !ok {
+					http.Error(w, "Unknown size", http.StatusBadRequest)
+					return
+				}
+				// Photos waiting for the backfill job fall back to the original
+				if path, ok := FindRendition(db, photoID, size); ok {
+					imagePath = path
+				}
+			}
+
+			// Other users get the original with metadata stripped according to the privacy policy
+			var transform func([]byte) ([]byte, error)
+			if !owner && imagePath == originalPath && cfg.Photos.PrivacyPolicy() != PrivacyNone {
+				transform = func(data []byte) ([]byte, error) {
+					return SanitizeImage(data, cfg.Photos.PrivacyPolicy())
+				}
+			}
+			if err := servePhoto(w, r, store, imagePath, transform); errors.Is(err, ErrMalformedImage) {
+				http.Error(w, "Photo cannot be served", http.StatusInternalServerError)
+			} else if err != nil {
+				http.Error(w, "Forbidden or not found", http.StatusForbidden)
+			}
 			return
 		}
 
-		rows, err := db.Query(`SELECT p.imagePath, p.imageIsPublic FROM photos p JOIN users u ON p.userID=u.ID WHERE u.login=?`, userLogin)
+		query, err := ParseListQuery(r.URL.Query())
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode([]Photo{})
+			http.Error(w, "Invalid query", http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var photos []Photo
-		for rows.Next() {
-			var imagePath string
-			var imageIsPublic int
-			rows.Scan(&imagePath, &imageIsPublic)
-			if imageIsPublic != 0 || authorized {
-				photos = append(photos, Photo{Filename: filepath.Base(imagePath), Public: imageIsPublic != 0})
-			}
+		rows, total, next, err := QueryPhotoPage(db, `u.login = ? AND (p.imageIsPublic = 1 OR ?)`, []any{userLogin, canViewPrivate}, query)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		photos := make([]Photo, 0, len(rows))
+		for _, p := range rows {
+			photos = append(photos, Photo{ID: p.ID, Filename: p.Filename, Public: p.Public, UploadedAt: p.UploadedAt})
+		}
+		writePage(w, photos, total, next)
+	}
+}
+
+// writePage sends a page of a listing, nextCursor is null on the last page.
+func writePage(w http.ResponseWriter, items any, total int, next string) {
+	var cursor any
+	if next != "" {
+		cursor = next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"items":      items,
+		"total":      total,
+		"nextCursor": cursor,
+	})
+}
+
+// isPhotoOwner reports whether the request carries a valid token of the given user.
+func isPhotoOwner(cfg *Config, db *sql.DB, r *http.Request, userLogin string) bool {
+	p, err := authenticate(cfg, db, r)
+	return err == nil && p.Login == userLogin
+}
+
+// photoAccess reports whether the request comes from the owner of the photos of the
+// given user and whether it may see the private ones, which users allowed to view all
+// photos can. Only the owner gets originals with unchanged metadata.
+func photoAccess(cfg *Config, db *sql.DB, r *http.Request, userLogin string) (bool, bool) {
+	p, err := authenticate(cfg, db, r)
+	if err != nil {
+		return false, false
+	}
+	owner := p.Login == userLogin
+	return owner, owner || p.Can(PermViewAllPhotos)
+}
+
+// requestUserID returns the ID of the user whose token the request carries, if any.
+// Banned users are treated as anonymous.
+func requestUserID(cfg *Config, db *sql.DB, r *http.Request) (int64, bool) {
+	p, err := authenticate(cfg, db, r)
+	if err != nil {
+		return 0, false
+	}
+	return p.ID, true
+}
+
+func HandleGetPhotoMetadata(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 5 || parts[4] == "" {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+
+		userLogin := parts[3]
+		photoID, ok := parsePhotoID(parts[4])
+		if !ok {
+			http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+			return
+		}
+
+		var imageIsPublic int
+		err := db.QueryRow(`SELECT imageIsPublic FROM photos p JOIN users u ON p.userID=u.ID WHERE u.login=? AND p.ID=?`, userLogin, photoID).Scan(&imageIsPublic)
+		owner, canViewPrivate := photoAccess(cfg, db, r, userLogin)
+		if err != nil || (imageIsPublic == 0 && !canViewPrivate) {
+			http.Error(w, "Forbidden or not found", http.StatusForbidden)
+			return
+		}
+
+		md, found := GetPhotoMetadata(db, photoID)
+		if !found {
+			http.Error(w, "Metadata not found", http.StatusNotFound)
+			return
+		}
+		if !owner {
+			md = SanitizeMetadata(md, cfg.Photos.PrivacyPolicy())
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(photos)
+		json.NewEncoder(w).Encode(md)
 	}
 }
 
-func HandleDeletePhoto(cfg *Config, db *sql.DB) http.HandlerFunc {
+func HandleDeletePhoto(cfg *Config, db *sql.DB, store PhotoStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -186,18 +437,24 @@ func HandleDeletePhoto(cfg *Config, db *sql.DB) http.HandlerFunc {
 		}
 
 		userLogin := parts[3]
-		filename := parts[4]
-		userID := r.Context().Value(ctxKeyID).(int64)
+		userID := PrincipalFrom(r.Context()).ID
+		photoID, ok := parsePhotoID(parts[4])
+		if !ok {
+			http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+			return
+		}
 
 		var dbUserID int64
-		err := db.QueryRow(`SELECT u.ID FROM users u JOIN photos p ON p.userID=u.ID WHERE u.login=? AND p.imagePath=?`, userLogin, fmt.Sprintf("%s/%s/%s", cfg.Photos.Directory, userLogin, filename)).Scan(&dbUserID)
+		err := db.QueryRow(`SELECT u.ID FROM users u JOIN photos p ON p.userID=u.ID WHERE u.login=? AND p.ID=?`, userLogin, photoID).Scan(&dbUserID)
 		if err != nil || dbUserID != userID {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		os.Remove(fmt.Sprintf("%s/%s/%s", cfg.Photos.Directory, userLogin, filename))
-		db.Exec(`DELETE FROM photos WHERE imagePath=?`, fmt.Sprintf("%s/%s/%s", cfg.Photos.Directory, userLogin, filename))
+		if err := DeletePhoto(db, store, photoID); err != nil {
+			http.Error(w, "Failed to delete photo", http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Photo deleted"})
@@ -211,8 +468,7 @@ func HandleTogglePhotoPublic(cfg *Config, db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		userID := r.Context().Value(ctxKeyID).(int64)
-		userLogin := r.Context().Value(ctxKeyLogin).(string)
+		userID := PrincipalFrom(r.Context()).ID
 
 		var req UpdatePublicRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -220,16 +476,15 @@ func HandleTogglePhotoPublic(cfg *Config, db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		imagePath := fmt.Sprintf("%s/%s/%s", cfg.Photos.Directory, userLogin, req.Filename)
-
+		// Moderators may hide photos of other users, but not publish them
 		var dbUserID int64
-		err := db.QueryRow(`SELECT userID FROM photos WHERE userID=? AND imagePath=?`, userID, imagePath).Scan(&dbUserID)
-		if err != nil || dbUserID != userID {
+		err := db.QueryRow(`SELECT userID FROM photos WHERE ID=?`, req.ID).Scan(&dbUserID)
+		if err != nil || (dbUserID != userID && !(req.Public == 0 && PrincipalFrom(r.Context()).Can(PermHidePhotos))) {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		_, err = db.Exec(`UPDATE photos SET imageIsPublic=? WHERE userID=? AND imagePath=?`, req.Public, userID, imagePath)
+		_, err = db.Exec(`UPDATE photos SET imageIsPublic=? WHERE ID=?`, req.Public, req.ID)
 		if err != nil {
 			http.Error(w, "Failed to update photo", http.StatusInternalServerError)
 			return
@@ -245,57 +500,43 @@ func HandleTogglePhotoPublic(cfg *Config, db *sql.DB) http.HandlerFunc {
 
 func HandlePublicGallery(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`
-			SELECT u.login, p.imagePath 
-			FROM photos p 
-			JOIN users u ON p.userID = u.ID 
-			WHERE p.imageIsPublic = 1 AND u.isBanned = 0
-			ORDER BY p.ID DESC
-		`)
+		query, err := ParseListQuery(r.URL.Query())
 		if err != nil {
-			http.Error(w, "DB error", http.StatusInternalServerError)
+			http.Error(w, "Invalid query", http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var list []PublicPhoto
-
-		for rows.Next() {
-			var login string
-			var path string
-			rows.Scan(&login, &path)
-
-			list = append(list, PublicPhoto{
-				User:     login,
-				Filename: filepath.Base(path),
-			})
+		rows, total, next, err := QueryPhotoPage(db, `p.imageIsPublic = 1 AND u.isBanned = 0`, nil, query)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(list)
+		list := make([]PublicPhoto, 0, len(rows))
+		for _, p := range rows {
+			list = append(list, PublicPhoto{User: p.User, ID: p.ID, Filename: p.Filename, UploadedAt: p.UploadedAt})
+		}
+		writePage(w, list, total, next)
 	}
 }
 
 func HandleGetUsers(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`SELECT login, isAdmin, isBanned FROM users ORDER BY login`)
+		// Administrators are not listed, as before roles were introduced
+		rows, err := db.Query(`SELECT login, role, isBanned FROM users WHERE role != ? ORDER BY login`, RoleAdmin)
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
 		}
 		defer rows.Close()
 
-		var users []UserResponse
+		users := []UserResponse{}
 		for rows.Next() {
-			var login string
-			var isAdmin, isBanned int
-			rows.Scan(&login, &isAdmin, &isBanned)
-			if isAdmin == 0 {
-				users = append(users, UserResponse{
-					Login:    login,
-					IsBanned: isBanned != 0,
-				})
-			}
+			var u UserResponse
+			var isBanned int
+			rows.Scan(&u.Login, &u.Role, &isBanned)
+			u.IsBanned = isBanned != 0
+			users = append(users, u)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -310,25 +551,35 @@ func HandleManageBanStatus(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		isAdmin := r.Context().Value("isAdmin").(bool)
-		if !isAdmin {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-
 		var req ManageBanRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
 
-		userLogin := r.Context().Value(ctxKeyLogin).(string)
-		if req.Login == userLogin {
+		principal := PrincipalFrom(r.Context())
+		if req.Login == principal.Login {
 			http.Error(w, "Cannot ban yourself", http.StatusForbidden)
 			return
 		}
 
-		_, err := db.Exec("UPDATE users SET isBanned = ? WHERE login = ?", req.Banned, req.Login)
+		// Only users who manage roles may ban someone who does
+		var role string
+		if err := db.QueryRow("SELECT role FROM users WHERE login = ?", req.Login).Scan(&role); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		targetPerms, err := RolePermissions(db, role)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if targetPerms[PermManageRoles] && !principal.Can(PermManageRoles) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		_, err = db.Exec("UPDATE users SET isBanned = ? WHERE login = ?", req.Banned, req.Login)
 		if err != nil {
 			http.Error(w, "Failed to update ban status", http.StatusInternalServerError)
 			return
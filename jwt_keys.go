@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing and verification keys of the tokens. Without configured keys tokens are
+// signed with HS256 and the secret key. With RSA or Ed25519 keys from PEM files the
+// tokens carry the kid of their key, so old keys can keep verifying tokens while new
+// ones are signed with the next key.
+
+const minRSAKeyBits = 2048
+
+var ErrUnknownSigningKey = errors.New("unknown token signing key")
+
+type jwtKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private any // nil for keys that only verify
+	public  any
+}
+
+// JWTKeyring holds the key new tokens are signed with and all keys tokens are
+// verified with.
+type JWTKeyring struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+	methods []string
+}
+
+// Keyrings loaded by JWTConfig.Keyring. They are kept outside of JWTConfig, which is
+// copied by value, so the lazy loading cannot race with readers of the copies.
+var (
+	keyringMu sync.Mutex
+	keyrings  = map[*JWTConfig]*JWTKeyring{}
+)
+
+// Keyring loads the keys on first use. Concurrent callers get the same keyring.
+func (j *JWTConfig) Keyring() (*JWTKeyring, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	if keyring, ok := keyrings[j]; ok {
+		return keyring, nil
+	}
+	keyring, err := LoadJWTKeyring(*j)
+	if err != nil {
+		return nil, err
+	}
+	keyrings[j] = keyring
+	return keyring, nil
+}
+
+func LoadJWTKeyring(cfg JWTConfig) (*JWTKeyring, error) {
+	if len(cfg.Keys) == 0 {
+		key := &jwtKey{method: jwt.SigningMethodHS256, private: []byte(cfg.SecretKey), public: []byte(cfg.SecretKey)}
+		return &JWTKeyring{signing: key, keys: map[string]*jwtKey{"": key}, methods: []string{key.method.Alg()}}, nil
+	}
+
+	keyring := &JWTKeyring{keys: map[string]*jwtKey{}}
+	algs := map[string]bool{}
+	for _, kc := range cfg.Keys {
+		if kc.ID == "" {
+			return nil, fmt.Errorf("jwt key: kid is required")
+		}
+		if _, dup := keyring.keys[kc.ID]; dup {
+			return nil, fmt.Errorf("jwt key %s: duplicate kid", kc.ID)
+		}
+		key, err := loadJWTKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %w", kc.ID, err)
+		}
+		keyring.keys[kc.ID] = key
+		if !algs[key.method.Alg()] {
+			algs[key.method.Alg()] = true
+			keyring.methods = append(keyring.methods, key.method.Alg())
+		}
+
+		if key.private != nil && keyring.signing == nil && (cfg.SigningKeyID == "" || cfg.SigningKeyID == kc.ID) {
+			keyring.signing = key
+		}
+	}
+	if keyring.signing == nil {
+		return nil, fmt.Errorf("jwt keys: no private key for signing %q", cfg.SigningKeyID)
+	}
+	return keyring, nil
+}
+
+// loadJWTKey reads a private key, from which the public key is derived, or a public
+// key of a retired signing key. The algorithm follows from the key type.
+func loadJWTKey(kc JWTKeyConfig) (*jwtKey, error) {
+	key := &jwtKey{id: kc.ID}
+	switch {
+	case kc.PrivateKeyFile != "":
+		data, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			key.private, key.public = rsaKey, &rsaKey.PublicKey
+		} else if edKey, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+			key.private, key.public = edKey, edKey.(ed25519.PrivateKey).Public()
+		} else {
+			return nil, fmt.Errorf("%s is not an RSA or Ed25519 private key", kc.PrivateKeyFile)
+		}
+	case kc.PublicKeyFile != "":
+		data, err := os.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+			key.public = rsaKey
+		} else if edKey, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+			key.public = edKey
+		} else {
+			return nil, fmt.Errorf("%s is not an RSA or Ed25519 public key", kc.PublicKeyFile)
+		}
+	default:
+		return nil, fmt.Errorf("private_key_file or public_key_file is required")
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSAKeyBits)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	}
+	return key, nil
+}
+
+// signToken signs the claims with the current signing key.
+func signToken(cfg *Config, claims jwt.MapClaims) (string, error) {
+	keyring, err := cfg.JWT.Keyring()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(keyring.signing.method, claims)
+	if keyring.signing.id != "" {
+		token.Header["kid"] = keyring.signing.id
+	}
+	return token.SignedString(keyring.signing.private)
+}
+
+// verificationKey picks the key named by the kid header. The algorithm of the token
+// has to be the one of the key, so a public key is never used as an HMAC secret.
+func (k *JWTKeyring) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public keys in the JSON Web Key Set format. The HS256 secret is
+// never published.
+func (k *JWTKeyring) JWKS() []map[string]string {
+	keys := []map[string]string{}
+	for _, kc := range k.sortedKeys() {
+		jwk := map[string]string{"kid": kc.id, "use": "sig", "alg": kc.method.Alg()}
+		switch pub := kc.public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+// sortedKeys lists the signing key first, then the others by kid.
+func (k *JWTKeyring) sortedKeys() []*jwtKey {
+	list := []*jwtKey{k.signing}
+	var others []string
+	for id := range k.keys {
+		if id != k.signing.id {
+			others = append(others, id)
+		}
+	}
+	sort.Strings(others)
+	for _, id := range others {
+		list = append(list, k.keys[id])
+	}
+	return list
+}
+
+// HandleJWKS publishes the verification keys for other services.
+func HandleJWKS(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keyring, err := cfg.JWT.Keyring()
+		if err != nil {
+			http.Error(w, "Keys unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(map[string]any{"keys": keyring.JWKS()})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKeyFiles stores the key pair as PKCS#8 and PKIX PEM files and returns their paths.
+func writeKeyFiles(t *testing.T, name string, private any, public any) (string, string) {
+	dir := t.TempDir()
+	privDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey failed: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey failed: %v", err)
+	}
+	privFile := filepath.Join(dir, name+".pem")
+	pubFile := filepath.Join(dir, name+".pub.pem")
+	os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	return privFile, pubFile
+}
+
+func rsaKeyFiles(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %v", err)
+	}
+	return writeKeyFiles(t, "rsa", key, &key.PublicKey)
+}
+
+func ed25519KeyFiles(t *testing.T) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %v", err)
+	}
+	return writeKeyFiles(t, "ed25519", priv, pub)
+}
+
+func keyConfig(keys []JWTKeyConfig, signing string) *Config {
+	return &Config{JWT: JWTConfig{TimeoutMinutes: 15, Keys: keys, SigningKeyID: signing}}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	rsaPriv, rsaPub := rsaKeyFiles(t)
+	edPriv, _ := ed25519KeyFiles(t)
+
+	before := keyConfig([]JWTKeyConfig{{ID: "2025", PrivateKeyFile: rsaPriv}}, "")
+	oldToken, err := GenerateJWT(before, 1, "user", "s1", "")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(oldToken, jwt.MapClaims{})
+	if parsed.Header["kid"] != "2025" || parsed.Header["alg"] != "RS256" {
+		t.Errorf("Expected RS256 token with kid 2025, got %v", parsed.Header)
+	}
+
+	// The new Ed25519 key signs, the retired RSA key only verifies.
+	after := keyConfig([]JWTKeyConfig{{ID: "2025", PublicKeyFile: rsaPub}, {ID: "2026", PrivateKeyFile: edPriv}}, "2026")
+	newToken, err := GenerateJWT(after, 1, "user", "s2", "")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	parsed, _, _ = jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{})
+	if parsed.Header["kid"] != "2026" || parsed.Header["alg"] != "EdDSA" {
+		t.Errorf("Expected EdDSA token with kid 2026, got %v", parsed.Header)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := parseJWT(after, token); err != nil {
+			t.Errorf("Expected token to verify after the rotation: %v", err)
+		}
+	}
+
+	removed := keyConfig([]JWTKeyConfig{{ID: "2026", PrivateKeyFile: edPriv}}, "")
+	if _, err := parseJWT(removed, oldToken); err == nil {
+		t.Error("Expected token of a removed key to be rejected")
+	}
+}
+
+func TestJWTRejectsForgedTokens(t *testing.T) {
+	rsaPriv, rsaPub := rsaKeyFiles(t)
+	cfg := keyConfig([]JWTKeyConfig{{ID: "main", PrivateKeyFile: rsaPriv}}, "")
+	claims := jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Hour).Unix()}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = "main"
+	noneToken, _ := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	// HS256 with the published public key as the secret.
+	pubPEM, _ := os.ReadFile(rsaPub)
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hmac.Header["kid"] = "main"
+	hmacToken, _ := hmac.SignedString(pubPEM)
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "other"
+	unknownToken, _ := unknown.SignedString([]byte("secret"))
+
+	noExp, _ := signToken(cfg, jwt.MapClaims{"user_id": 1})
+
+	for name, token := range map[string]string{"none": noneToken, "hs256": hmacToken, "unknown kid": unknownToken, "no exp": noExp} {
+		if _, err := parseJWT(cfg, token); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaPriv, _ := rsaKeyFiles(t)
+	_, edPub := ed25519KeyFiles(t)
+	cfg := keyConfig([]JWTKeyConfig{{ID: "b-ed", PublicKeyFile: edPub}, {ID: "a-rsa", PrivateKeyFile: rsaPriv}}, "")
+
+	rec := httptest.NewRecorder()
+	HandleJWKS(cfg)(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Cache-Control"), "max-age") {
+		t.Fatalf("Unexpected response %d %v", rec.Code, rec.Header())
+	}
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.NewDecoder(rec.Body).Decode(&jwks)
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %v", jwks.Keys)
+	}
+	if k := jwks.Keys[0]; k["kid"] != "a-rsa" || k["kty"] != "RSA" || k["alg"] != "RS256" || k["e"] != "AQAB" || k["n"] == "" {
+		t.Errorf("Unexpected RSA key %v", k)
+	}
+	if k := jwks.Keys[1]; k["kid"] != "b-ed" || k["kty"] != "OKP" || k["crv"] != "Ed25519" || k["x"] == "" {
+		t.Errorf("Unexpected Ed25519 key %v", k)
+	}
+	for _, k := range jwks.Keys {
+		if _, leaked := k["d"]; leaked {
+			t.Errorf("Expected no private key material, got %v", k)
+		}
+	}
+
+	secret := &Config{JWT: JWTConfig{SecretKey: "test_secret_key_for_jwt"}}
+	keyring, err := secret.JWT.Keyring()
+	if err != nil || len(keyring.JWKS()) != 0 {
+		t.Errorf("Expected the HS256 secret not to be published, got %v %v", keyring, err)
+	}
+}
+
+func TestLoadJWTKeyringErrors(t *testing.T) {
+	rsaPriv, rsaPub := rsaKeyFiles(t)
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %v", err)
+	}
+	smallPriv, _ := writeKeyFiles(t, "small", small, &small.PublicKey)
+
+	cases := map[string]JWTConfig{
+		"missing kid":    {Keys: []JWTKeyConfig{{PrivateKeyFile: rsaPriv}}},
+		"duplicate kid":  {Keys: []JWTKeyConfig{{ID: "a", PrivateKeyFile: rsaPriv}, {ID: "a", PublicKeyFile: rsaPub}}},
+		"missing file":   {Keys: []JWTKeyConfig{{ID: "a", PrivateKeyFile: filepath.Join(t.TempDir(), "none.pem")}}},
+		"no private key": {Keys: []JWTKeyConfig{{ID: "a", PublicKeyFile: rsaPub}}},
+		"unknown signer": {Keys: []JWTKeyConfig{{ID: "a", PrivateKeyFile: rsaPriv}}, SigningKeyID: "b"},
+		"small RSA key":  {Keys: []JWTKeyConfig{{ID: "a", PrivateKeyFile: smallPriv}}},
+		"not a key":      {Keys: []JWTKeyConfig{{ID: "a", PublicKeyFile: rsaPriv}}},
+	}
+	for name, cfg := range cases {
+		if _, err := LoadJWTKeyring(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestKeyringConcurrentFirstUse(t *testing.T) {
+	cfg := &Config{JWT: JWTConfig{SecretKey: "test_secret_key_for_jwt", TimeoutMinutes: 15}}
+
+	keyrings := make(chan *JWTKeyring, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(keyrings); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := GenerateJWT(cfg, 1, "user", "session", "csrf"); err != nil {
+				t.Errorf("GenerateJWT failed: %v", err)
+			}
+			keyring, _ := cfg.JWT.Keyring()
+			keyrings <- keyring
+		}()
+	}
+	wg.Wait()
+	close(keyrings)
+
+	first := <-keyrings
+	for k := range keyrings {
+		if k != first {
+			t.Fatal("Expected every caller to get the same keyring")
+		}
+	}
+}
@@ -12,7 +12,29 @@ func main() {
 		return
 	}
 
-	InitPasswordValidator(cfg)
+	if err := cfg.Cookies.Validate(); err != nil {
+		fmt.Printf("Invalid cookie settings: %v\n", err)
+		return
+	}
+
+	if err := cfg.Photos.Validate(); err != nil {
+		fmt.Printf("Invalid photo settings: %v\n", err)
+		return
+	}
+
+	if _, err := cfg.JWT.Keyring(); err != nil {
+		fmt.Printf("Failed to load JWT keys: %v\n", err)
+		return
+	}
+
+	if err := InitPasswordValidator(cfg); err != nil {
+		fmt.Printf("Password validator initialization failed: %v\n", err)
+		return
+	}
+	if err := InitPasswordHasher(cfg); err != nil {
+		fmt.Printf("Invalid password hashing settings: %v\n", err)
+		return
+	}
 
 	db, err := InitDB(cfg)
 	if err != nil {
@@ -21,15 +43,80 @@ func main() {
 	}
 	defer db.Close()
 
-	http.HandleFunc("/api/login", HandleLogin(cfg, db))
-	http.HandleFunc("/api/users", AuthMiddlewareAdministration(cfg, db, HandleGetUsers(db)))
+	if !fts5Available(db) {
+		if !cfg.Search.AllowLikeFallback {
+			fmt.Println("SQLite is built without FTS5, which full-text search needs. Build with -tags sqlite_fts5 (make build), or set search.allow_like_fallback to search with LIKE matching")
+			return
+		}
+		fmt.Println("WARNING: SQLite is built without FTS5, search falls back to LIKE matching without relevance ranking")
+	}
+
+	store, err := NewPhotoStore(cfg)
+	if err != nil {
+		fmt.Printf("Photo storage initialization failed: %v\n", err)
+		return
+	}
+
+	if cfg.Photos.BackfillRenditions {
+		go func() {
+			n, err := BackfillRenditions(cfg, db, store)
+			if err != nil {
+				fmt.Printf("Rendition backfill failed: %v\n", err)
+				return
+			}
+			fmt.Printf("Rendition backfill finished, %d photos processed\n", n)
+		}()
+	}
+
+	limiter := NewLoginLimiter(db, cfg.Login, systemClock{})
+	notifier := NewNotifier(cfg)
+
+	http.HandleFunc("/.well-known/jwks.json", HandleJWKS(cfg))
+	http.HandleFunc("/api/login", HandleLogin(cfg, db, limiter))
+	http.HandleFunc("/api/refresh", HandleRefresh(cfg, db))
+	http.HandleFunc("/api/logout", HandleLogout(cfg, db))
+	http.HandleFunc("/api/logout-all", AuthMiddlewarePasswordChange(cfg, db, HandleLogoutAll(cfg, db)))
+	http.HandleFunc("/api/change-password", AuthMiddlewarePasswordChange(cfg, db, HandleChangePassword(db, limiter)))
+	http.HandleFunc("/api/change-email", AuthMiddleware(cfg, db, HandleChangeEmail(db)))
+	http.HandleFunc("/api/password-reset/request", HandleRequestPasswordReset(cfg, db, notifier, limiter))
+	http.HandleFunc("/api/password-reset/confirm", HandleConfirmPasswordReset(db))
+	http.HandleFunc("/api/login/mfa", HandleLoginMFA(cfg, db, limiter))
+	http.HandleFunc("/api/login/expired-password", HandleChangeExpiredPassword(cfg, db))
+	http.HandleFunc("/api/2fa/setup", AuthMiddleware(cfg, db, HandleTOTPSetup(cfg, db)))
+	http.HandleFunc("/api/2fa/confirm", AuthMiddleware(cfg, db, HandleTOTPConfirm(db)))
+	http.HandleFunc("/api/2fa/disable", AuthMiddleware(cfg, db, HandleTOTPDisable(cfg, db)))
+	http.HandleFunc("/api/users", RequirePermission(cfg, db, PermListUsers, HandleGetUsers(db)))
 	http.HandleFunc("/api/register", HandleRegister(db))
-	http.HandleFunc("/api/add-photo", AuthMiddleware(cfg, HandleAddPhoto(cfg, db)))
-	http.HandleFunc("/api/manage-ban", AuthMiddlewareAdministration(cfg, db, HandleManageBanStatus(db)))
-	http.HandleFunc("/api/toggle-public", AuthMiddleware(cfg, HandleTogglePhotoPublic(cfg, db)))
+	http.HandleFunc("/api/password-strength", HandlePasswordStrength())
+	http.HandleFunc("/api/add-photo", AuthMiddlewareAPIKeys(cfg, db, HandleAddPhoto(cfg, db, store)))
+	http.HandleFunc("/api/manage-ban", RequirePermission(cfg, db, PermBanUsers, HandleManageBanStatus(db)))
+	http.HandleFunc("/api/reset-password", RequirePermission(cfg, db, PermResetPasswords, HandleAdminResetPassword(db)))
+	http.HandleFunc("/api/unlock-account", RequirePermission(cfg, db, PermBanUsers, HandleUnlockAccount(db, limiter)))
+	http.HandleFunc("/api/manage-role", RequirePermission(cfg, db, PermManageRoles, HandleManageRole(db)))
+	http.HandleFunc("/api/roles", RequirePermission(cfg, db, PermManageRoles, HandleGetRoles(db)))
+	http.HandleFunc("/api/toggle-public", AuthMiddlewareAPIKeys(cfg, db, HandleTogglePhotoPublic(cfg, db)))
 	http.HandleFunc("/api/public-gallery", HandlePublicGallery(db))
-	http.HandleFunc("/api/photos/", HandleGetPhotos(cfg, db))
-	http.HandleFunc("/api/delete-photo/", AuthMiddleware(cfg, HandleDeletePhoto(cfg, db)))
+	http.HandleFunc("/api/photos/", HandleGetPhotos(cfg, db, store))
+	http.HandleFunc("/api/photo-metadata/", HandleGetPhotoMetadata(cfg, db))
+	http.HandleFunc("/api/delete-photo/", AuthMiddlewareAPIKeys(cfg, db, HandleDeletePhoto(cfg, db, store)))
+	http.HandleFunc("/api/albums", AuthMiddlewareAPIKeys(cfg, db, HandleAlbums(db)))
+	http.HandleFunc("/api/albums/", HandleAlbum(cfg, db))
+	http.HandleFunc("/api/public-albums", HandlePublicAlbums(db))
+	http.HandleFunc("/api/photo-details", AuthMiddlewareAPIKeys(cfg, db, HandleUpdatePhotoDetails(db)))
+	http.HandleFunc("/api/api-keys", AuthMiddleware(cfg, db, HandleAPIKeys(db)))
+	http.HandleFunc("/api/api-keys/", AuthMiddleware(cfg, db, HandleAPIKey(db)))
+	http.HandleFunc("/api/search", HandleSearch(cfg, db))
+
+	if cfg.OIDC != nil {
+		provider, err := NewOIDCProvider(*cfg.OIDC)
+		if err != nil {
+			fmt.Printf("OIDC initialization failed: %v\n", err)
+			return
+		}
+		http.HandleFunc("/api/oidc/login", HandleOIDCLogin(cfg, db, provider))
+		http.HandleFunc("/api/oidc/callback", HandleOIDCCallback(cfg, db, provider))
+		http.HandleFunc("/api/oidc/link", AuthMiddleware(cfg, db, HandleOIDCLink(cfg, db, provider)))
+	}
 
 	addr := fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.Port)
 	fmt.Printf("Server started on %s\n", addr)
@@ -3,82 +3,197 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"net/http"
 )
 
 type contextKey string
 
-const (
-	ctxKeyLogin contextKey = "user_login"
-	ctxKeyID    contextKey = "user_id"
+const ctxKeyPrincipal contextKey = "principal"
+
+// Principal is the authenticated user of a request. It is loaded from the database on
+// every request, so bans and account changes apply immediately.
+type Principal struct {
+	ID          int64
+	Login       string
+	Role        string
+	Permissions map[string]bool
+	IsBanned    bool
+	SessionID   string
+	// MFARequired is set for admins that must enroll in two-factor authentication
+	// before their permissions are granted.
+	MFARequired bool
+	// MustChangePassword is set after an admin reset the password of the user.
+	MustChangePassword bool
+	// APIKeyID and Scopes are set for requests authenticated with an API key instead
+	// of a session.
+	APIKeyID int64
+	Scopes   map[string]bool
+}
+
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrAccountBanned   = errors.New("account is banned")
+	ErrAccountDeleted  = errors.New("account no longer exists")
+	ErrForbidden       = errors.New("insufficient privileges")
+	ErrPasswordChange  = errors.New("password must be changed first")
 )
 
-func AuthMiddleware(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tokenStr, err := getJWTFromCookie(r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKeyPrincipal, p)
+}
 
-		claims, err := parseJWT(cfg, tokenStr)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+// PrincipalFrom returns the user authenticated by AuthMiddleware, or nil.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(ctxKeyPrincipal).(*Principal)
+	return p
+}
 
-		userIDFloat, ok := claims["user_id"].(float64)
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		userLogin, ok := claims["user_login"].(string)
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+// LoadPrincipal reads the account state of the user.
+func LoadPrincipal(db *sql.DB, userID int64) (*Principal, error) {
+	p := &Principal{ID: userID}
+	var isBanned, mustChange int
+	err := db.QueryRow("SELECT login, role, isBanned, mustChangePassword FROM users WHERE ID = ?", userID).Scan(&p.Login, &p.Role, &isBanned, &mustChange)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.IsBanned = isBanned != 0
+	p.MustChangePassword = mustChange != 0
+	if p.IsBanned {
+		return p, ErrAccountBanned
+	}
+	p.Permissions, err = RolePermissions(db, p.Role)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// authenticate validates the API key or the access token of the request and its
+// session and loads the user it belongs to.
+func authenticate(cfg *Config, db *sql.DB, r *http.Request) (*Principal, error) {
+	var p *Principal
+	var err error
+	if key, ok := getAPIKeyFromHeader(r); ok {
+		p, err = authenticateAPIKey(db, key)
+		if err == nil && !p.HasScope(requiredScope(r)) {
+			err = ErrInsufficientScope
 		}
+	} else {
+		p, err = authenticateSession(cfg, db, r)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		ctx := context.WithValue(r.Context(), ctxKeyID, int64(userIDFloat))
-		ctx = context.WithValue(ctx, ctxKeyLogin, userLogin)
-		next.ServeHTTP(w, r.WithContext(ctx))
+	if cfg.MFA.RequireForAdmins && p.Role == RoleAdmin && !TOTPEnabled(db, p.ID) {
+		p.MFARequired = true
+		p.Permissions = map[string]bool{}
 	}
+	return p, nil
 }
 
-func AuthMiddlewareAdministration(cfg *Config, db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("jwt")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func authenticateSession(cfg *Config, db *sql.DB, r *http.Request) (*Principal, error) {
+	tokenStr, err := getJWTFromCookie(cfg, r)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	claims, err := parseJWT(cfg, tokenStr)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	userIDFloat, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	sessionID, ok := claims["jti"].(string)
+	if !ok || !SessionActive(db, sessionID, int64(userIDFloat)) {
+		return nil, ErrUnauthenticated
+	}
+	if err := checkCSRF(r, claims); err != nil {
+		return nil, err
+	}
+
+	p, err := LoadPrincipal(db, int64(userIDFloat))
+	if err != nil {
+		return nil, err
+	}
+	p.SessionID = sessionID
+	return p, nil
+}
+
+// writeAuthError answers with a JSON error code clients can act upon.
+func writeAuthError(w http.ResponseWriter, err error) {
+	status, code := http.StatusUnauthorized, "unauthorized"
+	switch err {
+	case ErrAccountBanned:
+		status, code = http.StatusForbidden, "account_banned"
+	case ErrAccountDeleted:
+		code = "account_deleted"
+	case ErrForbidden:
+		status, code = http.StatusForbidden, "forbidden"
+	case ErrMFARequired:
+		status, code = http.StatusForbidden, "mfa_required"
+	case ErrPasswordChange:
+		status, code = http.StatusForbidden, "password_change_required"
+	case ErrInvalidAPIKey:
+		code = "invalid_api_key"
+	case ErrAPIKeyNotAllowed:
+		status, code = http.StatusForbidden, "api_key_not_allowed"
+	case ErrInsufficientScope:
+		status, code = http.StatusForbidden, "insufficient_scope"
+	case ErrCSRF:
+		status, code = http.StatusForbidden, "csrf_token_invalid"
+	case ErrUnauthenticated:
+	default:
+		status, code = http.StatusInternalServerError, "internal_error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   code,
+		"message": err.Error(),
+	})
+}
 
-		claims, err := parseJWT(cfg, cookie.Value)
+func AuthMiddleware(cfg *Config, db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(cfg, db, next, false, false)
+}
+
+// AuthMiddlewarePasswordChange also lets in users who have to change their password,
+// for the endpoints they need to do so.
+func AuthMiddlewarePasswordChange(cfg *Config, db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(cfg, db, next, true, false)
+}
+
+// AuthMiddlewareAPIKeys also accepts API keys with the scope the request needs, for the
+// photo and album endpoints used by scripts.
+func AuthMiddlewareAPIKeys(cfg *Config, db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(cfg, db, next, false, true)
+}
+
+func authMiddleware(cfg *Config, db *sql.DB, next http.HandlerFunc, allowPasswordChange, allowAPIKeys bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(cfg, db, r)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeAuthError(w, err)
 			return
 		}
-
-		userLogin, ok := claims["user_login"].(string)
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if p.APIKeyID != 0 && !allowAPIKeys {
+			writeAuthError(w, ErrAPIKeyNotAllowed)
 			return
 		}
-
-		var userID int64
-		var isAdmin int
-		var isBanned int
-		err = db.QueryRow("SELECT ID, isAdmin, isBanned FROM users WHERE login = ?", userLogin).Scan(&userID, &isAdmin, &isBanned)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if p.MustChangePassword && !allowPasswordChange {
+			writeAuthError(w, ErrPasswordChange)
 			return
 		}
-
-		ctx := context.WithValue(r.Context(), ctxKeyID, userID)
-		ctx = context.WithValue(ctx, ctxKeyLogin, userLogin)
-		ctx = context.WithValue(ctx, "isAdmin", isAdmin != 0)
-		ctx = context.WithValue(ctx, "isBanned", isBanned != 0)
-
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
 	}
 }
-
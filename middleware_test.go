@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func authErrorCode(mux *http.ServeMux, jar cookieJar, method, url, body string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	jar.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp["error"]
+}
+
+func TestAuthMiddlewareAccountState(t *testing.T) {
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/users", RequirePermission(cfg, db, PermListUsers, HandleGetUsers(db)))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	var seen *Principal
+	mux.HandleFunc("/api/whoami", AuthMiddleware(cfg, db, func(w http.ResponseWriter, r *http.Request) {
+		seen = PrincipalFrom(r.Context())
+	}))
+
+	user := cookieJar{}
+	if code := user.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`); code != http.StatusOK {
+		t.Fatalf("Login failed with %d", code)
+	}
+	if code := user.do(mux, "GET", "/api/whoami", ""); code != http.StatusOK || seen == nil || seen.Login != "user" || seen.Role != RoleUser {
+		t.Errorf("Unexpected principal %+v (%d)", seen, code)
+	}
+	if code, errCode := authErrorCode(mux, user, "GET", "/api/users", ""); code != http.StatusForbidden || errCode != "forbidden" {
+		t.Errorf("Expected non-admin to be refused, got %d %q", code, errCode)
+	}
+
+	// A ban applies to tokens that were already issued
+	db.Exec(`UPDATE users SET isBanned = 1 WHERE login = 'user'`)
+	if code, errCode := authErrorCode(mux, user, "GET", "/api/whoami", ""); code != http.StatusForbidden || errCode != "account_banned" {
+		t.Errorf("Expected banned account to be refused, got %d %q", code, errCode)
+	}
+	if code, errCode := authErrorCode(mux, cookieJar{}, "POST", "/api/login", `{"login":"user","password":"pass"}`); code != http.StatusForbidden || errCode != "account_banned" {
+		t.Errorf("Expected banned account not to log in, got %d %q", code, errCode)
+	}
+	if code, errCode := authErrorCode(mux, user, "POST", "/api/refresh", ""); code != http.StatusForbidden || errCode != "account_banned" {
+		t.Errorf("Expected banned account not to refresh, got %d %q", code, errCode)
+	}
+
+	admin := cookieJar{}
+	admin.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+	if code := admin.do(mux, "GET", "/api/users", ""); code != http.StatusOK {
+		t.Errorf("Expected admin to list users, got %d", code)
+	}
+	db.Exec(`DELETE FROM users WHERE login = 'testadmin'`)
+	if code, errCode := authErrorCode(mux, admin, "GET", "/api/users", ""); code != http.StatusUnauthorized || errCode != "account_deleted" {
+		t.Errorf("Expected deleted account to be refused, got %d %q", code, errCode)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier delivers messages to users.
+type Notifier interface {
+	SendPasswordReset(to, login, token string, expires time.Time) error
+}
+
+// NewNotifier returns the notifier configured in the mail section, or nil when none is.
+func NewNotifier(cfg *Config) Notifier {
+	if cfg.Mail.SMTP == nil || cfg.Mail.SMTP.Host == "" {
+		return nil
+	}
+	return &SMTPNotifier{cfg: *cfg.Mail.SMTP, resetURL: cfg.Mail.ResetURL}
+}
+
+// SMTPNotifier sends plain text emails through an SMTP server. STARTTLS is used when
+// the server offers it.
+type SMTPNotifier struct {
+	cfg      SMTPConfig
+	resetURL string
+}
+
+func (n *SMTPNotifier) SendPasswordReset(to, login, token string, expires time.Time) error {
+	link := token
+	if n.resetURL != "" {
+		link = n.resetURL + token
+	}
+	body := fmt.Sprintf("Hello %s,\r\n\r\n"+
+		"a password reset was requested for your account. Use the link below to set a new password:\r\n\r\n"+
+		"%s\r\n\r\n"+
+		"The link expires at %s and can be used once. If you did not request it, ignore this message.\r\n",
+		login, link, expires.UTC().Format(time.RFC1123))
+	return n.send(to, "Password reset", body)
+}
+
+func (n *SMTPNotifier) send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	port := n.cfg.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)
+	}
+
+	msg := "From: " + n.cfg.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(addr, auth, n.cfg.From, []string{to}, []byte(msg))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts one message and sends it to the channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost fake SMTP")
+
+		var envelope, data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM"), strings.HasPrefix(cmd, "RCPT TO"):
+				envelope.WriteString(strings.TrimSpace(line) + "\n")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 Bye")
+				messages <- envelope.String() + "\n" + data.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	cfg := &Config{Mail: MailConfig{
+		SMTP:     &SMTPConfig{Host: host, Port: portNum, From: "photos@example.com"},
+		ResetURL: "https://photos.example.com/reset?token=",
+	}}
+	notifier := NewNotifier(cfg)
+	if notifier == nil {
+		t.Fatal("Expected SMTP notifier to be configured")
+	}
+
+	expires := time.Date(2025, 1, 1, 13, 0, 0, 0, time.UTC)
+	if err := notifier.SendPasswordReset("user@example.com", "user", "abc123", expires); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	select {
+	case msg := <-messages:
+		for _, want := range []string{
+			"MAIL FROM:<photos@example.com>",
+			"RCPT TO:<user@example.com>",
+			"To: user@example.com",
+			"Subject: Password reset",
+			"https://photos.example.com/reset?token=abc123",
+		} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("Expected message to contain %q, got:\n%s", want, msg)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message received")
+	}
+
+	if NewNotifier(&Config{}) != nil {
+		t.Error("Expected no notifier without SMTP configuration")
+	}
+	if err := notifier.SendPasswordReset("user@example.com\r\nBcc: x@example.com", "user", "t", expires); err == nil {
+		t.Error("Expected header injection to be rejected")
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Login through an OpenID Connect provider with the authorization code flow. The
+// state, nonce and PKCE verifier of a started login are kept in oidc_logins, the
+// state is also set as a cookie so the callback only works in the browser that
+// started the login. External identities are linked to users in user_identities,
+// either on their first login or by a logged in user through /api/oidc/link.
+
+const (
+	oidcStateCookie       = "oidc_state"
+	oidcLoginTTL          = 10 * time.Minute
+	oidcKeysRefetch       = time.Minute
+	defaultOIDCLoginClaim = "preferred_username"
+	maxOIDCLogin          = 32
+)
+
+var defaultOIDCScopes = []string{"openid", "profile", "email"}
+
+var (
+	ErrOIDCState           = errors.New("invalid or expired login state")
+	ErrOIDCUnknownIdentity = errors.New("no account is linked to this identity")
+	ErrOIDCIdentityLinked  = errors.New("this identity is linked to another account")
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcIdentity is the user described by a verified ID token.
+type oidcIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Login         string // value of the login claim, used for new accounts
+}
+
+// OIDCProvider reads the discovery document and the signing keys of the provider on
+// first use, so the server starts while the provider is unreachable.
+type OIDCProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer, client_id and redirect_url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = defaultOIDCScopes
+	}
+	if cfg.LoginClaim == "" {
+		cfg.LoginClaim = defaultOIDCLoginClaim
+	}
+	if cfg.SuccessURL == "" {
+		cfg.SuccessURL = "/"
+	}
+	return &OIDCProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}, nil
+}
+
+func (p *OIDCProvider) getJSON(endpoint string, out any) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is incomplete")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// pkceChallenge derives the S256 code challenge of the verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the address of the provider's login page.
+func (p *OIDCProvider) AuthURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the authorization code for the ID token.
+func (p *OIDCProvider) Exchange(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("oidc: token endpoint: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.IDToken == "" {
+		return "", errors.New("oidc: no id_token in the token response")
+	}
+	return token.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of the ID
+// token and returns the identity it describes.
+func (p *OIDCProvider) VerifyIDToken(idToken, nonce string) (oidcIdentity, error) {
+	token, err := jwt.Parse(idToken, p.verificationKey,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+		jwt.WithTimeFunc(p.now))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return oidcIdentity{}, errors.New("oidc: nonce mismatch")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return oidcIdentity{}, errors.New("oidc: token issued to another client")
+	}
+	id := oidcIdentity{Issuer: p.cfg.Issuer}
+	id.Subject, _ = claims["sub"].(string)
+	if id.Subject == "" {
+		return oidcIdentity{}, errors.New("oidc: no subject in the ID token")
+	}
+	id.Email, _ = claims["email"].(string)
+	// Some providers send email_verified as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified, _ = strconv.ParseBool(v)
+	}
+	id.Login, _ = claims[p.cfg.LoginClaim].(string)
+	return id, nil
+}
+
+// verificationKey returns the provider key named by the kid header. Unknown keys cause
+// a refetch of the key set, at most once a minute, to follow key rotations.
+func (p *OIDCProvider) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	fresh := p.keys != nil && p.now().Sub(p.keysFetched) <= oidcKeysRefetch
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fresh {
+		return nil, ErrUnknownSigningKey
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]any{}
+	for _, jwk := range set.Keys {
+		if use, _ := jwk["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		if k, err := parseJWK(jwk); err == nil {
+			id, _ := jwk["kid"].(string)
+			keys[id] = k
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysFetched = keys, p.now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// parseJWK reads RSA, P-256 and Ed25519 public keys of a JSON Web Key Set.
+func parseJWK(jwk map[string]any) (any, error) {
+	field := func(name string) ([]byte, error) {
+		s, _ := jwk[name].(string)
+		if s == "" {
+			return nil, fmt.Errorf("jwk: missing %s", name)
+		}
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := field("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := field("e")
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("jwk: RSA keys need at least %d bits", minRSAKeyBits)
+		}
+		return key, nil
+	case "EC":
+		if jwk["crv"] != "P-256" {
+			return nil, fmt.Errorf("jwk: unsupported curve %v", jwk["crv"])
+		}
+		x, err := field("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y")
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("jwk: point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := field("x")
+		if err != nil {
+			return nil, err
+		}
+		if jwk["crv"] != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk: unsupported curve %v", jwk["crv"])
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwk: unsupported key type %v", jwk["kty"])
+}
+
+// beginOIDCLogin stores a new login attempt and returns its state, nonce and PKCE
+// verifier. A non-zero linkUserID makes the attempt link the identity to that user
+// instead of logging in.
+func beginOIDCLogin(db *sql.DB, linkUserID int64) (string, string, string, error) {
+	now := time.Now().UTC()
+	db.Exec(`DELETE FROM oidc_logins WHERE expiresAt < ?`, now.Format(sessionTimeLayout))
+
+	state, nonce, verifier := randomToken(32), randomToken(32), randomToken(48)
+	_, err := db.Exec(`INSERT INTO oidc_logins (stateHash, nonce, verifier, expiresAt, linkUserID) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(state), nonce, verifier, now.Add(oidcLoginTTL).Format(sessionTimeLayout), sql.NullInt64{Int64: linkUserID, Valid: linkUserID != 0})
+	return state, nonce, verifier, err
+}
+
+// consumeOIDCLogin returns the nonce, the verifier and the user to link of the login
+// attempt. Each state can be used once.
+func consumeOIDCLogin(db *sql.DB, state string) (string, string, int64, error) {
+	var nonce, verifier, expiresAt string
+	var linkUserID sql.NullInt64
+	err := db.QueryRow(`DELETE FROM oidc_logins WHERE stateHash = ? RETURNING nonce, verifier, expiresAt, linkUserID`,
+		hashToken(state)).Scan(&nonce, &verifier, &expiresAt, &linkUserID)
+	if err != nil || expiresAt <= time.Now().UTC().Format(sessionTimeLayout) {
+		return "", "", 0, ErrOIDCState
+	}
+	return nonce, verifier, linkUserID.Int64, nil
+}
+
+// oidcLoginName makes a login out of the login claim: the part before "@", lower case,
+// letters, digits, ".", "_" and "-" only.
+func oidcLoginName(claim string) string {
+	claim, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(claim)), "@")
+	var b strings.Builder
+	for _, r := range claim {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	login := b.String()
+	if len(login) > maxOIDCLogin {
+		login = login[:maxOIDCLogin]
+	}
+	if login == "" {
+		login = "user"
+	}
+	return login
+}
+
+// provisionOIDCUser creates an account without a password for the identity. A taken
+// login gets a number appended, the identity is never linked to an account by its login.
+func provisionOIDCUser(tx *sql.Tx, id oidcIdentity) (int64, error) {
+	base := oidcLoginName(id.Login)
+	if id.Login == "" {
+		base = oidcLoginName(id.Email)
+	}
+	var email sql.NullString
+	if id.EmailVerified {
+		email = nullString(id.Email)
+	}
+
+	login := base
+	for n := 2; n <= 100; n++ {
+		var taken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE login = ?`, login).Scan(&taken); err != nil {
+			return 0, err
+		}
+		if taken == 0 {
+			res, err := tx.Exec(`INSERT INTO users (login, password, isAdmin, isBanned, role, email, emailVerified) VALUES (?, NULL, 0, 0, ?, ?, ?)`,
+				login, RoleUser, email, boolInt(email.Valid))
+			if err != nil {
+				return 0, err
+			}
+			return res.LastInsertId()
+		}
+		login = base + strconv.Itoa(n)
+	}
+	return 0, fmt.Errorf("oidc: no free login for %q", base)
+}
+
+// OIDCUser returns the user linked to the identity. Unknown identities are linked to
+// the account with the same verified email or get a new account, when enabled. Only
+// local addresses confirmed by a provider count, /api/change-email accepts any address.
+func OIDCUser(cfg *OIDCConfig, db *sql.DB, id oidcIdentity) (int64, error) {
+	now := time.Now().UTC().Format(sessionTimeLayout)
+	var userID int64
+	err := db.QueryRow(`SELECT userID FROM user_identities WHERE issuer = ? AND subject = ?`, id.Issuer, id.Subject).Scan(&userID)
+	if err == nil {
+		_, err = db.Exec(`UPDATE user_identities SET lastLoginAt = ?, email = ? WHERE issuer = ? AND subject = ?`,
+			now, nullString(id.Email), id.Issuer, id.Subject)
+		return userID, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if cfg.LinkVerifiedEmail && id.EmailVerified && id.Email != "" {
+		// Only an unambiguous match is linked
+		var matches int
+		err := tx.QueryRow(`SELECT COUNT(*), COALESCE(MIN(ID), 0) FROM users WHERE lower(email) = lower(?) AND emailVerified = 1`, id.Email).Scan(&matches, &userID)
+		if err != nil {
+			return 0, err
+		}
+		if matches != 1 {
+			userID = 0
+		}
+	}
+	if userID == 0 {
+		if !cfg.AutoProvision {
+			return 0, ErrOIDCUnknownIdentity
+		}
+		if userID, err = provisionOIDCUser(tx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO user_identities (userID, issuer, subject, email, createdAt, lastLoginAt) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, id.Issuer, id.Subject, nullString(id.Email), now, now)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// LinkOIDCIdentity links the identity to a logged in user. An identity linked to
+// another account is not moved.
+func LinkOIDCIdentity(db *sql.DB, userID int64, id oidcIdentity) error {
+	now := time.Now().UTC().Format(sessionTimeLayout)
+	res, err := db.Exec(`INSERT INTO user_identities (userID, issuer, subject, email, createdAt, lastLoginAt) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(issuer, subject) DO UPDATE SET email = excluded.email WHERE userID = excluded.userID`,
+		userID, id.Issuer, id.Subject, nullString(id.Email), now, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrOIDCIdentityLinked
+	}
+	return nil
+}
+
+// startOIDCLogin redirects the browser to the provider.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, cfg *Config, db *sql.DB, provider *OIDCProvider, linkUserID int64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, nonce, verifier, err := beginOIDCLogin(db, linkUserID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := provider.AuthURL(state, nonce, verifier)
+	if err != nil {
+		fmt.Printf("OIDC discovery failed: %v\n", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Lax, the provider redirects back with a top-level navigation
+	cookie := cfg.Cookies.newCookie(oidcStateCookie, state, "/api/oidc", int(oidcLoginTTL.Seconds()), true, http.SameSiteLaxMode)
+	cookie.Secure = cookie.Secure || strings.HasPrefix(provider.cfg.RedirectURL, "https://")
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleOIDCLogin starts the login at the provider (GET /api/oidc/login).
+func HandleOIDCLogin(cfg *Config, db *sql.DB, provider *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startOIDCLogin(w, r, cfg, db, provider, 0)
+	}
+}
+
+// HandleOIDCLink starts linking an identity at the provider to the logged in user
+// (GET /api/oidc/link), the callback links it instead of logging in.
+func HandleOIDCLink(cfg *Config, db *sql.DB, provider *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startOIDCLogin(w, r, cfg, db, provider, PrincipalFrom(r.Context()).ID)
+	}
+}
+
+// HandleOIDCCallback completes the login with the code returned by the provider
+// (GET /api/oidc/callback), sets the same cookies as /api/login and redirects to the
+// application.
+func HandleOIDCCallback(cfg *Config, db *sql.DB, provider *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.SetCookie(w, cfg.Cookies.newCookie(oidcStateCookie, "", "/api/oidc", -1, true, http.SameSiteLaxMode))
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			http.Error(w, "Login failed at the identity provider: "+e, http.StatusUnauthorized)
+			return
+		}
+		state := q.Get("state")
+		cookie, err := r.Cookie(cfg.Cookies.cookieName(oidcStateCookie, "/api/oidc"))
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			http.Error(w, ErrOIDCState.Error(), http.StatusBadRequest)
+			return
+		}
+		nonce, verifier, linkUserID, err := consumeOIDCLogin(db, state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := provider.Exchange(q.Get("code"), verifier)
+		if err != nil {
+			fmt.Printf("OIDC code exchange failed: %v\n", err)
+			http.Error(w, "Login failed at the identity provider", http.StatusBadGateway)
+			return
+		}
+		identity, err := provider.VerifyIDToken(idToken, nonce)
+		if err != nil {
+			fmt.Printf("OIDC ID token rejected: %v\n", err)
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			return
+		}
+
+		if linkUserID != 0 {
+			err := LinkOIDCIdentity(db, linkUserID, identity)
+			if err == ErrOIDCIdentityLinked {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, provider.cfg.SuccessURL, http.StatusFound)
+			return
+		}
+
+		userID, err := OIDCUser(&provider.cfg, db, identity)
+		if err == ErrOIDCUnknownIdentity {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		principal, err := LoadPrincipal(db, userID)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		// Accounts with 2FA still need their second factor. The token is passed in the
+		// fragment, which is not sent to servers, and the frontend completes the login
+		// with /api/login/mfa
+		if TOTPEnabled(db, principal.ID) {
+			mfaToken, err := GenerateMFAToken(cfg, principal.ID, true)
+			if err != nil {
+				http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, provider.cfg.SuccessURL+"#mfaToken="+url.QueryEscape(mfaToken), http.StatusFound)
+			return
+		}
+
+		// The provider authenticated the user, the local password and its age do not matter
+		sessionID, refreshToken, err := CreateSession(cfg, db, principal.ID, r.UserAgent())
+		if err != nil {
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		if _, err := setAuthCookies(w, cfg, principal.ID, principal.Login, sessionID, refreshToken); err != nil {
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, provider.cfg.SuccessURL, http.StatusFound)
+	}
+}
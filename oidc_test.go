@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP is an in-process OpenID Connect provider. Logins are approved with authorize,
+// which returns the code the browser would bring back to the callback.
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %v", err)
+	}
+	idp := &fakeIdP{key: key, grants: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp-1", "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (f *fakeIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if id, secret, _ := r.BasicAuth(); id != "photos" || secret != "s3cret" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	grant, ok := f.grants[r.PostForm.Get("code")]
+	delete(f.grants, r.PostForm.Get("code"))
+	f.mu.Unlock()
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   f.server.URL,
+		"aud":   "photos",
+		"nonce": grant.nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-1"
+	idToken, _ := token.SignedString(f.key)
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+}
+
+// authorize checks the authorization request and approves it for a user with the claims.
+func (f *fakeIdP) authorize(t *testing.T, location string, claims map[string]any) (string, string) {
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, f.server.URL+"/authorize?") {
+		t.Fatalf("Unexpected authorization URL %q", location)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != "photos" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("state") == "" || q.Get("nonce") == "" || !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("Unexpected authorization request %v", q)
+	}
+	code := randomToken(16)
+	f.mu.Lock()
+	f.grants[code] = fakeGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	f.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func testOIDCServer(t *testing.T, idp *fakeIdP, configure func(*OIDCConfig)) (*Config, *sql.DB, *http.ServeMux) {
+	cfg, db, mux := testSessionServer(t)
+	oc := OIDCConfig{
+		Issuer:        idp.server.URL,
+		ClientID:      "photos",
+		ClientSecret:  "s3cret",
+		RedirectURL:   "https://photos.example.com/api/oidc/callback",
+		AutoProvision: true,
+		SuccessURL:    "/gallery",
+	}
+	if configure != nil {
+		configure(&oc)
+	}
+	provider, err := NewOIDCProvider(oc)
+	if err != nil {
+		t.Fatalf("NewOIDCProvider failed: %v", err)
+	}
+	mux.HandleFunc("/api/oidc/login", HandleOIDCLogin(cfg, db, provider))
+	mux.HandleFunc("/api/oidc/callback", HandleOIDCCallback(cfg, db, provider))
+	mux.HandleFunc("/api/oidc/link", AuthMiddleware(cfg, db, HandleOIDCLink(cfg, db, provider)))
+	mux.HandleFunc("/api/change-email", AuthMiddleware(cfg, db, HandleChangeEmail(db)))
+	return cfg, db, mux
+}
+
+// redirect sends a GET request with the cookies of the jar and returns the status and
+// the Location header.
+func (j cookieJar) redirect(mux *http.ServeMux, url string) (int, string) {
+	req := httptest.NewRequest("GET", url, nil)
+	j.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(j, c.Name)
+		} else {
+			j[c.Name] = c.Value
+		}
+	}
+	return rec.Code, rec.Header().Get("Location")
+}
+
+func callbackURL(state, code string) string {
+	return "/api/oidc/callback?" + url.Values{"state": {state}, "code": {code}}.Encode()
+}
+
+// oidcLogin runs the whole flow in the browser of the jar.
+func oidcLogin(t *testing.T, mux *http.ServeMux, idp *fakeIdP, jar cookieJar, claims map[string]any) (int, string) {
+	code, location := jar.redirect(mux, "/api/oidc/login")
+	if code != http.StatusFound {
+		t.Fatalf("Expected redirect to the provider, got %d", code)
+	}
+	state, authCode := idp.authorize(t, location, claims)
+	return jar.redirect(mux, callbackURL(state, authCode))
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, db, mux := testOIDCServer(t, idp, nil)
+	claims := map[string]any{"sub": "u-1", "preferred_username": "Jan.Kowalski", "email": "jan@example.com", "email_verified": true}
+
+	jar := cookieJar{}
+	code, location := oidcLogin(t, mux, idp, jar, claims)
+	if code != http.StatusFound || location != "/gallery" {
+		t.Fatalf("Expected redirect to the application, got %d %q", code, location)
+	}
+	if jar["jwt"] == "" || jar[refreshCookie] == "" || jar[oidcStateCookie] != "" {
+		t.Errorf("Expected session cookies only, got %v", jar)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected a session, got %d", code)
+	}
+
+	var userID int64
+	var password, changedAt sql.NullString
+	var email string
+	db.QueryRow(`SELECT ID, password, email, passwordChangedAt FROM users WHERE login = 'jan.kowalski'`).Scan(&userID, &password, &email, &changedAt)
+	if userID == 0 || password.Valid || changedAt.Valid || email != "jan@example.com" {
+		t.Fatalf("Expected an account without a password, got %d %v %q %v", userID, password, email, changedAt)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"jan.kowalski","password":""}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected password login to fail, got %d", code)
+	}
+
+	oidcLogin(t, mux, idp, cookieJar{}, claims)
+	oidcLogin(t, mux, idp, cookieJar{}, map[string]any{"sub": "u-2", "preferred_username": "jan.kowalski"})
+	var users, identities int
+	db.QueryRow(`SELECT COUNT(*) FROM users WHERE login LIKE 'jan.kowalski%'`).Scan(&users)
+	db.QueryRow(`SELECT COUNT(*) FROM user_identities`).Scan(&identities)
+	if users != 2 || identities != 2 {
+		t.Errorf("Expected 2 accounts and identities, got %d and %d", users, identities)
+	}
+	var second string
+	db.QueryRow(`SELECT u.login FROM users u JOIN user_identities i ON i.userID = u.ID WHERE i.subject = 'u-2'`).Scan(&second)
+	if second != "jan.kowalski2" {
+		t.Errorf("Expected a taken login to get a number, got %q", second)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, _, mux := testOIDCServer(t, idp, nil)
+	user := map[string]any{"sub": "u-1", "preferred_username": "jan"}
+
+	start := func() (cookieJar, string) {
+		jar := cookieJar{}
+		_, location := jar.redirect(mux, "/api/oidc/login")
+		return jar, location
+	}
+
+	jar, location := start()
+	state, code := idp.authorize(t, location, user)
+	if status, _ := (cookieJar{}).redirect(mux, callbackURL(state, code)); status != http.StatusBadRequest {
+		t.Errorf("Expected callback without the state cookie to fail, got %d", status)
+	}
+	if status, _ := jar.clone().redirect(mux, callbackURL("forged", code)); status != http.StatusBadRequest {
+		t.Errorf("Expected a forged state to fail, got %d", status)
+	}
+	replay := jar.clone()
+	if status, _ := jar.redirect(mux, callbackURL(state, code)); status != http.StatusFound {
+		t.Fatalf("Expected login to succeed, got %d", status)
+	}
+	if status, _ := replay.redirect(mux, callbackURL(state, code)); status != http.StatusBadRequest {
+		t.Errorf("Expected a used state to fail, got %d", status)
+	}
+
+	// A code issued for another login attempt fails the PKCE check
+	jarA, locationA := start()
+	jarB, locationB := start()
+	_, codeA := idp.authorize(t, locationA, user)
+	stateB, _ := idp.authorize(t, locationB, user)
+	if status, _ := jarB.redirect(mux, callbackURL(stateB, codeA)); status != http.StatusBadGateway {
+		t.Errorf("Expected a stolen code to be rejected, got %d", status)
+	}
+	if jarA["jwt"] != "" || jarB["jwt"] != "" {
+		t.Error("Expected no session for a stolen code")
+	}
+
+	for name, claims := range map[string]map[string]any{
+		"nonce":    {"sub": "u-1", "nonce": "replayed"},
+		"audience": {"sub": "u-1", "aud": "other-client"},
+		"issuer":   {"sub": "u-1", "iss": "https://evil.example.com"},
+		"expired":  {"sub": "u-1", "exp": time.Now().Add(-time.Hour).Unix()},
+		"subject":  {"preferred_username": "jan"},
+	} {
+		if status, _ := oidcLogin(t, mux, idp, cookieJar{}, claims); status != http.StatusUnauthorized {
+			t.Errorf("%s: expected ID token to be rejected, got %d", name, status)
+		}
+	}
+
+	jar, _ = start()
+	if status, _ := jar.redirect(mux, "/api/oidc/callback?error=access_denied&state=x"); status != http.StatusUnauthorized {
+		t.Errorf("Expected a provider error to fail the login, got %d", status)
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, db, mux := testOIDCServer(t, idp, func(c *OIDCConfig) {
+		c.AutoProvision = false
+		c.LinkVerifiedEmail = true
+	})
+	RegisterUser(db, &User{Login: "anna", Password: "pass", Email: "Anna@example.com"})
+	RegisterUser(db, &User{Login: "mallory", Password: "pass"})
+
+	if status, _ := oidcLogin(t, mux, idp, cookieJar{}, map[string]any{"sub": "u-1", "email": "anna@example.com", "email_verified": false}); status != http.StatusForbidden {
+		t.Errorf("Expected an unverified email not to be linked, got %d", status)
+	}
+	if status, _ := oidcLogin(t, mux, idp, cookieJar{}, map[string]any{"sub": "u-2", "email": "bob@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Errorf("Expected unknown identity to be rejected without provisioning, got %d", status)
+	}
+
+	// Anyone can put any address on their account, so it is not linked until verified
+	mallory := cookieJar{}
+	mallory.do(mux, "POST", "/api/login", `{"login":"mallory","password":"pass"}`)
+	if code := mallory.do(mux, "POST", "/api/change-email", `{"email":"victim@example.com"}`); code != http.StatusOK {
+		t.Fatalf("Email change failed with %d", code)
+	}
+	if status, _ := oidcLogin(t, mux, idp, cookieJar{}, map[string]any{"sub": "victim", "email": "victim@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Errorf("Expected a self-declared email not to be linked, got %d", status)
+	}
+	if status, _ := oidcLogin(t, mux, idp, cookieJar{}, map[string]any{"sub": "u-1", "email": "anna@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Errorf("Expected an unverified local email not to be linked, got %d", status)
+	}
+
+	db.Exec(`UPDATE users SET emailVerified = 1 WHERE login = 'anna'`)
+	jar := cookieJar{}
+	if status, _ := oidcLogin(t, mux, idp, jar, map[string]any{"sub": "u-1", "email": "anna@example.com", "email_verified": "true"}); status != http.StatusFound {
+		t.Fatalf("Expected the verified email to be linked, got %d", status)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected a session, got %d", code)
+	}
+	var linked string
+	db.QueryRow(`SELECT u.login FROM users u JOIN user_identities i ON i.userID = u.ID WHERE i.subject = 'u-1'`).Scan(&linked)
+	if linked != "anna" {
+		t.Errorf("Expected identity linked to anna, got %q", linked)
+	}
+}
+
+func TestOIDCExplicitLink(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, db, mux := testOIDCServer(t, idp, func(c *OIDCConfig) { c.AutoProvision = false })
+	RegisterUser(db, &User{Login: "anna", Password: "pass"})
+	RegisterUser(db, &User{Login: "bob", Password: "pass"})
+	claims := map[string]any{"sub": "u-1", "email": "anna@corp.example.com", "email_verified": true}
+
+	if code, _ := (cookieJar{}).redirect(mux, "/api/oidc/link"); code != http.StatusUnauthorized {
+		t.Errorf("Expected linking to require a login, got %d", code)
+	}
+
+	link := func(jar cookieJar) int {
+		code, location := jar.redirect(mux, "/api/oidc/link")
+		if code != http.StatusFound {
+			t.Fatalf("Expected redirect to the provider, got %d", code)
+		}
+		state, authCode := idp.authorize(t, location, claims)
+		code, _ = jar.redirect(mux, callbackURL(state, authCode))
+		return code
+	}
+
+	anna := cookieJar{}
+	anna.do(mux, "POST", "/api/login", `{"login":"anna","password":"pass"}`)
+	if code := link(anna); code != http.StatusFound {
+		t.Fatalf("Expected the identity to be linked, got %d", code)
+	}
+
+	jar := cookieJar{}
+	if status, _ := oidcLogin(t, mux, idp, jar, claims); status != http.StatusFound {
+		t.Fatalf("Expected login with the linked identity, got %d", status)
+	}
+	var linked string
+	db.QueryRow(`SELECT u.login FROM users u JOIN user_identities i ON i.userID = u.ID WHERE i.subject = 'u-1'`).Scan(&linked)
+	if linked != "anna" || jar["jwt"] == "" {
+		t.Errorf("Expected a session of anna, got %q", linked)
+	}
+
+	bob := cookieJar{}
+	bob.do(mux, "POST", "/api/login", `{"login":"bob","password":"pass"}`)
+	if code := link(bob); code != http.StatusConflict {
+		t.Errorf("Expected an identity of another account not to move, got %d", code)
+	}
+}
+
+func TestOIDCLoginRequiresMFA(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, db, mux := testOIDCServer(t, idp, func(c *OIDCConfig) { c.AutoProvision = false })
+	claims := map[string]any{"sub": "admin-1"}
+	if err := LinkOIDCIdentity(db, 1, oidcIdentity{Issuer: idp.server.URL, Subject: "admin-1"}); err != nil {
+		t.Fatalf("LinkOIDCIdentity failed: %v", err)
+	}
+	secret, err := BeginTOTPEnrollment(db, 1)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+	db.Exec(`UPDATE user_totp SET confirmed = 1 WHERE userID = 1`)
+
+	jar := cookieJar{}
+	status, location := oidcLogin(t, mux, idp, jar, claims)
+	if status != http.StatusFound || !strings.HasPrefix(location, "/gallery#mfaToken=") {
+		t.Fatalf("Expected redirect with an MFA token, got %d %q", status, location)
+	}
+	if jar["jwt"] != "" {
+		t.Fatal("Expected no session before the second factor")
+	}
+
+	fragment, _ := url.ParseQuery(strings.TrimPrefix(location, "/gallery#"))
+	body := `{"mfaToken":"` + fragment.Get("mfaToken") + `","code":"` + currentTOTP(t, secret, time.Now()) + `"}`
+	var result map[string]any
+	if status := jar.postJSON(mux, "/api/login/mfa", body, &result); status != http.StatusOK {
+		t.Fatalf("MFA login failed with %d", status)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected a session after the second factor, got %d", code)
+	}
+}
+
+func TestOIDCLoginIgnoresPasswordExpiry(t *testing.T) {
+	pwCfg := usePasswordHistory(t, PasswordHistoryConfig{MaxAgeDays: 30})
+	idp := newFakeIdP(t)
+	cfg, db, mux := testOIDCServer(t, idp, func(c *OIDCConfig) { c.LinkVerifiedEmail = true })
+	cfg.Password = pwCfg.Password
+	RegisterUser(db, &User{Login: "anna", Password: "pass", Email: "anna@example.com"})
+	db.Exec(`UPDATE users SET emailVerified = 1, passwordChangedAt = ? WHERE login = 'anna'`,
+		time.Now().UTC().Add(-31*24*time.Hour).Format(sessionTimeLayout))
+
+	var login struct {
+		Status string `json:"status"`
+	}
+	(cookieJar{}).postJSON(mux, "/api/login", `{"login":"anna","password":"pass"}`, &login)
+	if login.Status != "password_expired" {
+		t.Fatalf("Expected password login to need a new password, got %q", login.Status)
+	}
+
+	jar := cookieJar{}
+	if status, _ := oidcLogin(t, mux, idp, jar, map[string]any{"sub": "u-1", "email": "anna@example.com", "email_verified": true}); status != http.StatusFound {
+		t.Fatalf("Expected single sign-on to ignore the password age, got %d", status)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected a session, got %d", code)
+	}
+	var linked string
+	db.QueryRow(`SELECT u.login FROM users u JOIN user_identities i ON i.userID = u.ID WHERE i.subject = 'u-1'`).Scan(&linked)
+	if linked != "anna" {
+		t.Errorf("Expected identity linked to anna, got %q", linked)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SortNewest   = "newest"
+	SortOldest   = "oldest"
+	SortCaptured = "captured"
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+
+	uploadedAtLayout = "2006-01-02T15:04:05Z"
+)
+
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+// ListQuery holds the paging, sorting and filtering options shared by photo listings.
+type ListQuery struct {
+	Limit    int
+	Sort     string
+	Cursor   *pageCursor
+	User     string
+	From     string // uploadedAt lower bound, inclusive
+	To       string // uploadedAt upper bound, exclusive
+	Filename string
+}
+
+// pageCursor is the position after the last returned photo. It is sent to clients
+// base64 encoded and only valid for the sort order it was created with.
+type pageCursor struct {
+	Sort     string `json:"s"`
+	ID       int64  `json:"id"`
+	Captured string `json:"c,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidListQuery
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, ErrInvalidListQuery
+	}
+	return &c, nil
+}
+
+// ParseListQuery reads limit, cursor, sort, user, from, to and filename parameters.
+// Dates are given as YYYY-MM-DD, both ends of the range are inclusive.
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	q := ListQuery{
+		Limit:    defaultPageSize,
+		Sort:     SortNewest,
+		User:     values.Get("user"),
+		Filename: strings.TrimSpace(values.Get("filename")),
+	}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, ErrInvalidListQuery
+		}
+		q.Limit = n
+	}
+
+	switch v := values.Get("sort"); v {
+	case "":
+	case SortNewest, SortOldest, SortCaptured:
+		q.Sort = v
+	default:
+		return q, ErrInvalidListQuery
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil || c.Sort != q.Sort {
+			return q, ErrInvalidListQuery
+		}
+		q.Cursor = c
+	}
+
+	if v := values.Get("from"); v != "" {
+		d, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return q, ErrInvalidListQuery
+		}
+		q.From = d.Format(uploadedAtLayout)
+	}
+	if v := values.Get("to"); v != "" {
+		d, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return q, ErrInvalidListQuery
+		}
+		q.To = d.AddDate(0, 0, 1).Format(uploadedAtLayout)
+	}
+
+	return q, nil
+}
+
+// photoRow is a listed photo with the fields needed to build the next cursor.
+type photoRow struct {
+	User       string
+	ID         int64
+	Filename   string
+	Public     bool
+	UploadedAt string
+	captured   string
+}
+
+// QueryPhotoPage returns one page of photos matching the base condition and the query
+// filters, the total number of matching photos and the cursor of the next page.
+func QueryPhotoPage(db *sql.DB, base string, baseArgs []any, q ListQuery) ([]photoRow, int, string, error) {
+	const captured = `COALESCE(m.captureDate, '')`
+
+	where := []string{base}
+	args := append([]any{}, baseArgs...)
+	if q.User != "" {
+		where = append(where, `u.login = ?`)
+		args = append(args, q.User)
+	}
+	if q.From != "" {
+		where = append(where, `p.uploadedAt >= ?`)
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		where = append(where, `p.uploadedAt < ?`)
+		args = append(args, q.To)
+	}
+	if q.Filename != "" {
+		where = append(where, `p.originalName LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(q.Filename)+"%")
+	}
+
+	from := ` FROM photos p JOIN users u ON p.userID = u.ID LEFT JOIN photo_metadata m ON m.photoID = p.ID`
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*)`+from+` WHERE `+strings.Join(where, ` AND `), args...).Scan(&total); err != nil {
+		return nil, 0, "", err
+	}
+
+	var order string
+	switch q.Sort {
+	case SortOldest:
+		order = `p.ID ASC`
+		if q.Cursor != nil {
+			where = append(where, `p.ID > ?`)
+			args = append(args, q.Cursor.ID)
+		}
+	case SortCaptured:
+		// Photos without a capture date come last
+		order = captured + ` = '', ` + captured + ` DESC, p.ID DESC`
+		if c := q.Cursor; c != nil {
+			if c.Captured != "" {
+				where = append(where, `((`+captured+` != '' AND (`+captured+` < ? OR (`+captured+` = ? AND p.ID < ?))) OR `+captured+` = '')`)
+				args = append(args, c.Captured, c.Captured, c.ID)
+			} else {
+				where = append(where, captured+` = '' AND p.ID < ?`)
+				args = append(args, c.ID)
+			}
+		}
+	default:
+		order = `p.ID DESC`
+		if q.Cursor != nil {
+			where = append(where, `p.ID < ?`)
+			args = append(args, q.Cursor.ID)
+		}
+	}
+
+	// One extra row tells whether there is a next page
+	rows, err := db.Query(`SELECT u.login, p.ID, p.originalName, p.imageIsPublic, COALESCE(p.uploadedAt, ''), `+captured+
+		from+` WHERE `+strings.Join(where, ` AND `)+` ORDER BY `+order+` LIMIT ?`, append(args, q.Limit+1)...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer rows.Close()
+
+	list := []photoRow{}
+	for rows.Next() {
+		var p photoRow
+		var imageIsPublic int
+		if err := rows.Scan(&p.User, &p.ID, &p.Filename, &imageIsPublic, &p.UploadedAt, &p.captured); err != nil {
+			return nil, 0, "", err
+		}
+		p.Public = imageIsPublic != 0
+		list = append(list, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, "", err
+	}
+
+	next := ""
+	if len(list) > q.Limit {
+		list = list[:q.Limit]
+		last := list[len(list)-1]
+		next = pageCursor{Sort: q.Sort, ID: last.ID, Captured: last.captured}.encode()
+	}
+	return list, total, next, nil
+}
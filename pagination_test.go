@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseListQuery(t *testing.T) {
+	q, err := ParseListQuery(url.Values{"limit": {"10"}, "sort": {"oldest"}, "from": {"2024-01-01"}, "to": {"2024-01-31"}})
+	if err != nil {
+		t.Fatalf("ParseListQuery failed: %v", err)
+	}
+	if q.Limit != 10 || q.Sort != SortOldest || q.From != "2024-01-01T00:00:00Z" || q.To != "2024-02-01T00:00:00Z" {
+		t.Errorf("Unexpected query %+v", q)
+	}
+
+	cursor := pageCursor{Sort: SortNewest, ID: 5}.encode()
+	for _, values := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"1000"}},
+		{"sort": {"random"}},
+		{"from": {"yesterday"}},
+		{"cursor": {"not a cursor"}},
+		{"cursor": {cursor}, "sort": {"oldest"}},
+	} {
+		if _, err := ParseListQuery(values); err == nil {
+			t.Errorf("Expected %v to be rejected", values)
+		}
+	}
+}
+
+func TestPublicGalleryPagination(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	RegisterUser(db, &User{Login: "other", Password: "pass"})
+
+	db.Exec(`INSERT INTO photos (imagePath, originalName, imageIsPublic, userID, uploadedAt) VALUES
+		('1', 'beach.jpg', 1, 1, '2024-01-05T10:00:00Z'),
+		('2', 'city.jpg', 1, 2, '2024-01-10T10:00:00Z'),
+		('3', 'private.jpg', 0, 1, '2024-01-11T10:00:00Z'),
+		('4', 'beach2.jpg', 1, 1, '2024-02-01T10:00:00Z'),
+		('5', 'forest.jpg', 1, 2, '2024-02-03T10:00:00Z')`)
+	SavePhotoMetadata(db, 1, &PhotoMetadata{CaptureDate: "2023-07-01T12:00:00"})
+	SavePhotoMetadata(db, 4, &PhotoMetadata{CaptureDate: "2023-08-01T12:00:00"})
+	SavePhotoMetadata(db, 2, &PhotoMetadata{CaptureDate: "2023-08-01T12:00:00"})
+
+	gallery := HandlePublicGallery(db)
+	page := func(query string) (ids []int64, total int, next string) {
+		rec := httptest.NewRecorder()
+		gallery(rec, httptest.NewRequest("GET", "/api/public-gallery?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d for %q", rec.Code, query)
+		}
+		var body struct {
+			Items      []PublicPhoto `json:"items"`
+			Total      int           `json:"total"`
+			NextCursor *string       `json:"nextCursor"`
+		}
+		json.NewDecoder(rec.Body).Decode(&body)
+		for _, p := range body.Items {
+			ids = append(ids, p.ID)
+		}
+		if body.NextCursor != nil {
+			next = *body.NextCursor
+		}
+		return ids, body.Total, next
+	}
+	all := func(query string) []int64 {
+		var ids []int64
+		next := ""
+		for i := 0; i < 10; i++ {
+			q := query + "&limit=2"
+			if next != "" {
+				q += "&cursor=" + next
+			}
+			page, _, n := page(q)
+			ids = append(ids, page...)
+			if next = n; next == "" {
+				return ids
+			}
+		}
+		t.Fatalf("Pagination of %q did not end", query)
+		return nil
+	}
+	equal := func(got []int64, want ...int64) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	ids, total, next := page("limit=2")
+	if !equal(ids, 5, 4) || total != 4 || next == "" {
+		t.Errorf("Unexpected first page %v, total %d, next %q", ids, total, next)
+	}
+	if ids := all("sort=newest"); !equal(ids, 5, 4, 2, 1) {
+		t.Errorf("Unexpected newest order %v", ids)
+	}
+	if ids := all("sort=oldest"); !equal(ids, 1, 2, 4, 5) {
+		t.Errorf("Unexpected oldest order %v", ids)
+	}
+	// Equal capture dates are ordered by ID, photos without one come last
+	if ids := all("sort=captured"); !equal(ids, 4, 2, 1, 5) {
+		t.Errorf("Unexpected captured order %v", ids)
+	}
+
+	if ids, total, _ := page("user=other"); !equal(ids, 5, 2) || total != 2 {
+		t.Errorf("Unexpected user filter result %v", ids)
+	}
+	if ids, _, _ := page("from=2024-01-10&to=2024-02-01"); !equal(ids, 4, 2) {
+		t.Errorf("Unexpected date filter result %v", ids)
+	}
+	if ids, _, _ := page("filename=BEACH"); !equal(ids, 4, 1) {
+		t.Errorf("Unexpected filename filter result %v", ids)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PasswordSubject is the account a password is being set for. UserID and
+// PasswordHashes are empty for new accounts.
+type PasswordSubject struct {
+	Login          string
+	UserID         int64
+	PasswordHashes []string // current first, then previous ones
+}
+
+// SubjectValidator is implemented by validators that also check the password against
+// the account it is set for.
+type SubjectValidator interface {
+	ValidateFor(password string, subject PasswordSubject) error
+}
+
+// minLoginCheckLength avoids rejecting every password containing a very short login
+const minLoginCheckLength = 3
+
+// BlocklistValidator - rejects common or breached passwords and passwords containing
+// the login. It is combined with the mode through PasswordPolicy
+type BlocklistValidator struct {
+	common      map[string]struct{}
+	hibpDir     string
+	minCount    int
+	rejectLogin bool
+}
+
+// NewBlocklistValidator loads the configured lists. The plain list is kept in memory,
+// the HIBP files are read on demand, one file per check.
+func NewBlocklistValidator(cfg BlocklistConfig) (*BlocklistValidator, error) {
+	v := &BlocklistValidator{
+		hibpDir:     cfg.HIBPDir,
+		minCount:    cfg.MinCount,
+		rejectLogin: cfg.RejectLogin,
+	}
+	if v.minCount <= 0 {
+		v.minCount = 1
+	}
+
+	if cfg.File != "" {
+		file, err := os.Open(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("password blocklist: %w", err)
+		}
+		defer file.Close()
+
+		v.common = map[string]struct{}{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				v.common[strings.ToLower(line)] = struct{}{}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("password blocklist: %w", err)
+		}
+	}
+
+	if v.hibpDir != "" {
+		if info, err := os.Stat(v.hibpDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("password blocklist: %s is not a directory", v.hibpDir)
+		}
+	}
+	return v, nil
+}
+
+func (v *BlocklistValidator) Validate(password string) error {
+	return v.ValidateFor(password, PasswordSubject{})
+}
+
+func (v *BlocklistValidator) ValidateFor(password string, subject PasswordSubject) error {
+	var violations []PasswordViolation
+	login := strings.ToLower(subject.Login)
+	if v.rejectLogin && len(login) >= minLoginCheckLength && strings.Contains(strings.ToLower(password), login) {
+		violations = append(violations, newViolation(ViolationContainsLogin, nil))
+	}
+	if _, found := v.common[strings.ToLower(password)]; found {
+		violations = append(violations, newViolation(ViolationTooCommon, nil))
+	}
+	breached, err := v.breached(password)
+	if err != nil {
+		return fmt.Errorf("password blocklist unavailable: %w", err)
+	}
+	if breached {
+		violations = append(violations, newViolation(ViolationBreached, nil))
+	}
+	return policyError(violations)
+}
+
+func (v *BlocklistValidator) GetName() string {
+	return "blocklist"
+}
+
+// breached looks the password up in k-anonymity range files: the file named after the
+// first 5 hex digits of the SHA-1 lists the remaining 35 digits as SUFFIX:COUNT lines.
+func (v *BlocklistValidator) breached(password string) (bool, error) {
+	if v.hibpDir == "" {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	file, err := os.Open(filepath.Join(v.hibpDir, prefix))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(v.hibpDir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(hash, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			n = 1
+		}
+		return n >= v.minCount, nil
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHIBPRange(t *testing.T, dir, password string, count string) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	lines := "0000000000000000000000000000000000A:3\r\n" + digest[5:] + ":" + count + "\r\n"
+	if err := os.WriteFile(filepath.Join(dir, digest[:5]), []byte(lines), 0644); err != nil {
+		t.Fatalf("Failed to write range file: %v", err)
+	}
+}
+
+func TestBlocklistValidator(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "common.txt")
+	os.WriteFile(list, []byte("123456\nPassword1!\n\nqwerty\n"), 0644)
+	hibp := filepath.Join(dir, "hibp")
+	os.Mkdir(hibp, 0755)
+	writeHIBPRange(t, hibp, "Breached#2024", "42")
+	writeHIBPRange(t, hibp, "Rare#Breach99", "1")
+
+	v, err := NewBlocklistValidator(BlocklistConfig{File: list, HIBPDir: hibp, MinCount: 2, RejectLogin: true})
+	if err != nil {
+		t.Fatalf("NewBlocklistValidator failed: %v", err)
+	}
+
+	cases := []struct {
+		password, login string
+		ok              bool
+	}{
+		{"Password1!", "", false},          // plain list
+		{"PASSWORD1!", "", false},          // case-insensitive
+		{"Breached#2024", "", false},       // HIBP range file
+		{"Rare#Breach99", "", true},        // below min_count
+		{"Xx-Alice-2024!", "alice", false}, // contains the login
+		{"Xx-Alice-2024!", "", true},       // no login known
+		{"Unique#Pass77", "bob", true},     // not on any list
+		{"Ab1!Ab1!", "ab", true},           // login too short to check
+	}
+	for _, c := range cases {
+		err := v.ValidateFor(c.password, PasswordSubject{Login: c.login})
+		if (err == nil) != c.ok {
+			t.Errorf("ValidateFor(%q, %q) = %v, expected ok=%v", c.password, c.login, err, c.ok)
+		}
+	}
+	if _, err := NewBlocklistValidator(BlocklistConfig{File: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("Expected missing list to fail")
+	}
+	if _, err := NewBlocklistValidator(BlocklistConfig{HIBPDir: list}); err == nil {
+		t.Error("Expected HIBP path that is not a directory to fail")
+	}
+}
+
+func TestRegisterRejectsBlockedPassword(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "common.txt")
+	os.WriteFile(list, []byte("letmein1\n"), 0644)
+	err := InitPasswordValidator(&Config{Password: &PasswordConfig{
+		Mode:      "medium",
+		Blocklist: &BlocklistConfig{File: list, RejectLogin: true},
+	}})
+	if err != nil {
+		t.Fatalf("InitPasswordValidator failed: %v", err)
+	}
+	t.Cleanup(func() { globalPasswordValidator = nil })
+
+	_, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/register", HandleRegister(db))
+
+	for _, body := range []string{
+		`{"login":"carol","password":"letmein1"}`,
+		`{"login":"carol","password":"carol2024"}`,
+		`{"login":"carol","password":"abc"}`,
+	} {
+		if code := (cookieJar{}).do(mux, "POST", "/api/register", body); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, code)
+		}
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/register", `{"login":"carol","password":"tulip77garden"}`); code != http.StatusOK {
+		t.Errorf("Expected valid password to be accepted, got %d", code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether the hash was made with another algorithm or other
+	// parameters than the hasher would use now.
+	NeedsRehash(hash string) bool
+	GetName() string
+}
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// BcryptHasher - bcrypt in its standard $2b$ format
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) cost() int {
+	if h.Cost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	return string(hash), err
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+func (h *BcryptHasher) GetName() string {
+	return "bcrypt"
+}
+
+// Argon2idHasher - argon2id in the PHC string format:
+// $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2idHasher struct {
+	MemoryKiB   uint32 `json:"memory_kib"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+func (h *Argon2idHasher) params() argon2Params {
+	p := argon2Params{memory: h.MemoryKiB, iterations: h.Iterations, parallelism: h.Parallelism, keyLen: argon2KeyLen}
+	if p.memory == 0 {
+		p.memory = 64 * 1024
+	}
+	if p.iterations == 0 {
+		p.iterations = 3
+	}
+	if p.parallelism == 0 {
+		p.parallelism = 2
+	}
+	return p
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.params()
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	p, _, _, err := parseArgon2id(hash)
+	return err != nil || p != h.params()
+}
+
+func (h *Argon2idHasher) GetName() string {
+	return "argon2id"
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	keyLen      uint32
+}
+
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	if err != nil || p.memory == 0 || p.iterations == 0 || p.parallelism == 0 {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	p.keyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// verifyPasswordHash checks the password against a hash of any supported algorithm,
+// so hashes made before a change of configuration keep working.
+func verifyPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		computed := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLen)
+		return subtle.ConstantTimeCompare(computed, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// GetPasswordHasher returns the configured hasher. An unknown algorithm is a config
+// error rather than a silent fallback to bcrypt.
+func GetPasswordHasher(cfg *Config) (PasswordHasher, error) {
+	if cfg.Password == nil || cfg.Password.Hashing == nil {
+		return &BcryptHasher{}, nil
+	}
+
+	h := cfg.Password.Hashing
+	switch h.Algorithm {
+	case "argon2id":
+		if h.Argon2id != nil {
+			return h.Argon2id, nil
+		}
+		return &Argon2idHasher{}, nil
+	case "", "bcrypt":
+		// 0 selects the default cost, other values outside the range would fail every hash
+		if h.BcryptCost != 0 && (h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost) {
+			return nil, fmt.Errorf("password: bcrypt_cost %d is outside %d-%d", h.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &BcryptHasher{Cost: h.BcryptCost}, nil
+	default:
+		return nil, fmt.Errorf("password: unknown hashing algorithm %q, use bcrypt or argon2id", h.Algorithm)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fastArgon2id keeps the tests quick, production defaults use 64 MiB
+var fastArgon2id = &Argon2idHasher{MemoryKiB: 1024, Iterations: 1, Parallelism: 1}
+
+func useHasher(t *testing.T, h PasswordHasher) {
+	globalPasswordHasher = h
+	t.Cleanup(func() { globalPasswordHasher = nil })
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for _, h := range []PasswordHasher{&BcryptHasher{Cost: 4}, fastArgon2id} {
+		hash, err := h.Hash("secret")
+		if err != nil {
+			t.Fatalf("%s: hash failed: %v", h.GetName(), err)
+		}
+		if !verifyPasswordHash(hash, "secret") || verifyPasswordHash(hash, "wrong") {
+			t.Errorf("%s: unexpected verification result for %s", h.GetName(), hash)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s: expected fresh hash not to need rehash", h.GetName())
+		}
+	}
+
+	hash, _ := fastArgon2id.Hash("secret")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Expected PHC formatted hash, got %s", hash)
+	}
+	stronger := &Argon2idHasher{MemoryKiB: 2048, Iterations: 1, Parallelism: 1}
+	if !stronger.NeedsRehash(hash) || !(&BcryptHasher{}).NeedsRehash(hash) {
+		t.Error("Expected rehash for other parameters or algorithm")
+	}
+
+	bcryptHash, _ := (&BcryptHasher{Cost: 4}).Hash("secret")
+	if !(&BcryptHasher{Cost: 5}).NeedsRehash(bcryptHash) || !fastArgon2id.NeedsRehash(bcryptHash) {
+		t.Error("Expected rehash for other cost or algorithm")
+	}
+
+	for _, bad := range []string{"", "plain", "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5"} {
+		if verifyPasswordHash(bad, "secret") {
+			t.Errorf("Expected malformed hash %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	useHasher(t, &BcryptHasher{Cost: 4})
+	_, db, mux := testSessionServer(t)
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	var before string
+	db.QueryRow("SELECT password FROM users WHERE login = 'user'").Scan(&before)
+
+	useHasher(t, fastArgon2id)
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"wrong"}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected wrong password to fail, got %d", code)
+	}
+	var after string
+	db.QueryRow("SELECT password FROM users WHERE login = 'user'").Scan(&after)
+	if after != before {
+		t.Error("Expected failed login not to change the hash")
+	}
+
+	// The limiter delays the next attempt after the failure
+	db.Exec("DELETE FROM failed_logins")
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`); code != http.StatusOK {
+		t.Fatalf("Login failed with %d", code)
+	}
+	db.QueryRow("SELECT password FROM users WHERE login = 'user'").Scan(&after)
+	if !strings.HasPrefix(after, "$argon2id$") {
+		t.Fatalf("Expected hash to be upgraded to argon2id, got %s", after)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`); code != http.StatusOK {
+		t.Errorf("Expected login with the upgraded hash, got %d", code)
+	}
+}
+
+func TestGetPasswordHasher(t *testing.T) {
+	if h, _ := GetPasswordHasher(&Config{}); h.GetName() != "bcrypt" {
+		t.Errorf("Expected bcrypt by default, got %s", h.GetName())
+	}
+	cfg := &Config{Password: &PasswordConfig{Hashing: &HashingConfig{Algorithm: "argon2id"}}}
+	if h, _ := GetPasswordHasher(cfg); h.GetName() != "argon2id" {
+		t.Errorf("Expected argon2id, got %s", h.GetName())
+	}
+	cfg.Password.Hashing = &HashingConfig{Algorithm: "bcrypt", BcryptCost: 12}
+	h, _ := GetPasswordHasher(cfg)
+	if b, ok := h.(*BcryptHasher); !ok || b.cost() != 12 {
+		t.Errorf("Expected bcrypt with cost 12, got %+v", h)
+	}
+	for _, cost := range []int{-1, 3, 32} {
+		cfg.Password.Hashing = &HashingConfig{BcryptCost: cost}
+		if _, err := GetPasswordHasher(cfg); err == nil {
+			t.Errorf("Expected bcrypt cost %d to be rejected", cost)
+		}
+	}
+	cfg.Password.Hashing = &HashingConfig{Algorithm: "argon2"}
+	if _, err := GetPasswordHasher(cfg); err == nil {
+		t.Error("Expected an unknown algorithm to be rejected")
+	}
+	if err := InitPasswordHasher(cfg); err == nil {
+		t.Error("Expected InitPasswordHasher to fail with an unknown algorithm")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Password history and maximum password age. Previous hashes are kept in
+// password_history, the current one stays in users.password.
+
+const (
+	expiredPasswordTokenPurpose = "password_expired"
+	expiredPasswordTokenTTL     = 5 * time.Minute
+)
+
+// globalPasswordHistory is set by InitPasswordValidator, it decides how many previous
+// hashes are kept when a password changes.
+var globalPasswordHistory PasswordHistoryConfig
+
+func (h PasswordHistoryConfig) MaxAge() time.Duration {
+	return time.Duration(h.MaxAgeDays) * 24 * time.Hour
+}
+
+func passwordHistoryConfig(cfg *Config) PasswordHistoryConfig {
+	if cfg.Password == nil || cfg.Password.History == nil {
+		return PasswordHistoryConfig{}
+	}
+	return *cfg.Password.History
+}
+
+// HistoryValidator - rejects the current password and the previous ones, Remember
+// passwords in total. Needs the hashes of the subject, new accounts have none.
+type HistoryValidator struct {
+	Remember int
+}
+
+func (v *HistoryValidator) Validate(password string) error {
+	return nil
+}
+
+func (v *HistoryValidator) ValidateFor(password string, subject PasswordSubject) error {
+	for i, hash := range subject.PasswordHashes {
+		if i >= v.Remember {
+			break
+		}
+		if verifyPasswordHash(hash, password) {
+			return policyError([]PasswordViolation{newViolation(ViolationReused, map[string]any{"remember": v.Remember})})
+		}
+	}
+	return nil
+}
+
+func (v *HistoryValidator) GetName() string {
+	return "history"
+}
+
+// LoadPasswordSubject returns the user with the current and previous password hashes,
+// newest first.
+func LoadPasswordSubject(db *sql.DB, userID int64) (PasswordSubject, error) {
+	subject := PasswordSubject{UserID: userID}
+	var current sql.NullString
+	if err := db.QueryRow(`SELECT login, password FROM users WHERE ID = ?`, userID).Scan(&subject.Login, &current); err != nil {
+		return subject, err
+	}
+	// Accounts created through single sign-on have no password
+	if current.Valid {
+		subject.PasswordHashes = append(subject.PasswordHashes, current.String)
+	}
+
+	rows, err := db.Query(`SELECT hash FROM password_history WHERE userID = ? ORDER BY ID DESC`, userID)
+	if err != nil {
+		return subject, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return subject, err
+		}
+		subject.PasswordHashes = append(subject.PasswordHashes, hash)
+	}
+	return subject, rows.Err()
+}
+
+// storePassword replaces the password hash of the user, moving the old one to the
+// history when the history is enabled.
+func storePassword(tx *sql.Tx, userID int64, hash string, mustChange bool) error {
+	if keep := globalPasswordHistory.Remember - 1; keep > 0 {
+		_, err := tx.Exec(`INSERT INTO password_history (userID, hash, replacedAt) SELECT ID, password, ? FROM users WHERE ID = ? AND password IS NOT NULL`,
+			time.Now().UTC().Format(sessionTimeLayout), userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM password_history WHERE userID = ? AND ID NOT IN
+			(SELECT ID FROM password_history WHERE userID = ? ORDER BY ID DESC LIMIT ?)`, userID, userID, keep)
+		if err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`DELETE FROM password_history WHERE userID = ?`, userID); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`UPDATE users SET password = ?, mustChangePassword = ?, passwordChangedAt = ? WHERE ID = ?`,
+		hash, boolInt(mustChange), time.Now().UTC().Format(sessionTimeLayout), userID)
+	return err
+}
+
+// passwordExpiry returns when the password of the user was changed and whether it is
+// older than the configured maximum age.
+func passwordExpiry(cfg *Config, db *sql.DB, userID int64) (string, bool, error) {
+	var changedAt sql.NullString
+	if err := db.QueryRow(`SELECT passwordChangedAt FROM users WHERE ID = ?`, userID).Scan(&changedAt); err != nil {
+		return "", false, err
+	}
+	maxAge := passwordHistoryConfig(cfg).MaxAge()
+	if maxAge <= 0 || !changedAt.Valid {
+		return changedAt.String, false, nil
+	}
+	changed, err := time.Parse(sessionTimeLayout, changedAt.String)
+	if err != nil {
+		return changedAt.String, false, nil
+	}
+	return changedAt.String, time.Since(changed) > maxAge, nil
+}
+
+// GenerateExpiredPasswordToken allows setting a new password after a login with an
+// expired one. The token stops working once the password is changed.
+func GenerateExpiredPasswordToken(cfg *Config, userID int64, changedAt string) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id":    userID,
+		"purpose":    expiredPasswordTokenPurpose,
+		"changed_at": changedAt,
+		"exp":        time.Now().Add(expiredPasswordTokenTTL).Unix(),
+	}
+	return signToken(cfg, claims)
+}
+
+func parseExpiredPasswordToken(cfg *Config, db *sql.DB, tokenStr string) (int64, bool) {
+	claims, err := parseJWT(cfg, tokenStr)
+	if err != nil || claims["purpose"] != expiredPasswordTokenPurpose {
+		return 0, false
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, false
+	}
+	changedAt, _, err := passwordExpiry(cfg, db, int64(userID))
+	if err != nil || claims["changed_at"] != changedAt {
+		return 0, false
+	}
+	return int64(userID), true
+}
+
+// writePasswordExpired answers a login with an expired password. No session is started
+// until a new password is set.
+func writePasswordExpired(w http.ResponseWriter, cfg *Config, userID int64, changedAt string) {
+	token, err := GenerateExpiredPasswordToken(cfg, userID, changedAt)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":        "password_expired",
+		"passwordToken": token,
+	})
+}
+
+// HandleChangeExpiredPassword sets a new password with the token returned by a login
+// with an expired password and completes the login.
+func HandleChangeExpiredPassword(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ExpiredPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		userID, ok := parseExpiredPasswordToken(cfg, db, req.PasswordToken)
+		if !ok {
+			writeAuthError(w, ErrUnauthenticated)
+			return
+		}
+		principal, err := LoadPrincipal(db, userID)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		subject, err := LoadPasswordSubject(db, userID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if len(subject.PasswordHashes) > 0 && verifyPasswordHash(subject.PasswordHashes[0], req.NewPassword) {
+			http.Error(w, "New password must differ from the old one", http.StatusBadRequest)
+			return
+		}
+		if err := ValidatePasswordFor(req.NewPassword, subject); err != nil {
+			writePasswordError(w, r, err)
+			return
+		}
+		if err := SetUserPassword(db, userID, req.NewPassword, false); err != nil {
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		principal.MustChangePassword = false
+		completeLogin(w, r, cfg, db, principal, false)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func usePasswordHistory(t *testing.T, history PasswordHistoryConfig) *Config {
+	cfg := &Config{Password: &PasswordConfig{Mode: "easy", History: &history}}
+	if err := InitPasswordValidator(cfg); err != nil {
+		t.Fatalf("InitPasswordValidator failed: %v", err)
+	}
+	t.Cleanup(func() {
+		globalPasswordValidator = nil
+		globalPasswordHistory = PasswordHistoryConfig{}
+	})
+	return cfg
+}
+
+func TestChangePasswordRejectsReuse(t *testing.T) {
+	usePasswordHistory(t, PasswordHistoryConfig{Remember: 3})
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/change-password", AuthMiddlewarePasswordChange(cfg, db, HandleChangePassword(db, NewLoginLimiter(db, cfg.Login, nil))))
+	RegisterUser(db, &User{Login: "user", Password: "first"})
+
+	jar := cookieJar{}
+	jar.do(mux, "POST", "/api/login", `{"login":"user","password":"first"}`)
+	change := func(from, to string) int {
+		return jar.do(mux, "POST", "/api/change-password", `{"oldPassword":"`+from+`","newPassword":"`+to+`"}`)
+	}
+
+	if code := change("first", "second"); code != http.StatusOK {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	if code := change("second", "third"); code != http.StatusOK {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	if code := change("third", "first"); code != http.StatusBadRequest {
+		t.Errorf("Expected one of the last 3 passwords to be rejected, got %d", code)
+	}
+	if code := change("third", "fourth"); code != http.StatusOK {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	if code := change("fourth", "second"); code != http.StatusBadRequest {
+		t.Errorf("Expected one of the last 3 passwords to be rejected, got %d", code)
+	}
+	if code := change("fourth", "first"); code != http.StatusOK {
+		t.Errorf("Expected a password older than the last 3 to be accepted, got %d", code)
+	}
+
+	var kept int
+	db.QueryRow(`SELECT COUNT(*) FROM password_history`).Scan(&kept)
+	if kept != 2 {
+		t.Errorf("Expected 2 previous hashes to be kept, got %d", kept)
+	}
+}
+
+func TestLoginWithExpiredPassword(t *testing.T) {
+	pwCfg := usePasswordHistory(t, PasswordHistoryConfig{Remember: 2, MaxAgeDays: 30})
+	cfg, db, mux := testSessionServer(t)
+	cfg.Password = pwCfg.Password
+	mux.HandleFunc("/api/login/expired-password", HandleChangeExpiredPassword(cfg, db))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`); code != http.StatusOK {
+		t.Fatalf("Login failed with %d", code)
+	}
+	db.Exec(`UPDATE users SET passwordChangedAt = ? WHERE login = 'user'`,
+		time.Now().UTC().Add(-31*24*time.Hour).Format(sessionTimeLayout))
+
+	jar := cookieJar{}
+	var login struct {
+		Status        string `json:"status"`
+		PasswordToken string `json:"passwordToken"`
+	}
+	if code := jar.postJSON(mux, "/api/login", `{"login":"user","password":"pass"}`, &login); code != http.StatusOK {
+		t.Fatalf("Login failed with %d", code)
+	}
+	if login.Status != "password_expired" || login.PasswordToken == "" {
+		t.Fatalf("Expected password_expired, got %+v", login)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected no session for an expired password, got %d", code)
+	}
+
+	body := func(password string) string {
+		return `{"passwordToken":"` + login.PasswordToken + `","newPassword":"` + password + `"}`
+	}
+	if code := jar.do(mux, "POST", "/api/login/expired-password", body("pass")); code != http.StatusBadRequest {
+		t.Errorf("Expected the expired password to be rejected, got %d", code)
+	}
+	if code := jar.do(mux, "POST", "/api/login/expired-password", body("fresh")); code != http.StatusOK {
+		t.Fatalf("Expected new password to complete the login, got %d", code)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected a session after the password change, got %d", code)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login/expired-password", body("another")); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token to stop working after the change, got %d", code)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"fresh"}`); code != http.StatusOK {
+		t.Errorf("Expected login with the new password, got %d", code)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Password policy: validators report every violated rule as a code with parameters, so
+// the frontend can translate them. Messages are rendered in English or Polish, as is
+// the feedback of the strength estimate.
+
+// Violation codes
+const (
+	ViolationTooShort         = "too_short" // params: min
+	ViolationTooLong          = "too_long"  // params: max
+	ViolationMissingLetter    = "missing_letter"
+	ViolationMissingUppercase = "missing_uppercase"
+	ViolationMissingLowercase = "missing_lowercase"
+	ViolationMissingDigit     = "missing_digit"
+	ViolationMissingSpecial   = "missing_special"
+	ViolationPatternMismatch  = "pattern_mismatch" // params: pattern
+	ViolationTooWeak          = "too_weak"         // params: score, minScore, warning, suggestions (feedback codes)
+	ViolationContainsLogin    = "contains_login"
+	ViolationTooCommon        = "too_common"
+	ViolationBreached         = "breached"
+	ViolationReused           = "reused" // params: remember
+)
+
+var violationMessages = map[string]map[string]string{
+	"en": {
+		ViolationTooShort:         "password must be at least {min} characters long",
+		ViolationTooLong:          "password must be at most {max} characters long",
+		ViolationMissingLetter:    "password must contain at least one letter",
+		ViolationMissingUppercase: "password must contain at least one uppercase letter",
+		ViolationMissingLowercase: "password must contain at least one lowercase letter",
+		ViolationMissingDigit:     "password must contain at least one digit",
+		ViolationMissingSpecial:   "password must contain at least one special character",
+		ViolationPatternMismatch:  "password must match pattern: {pattern}",
+		ViolationTooWeak:          "password is too easy to guess",
+		ViolationContainsLogin:    "password must not contain the login",
+		ViolationTooCommon:        "password is too common",
+		ViolationBreached:         "password has appeared in a data breach",
+		ViolationReused:           "password must differ from the last {remember} passwords",
+	},
+	"pl": {
+		ViolationTooShort:         "hasło musi mieć co najmniej {min} znaków",
+		ViolationTooLong:          "hasło może mieć najwyżej {max} znaków",
+		ViolationMissingLetter:    "hasło musi zawierać co najmniej jedną literę",
+		ViolationMissingUppercase: "hasło musi zawierać co najmniej jedną wielką literę",
+		ViolationMissingLowercase: "hasło musi zawierać co najmniej jedną małą literę",
+		ViolationMissingDigit:     "hasło musi zawierać co najmniej jedną cyfrę",
+		ViolationMissingSpecial:   "hasło musi zawierać co najmniej jeden znak specjalny",
+		ViolationPatternMismatch:  "hasło musi pasować do wzorca: {pattern}",
+		ViolationTooWeak:          "hasło jest zbyt łatwe do odgadnięcia",
+		ViolationContainsLogin:    "hasło nie może zawierać loginu",
+		ViolationTooCommon:        "hasło jest zbyt popularne",
+		ViolationBreached:         "hasło pojawiło się w wycieku danych",
+		ViolationReused:           "hasło musi różnić się od {remember} ostatnich haseł",
+	},
+}
+
+// Strength feedback codes, reported as warning and suggestions of the strength estimate
+const (
+	WarningLoginUsed       = "login_used"
+	WarningTop10Password   = "top10_password"
+	WarningCommonPassword  = "common_password"
+	WarningSingleWord      = "single_word"
+	WarningStraightRow     = "straight_row"
+	WarningKeyboardPattern = "keyboard_pattern"
+	WarningRepeatedChars   = "repeated_characters"
+	WarningRepeatedPattern = "repeated_pattern"
+	WarningSequence        = "sequence"
+	WarningRecentYear      = "recent_year"
+	WarningDate            = "date"
+
+	SuggestionUseWords           = "use_words"
+	SuggestionNoSymbolsNeeded    = "no_symbols_needed"
+	SuggestionAddWord            = "add_word"
+	SuggestionCapitalization     = "capitalization"
+	SuggestionAllUppercase       = "all_uppercase"
+	SuggestionSubstitutions      = "predictable_substitutions"
+	SuggestionLongerKeyboard     = "longer_keyboard_pattern"
+	SuggestionAvoidRepeats       = "avoid_repeats"
+	SuggestionAvoidSequences     = "avoid_sequences"
+	SuggestionAvoidRecentYears   = "avoid_recent_years"
+	SuggestionAvoidPersonalYears = "avoid_personal_years"
+	SuggestionAvoidPersonalDates = "avoid_personal_dates"
+)
+
+var feedbackMessages = map[string]map[string]string{
+	"en": {
+		WarningLoginUsed:       "Avoid using your login in the password",
+		WarningTop10Password:   "This is a top-10 common password",
+		WarningCommonPassword:  "This is a very common password",
+		WarningSingleWord:      "A word by itself is easy to guess",
+		WarningStraightRow:     "Straight rows of keys are easy to guess",
+		WarningKeyboardPattern: "Short keyboard patterns are easy to guess",
+		WarningRepeatedChars:   `Repeats like "aaa" are easy to guess`,
+		WarningRepeatedPattern: `Repeats like "abcabcabc" are only slightly harder to guess than "abc"`,
+		WarningSequence:        "Sequences like abc or 6543 are easy to guess",
+		WarningRecentYear:      "Recent years are easy to guess",
+		WarningDate:            "Dates are often easy to guess",
+
+		SuggestionUseWords:           "Use a few words, avoid common phrases",
+		SuggestionNoSymbolsNeeded:    "No need for symbols, digits, or uppercase letters",
+		SuggestionAddWord:            "Add another word or two. Uncommon words are better.",
+		SuggestionCapitalization:     "Capitalization doesn't help very much",
+		SuggestionAllUppercase:       "All-uppercase is almost as easy to guess as all-lowercase",
+		SuggestionSubstitutions:      "Predictable substitutions like '@' instead of 'a' don't help very much",
+		SuggestionLongerKeyboard:     "Use a longer keyboard pattern with more turns",
+		SuggestionAvoidRepeats:       "Avoid repeated words and characters",
+		SuggestionAvoidSequences:     "Avoid sequences",
+		SuggestionAvoidRecentYears:   "Avoid recent years",
+		SuggestionAvoidPersonalYears: "Avoid years that are associated with you",
+		SuggestionAvoidPersonalDates: "Avoid dates and years that are associated with you",
+	},
+	"pl": {
+		WarningLoginUsed:       "Nie używaj loginu w haśle",
+		WarningTop10Password:   "To jedno z 10 najpopularniejszych haseł",
+		WarningCommonPassword:  "To bardzo popularne hasło",
+		WarningSingleWord:      "Pojedyncze słowo łatwo odgadnąć",
+		WarningStraightRow:     "Proste rzędy klawiszy łatwo odgadnąć",
+		WarningKeyboardPattern: "Krótkie wzory na klawiaturze łatwo odgadnąć",
+		WarningRepeatedChars:   `Powtórzenia typu "aaa" łatwo odgadnąć`,
+		WarningRepeatedPattern: `Powtórzenia typu "abcabcabc" są niewiele trudniejsze do odgadnięcia niż "abc"`,
+		WarningSequence:        "Ciągi typu abc lub 6543 łatwo odgadnąć",
+		WarningRecentYear:      "Ostatnie lata łatwo odgadnąć",
+		WarningDate:            "Daty często łatwo odgadnąć",
+
+		SuggestionUseWords:           "Użyj kilku słów, unikaj popularnych zwrotów",
+		SuggestionNoSymbolsNeeded:    "Symbole, cyfry ani wielkie litery nie są potrzebne",
+		SuggestionAddWord:            "Dodaj jedno lub dwa słowa. Lepsze są rzadkie słowa.",
+		SuggestionCapitalization:     "Wielka litera niewiele pomaga",
+		SuggestionAllUppercase:       "Same wielkie litery są prawie tak łatwe do odgadnięcia jak same małe",
+		SuggestionSubstitutions:      "Przewidywalne zamiany, np. '@' zamiast 'a', niewiele pomagają",
+		SuggestionLongerKeyboard:     "Użyj dłuższego wzoru na klawiaturze z większą liczbą zmian kierunku",
+		SuggestionAvoidRepeats:       "Unikaj powtarzania słów i znaków",
+		SuggestionAvoidSequences:     "Unikaj ciągów znaków",
+		SuggestionAvoidRecentYears:   "Unikaj ostatnich lat",
+		SuggestionAvoidPersonalYears: "Unikaj lat, które są z tobą związane",
+		SuggestionAvoidPersonalDates: "Unikaj dat i lat, które są z tobą związane",
+	},
+}
+
+const defaultLanguage = "en"
+
+// localizeFeedback renders a strength feedback code. Unknown codes are returned as is.
+func localizeFeedback(lang, code string) string {
+	if message, ok := feedbackMessages[lang][code]; ok {
+		return message
+	}
+	if message, ok := feedbackMessages[defaultLanguage][code]; ok {
+		return message
+	}
+	return code
+}
+
+// PasswordViolation is one broken rule of the password policy.
+type PasswordViolation struct {
+	Code    string         `json:"code"`
+	Params  map[string]any `json:"params,omitempty"`
+	Message string         `json:"message"`
+}
+
+func newViolation(code string, params map[string]any) PasswordViolation {
+	v := PasswordViolation{Code: code, Params: params}
+	v.Message = v.localize(defaultLanguage)
+	return v
+}
+
+// localize renders the message of the violation, filling {param} placeholders.
+func (v PasswordViolation) localize(lang string) string {
+	message, ok := violationMessages[lang][v.Code]
+	if !ok {
+		message, ok = violationMessages[defaultLanguage][v.Code]
+	}
+	if !ok {
+		return v.Message
+	}
+	for name, value := range v.Params {
+		message = strings.ReplaceAll(message, "{"+name+"}", fmt.Sprint(value))
+	}
+	return message
+}
+
+// PolicyError lists every rule the password violates.
+type PolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// policyError returns nil when there are no violations.
+func policyError(violations []PasswordViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PolicyError{Violations: violations}
+}
+
+// validateFor passes the subject to validators that check it.
+func validateFor(v PasswordValidator, password string, subject PasswordSubject) error {
+	if sv, ok := v.(SubjectValidator); ok {
+		return sv.ValidateFor(password, subject)
+	}
+	return v.Validate(password)
+}
+
+// PasswordPolicy - runs every validator of the chain and collects all violations.
+// Errors other than violations, like an unreadable blocklist, stop the chain.
+type PasswordPolicy struct {
+	Validators []PasswordValidator
+}
+
+func (p *PasswordPolicy) Validate(password string) error {
+	return p.ValidateFor(password, PasswordSubject{})
+}
+
+func (p *PasswordPolicy) ValidateFor(password string, subject PasswordSubject) error {
+	var violations []PasswordViolation
+	for _, v := range p.Validators {
+		err := validateFor(v, password, subject)
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			violations = append(violations, policyErr.Violations...)
+		} else if err != nil {
+			return err
+		}
+	}
+	return policyError(violations)
+}
+
+func (p *PasswordPolicy) GetName() string {
+	names := make([]string, len(p.Validators))
+	for i, v := range p.Validators {
+		names[i] = v.GetName()
+	}
+	return strings.Join(names, "+")
+}
+
+// preferredLanguage picks the first supported language of the Accept-Language header.
+func preferredLanguage(r *http.Request) string {
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		tag, _, _ = strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := violationMessages[tag]; ok {
+			return tag
+		}
+	}
+	return defaultLanguage
+}
+
+// localizedViolations renders the messages in the language of the request.
+func localizedViolations(r *http.Request, violations []PasswordViolation) []PasswordViolation {
+	lang := preferredLanguage(r)
+	out := make([]PasswordViolation, len(violations))
+	for i, v := range violations {
+		out[i] = v
+		out[i].Message = v.localize(lang)
+	}
+	return out
+}
+
+// writePasswordError answers with the list of violations, or with the plain message of
+// other validation errors.
+func writePasswordError(w http.ResponseWriter, r *http.Request, err error) {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	violations := localizedViolations(r, policyErr.Violations)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":      "password_policy",
+		"message":    (&PolicyError{Violations: violations}).Error(),
+		"violations": violations,
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func violationCodes(err error) []string {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	var codes []string
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestValidatorsListEveryViolation(t *testing.T) {
+	cases := []struct {
+		validator PasswordValidator
+		password  string
+		codes     []string
+	}{
+		{&EasyValidator{}, "ab", []string{ViolationTooShort}},
+		{&MediumValidator{}, "!!", []string{ViolationTooShort, ViolationMissingLetter, ViolationMissingDigit}},
+		{&RestrictValidator{}, "pass", []string{ViolationTooShort, ViolationMissingUppercase, ViolationMissingDigit, ViolationMissingSpecial}},
+		{&CustomValidator{MaxLength: 4, RequireDigit: true, Regex: "^[a-z]+$"}, "Abcde", []string{ViolationTooLong, ViolationMissingDigit, ViolationPatternMismatch}},
+	}
+	for _, c := range cases {
+		if codes := violationCodes(c.validator.Validate(c.password)); !reflect.DeepEqual(codes, c.codes) {
+			t.Errorf("%s(%q): expected %v, got %v", c.validator.GetName(), c.password, c.codes, codes)
+		}
+	}
+
+	err := (&CustomValidator{MinLength: 12}).Validate("short")
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || policyErr.Violations[0].Params["min"] != 12 || err.Error() != "password must be at least 12 characters long" {
+		t.Errorf("Unexpected violation %v", err)
+	}
+}
+
+func TestPasswordPolicyChain(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "common.txt")
+	os.WriteFile(list, []byte("Summer2024\n"), 0644)
+	err := InitPasswordValidator(&Config{Password: &PasswordConfig{
+		Policy:    []string{"restrict", "strength"},
+		Blocklist: &BlocklistConfig{File: list, RejectLogin: true},
+	}})
+	if err != nil {
+		t.Fatalf("InitPasswordValidator failed: %v", err)
+	}
+	t.Cleanup(func() { globalPasswordValidator = nil })
+
+	if name := globalPasswordValidator.GetName(); name != "restrict+strength+blocklist" {
+		t.Errorf("Unexpected policy name %s", name)
+	}
+	codes := violationCodes(ValidatePasswordFor("Summer2024", PasswordSubject{Login: "carol"}))
+	expected := []string{ViolationMissingSpecial, ViolationTooWeak, ViolationTooCommon}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Errorf("Expected %v, got %v", expected, codes)
+	}
+	if codes := violationCodes(ValidatePasswordFor("Carol#Tulip77garden", PasswordSubject{Login: "carol"})); !reflect.DeepEqual(codes, []string{ViolationContainsLogin}) {
+		t.Errorf("Expected only the login violation, got %v", codes)
+	}
+	if err := ValidatePasswordFor("Tulip#77garden", PasswordSubject{Login: "carol"}); err != nil {
+		t.Errorf("Expected password to pass the policy, got %v", err)
+	}
+}
+
+func TestRegisterReturnsLocalizedViolations(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "custom", Custom: &CustomValidator{MinLength: 10, RequireDigit: true}}})
+	t.Cleanup(func() { globalPasswordValidator = nil })
+
+	_, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/register", HandleRegister(db))
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"login":"dave","password":"short"}`))
+	req.Header.Set("Accept-Language", "pl-PL,pl;q=0.9,en;q=0.8")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+
+	var resp struct {
+		Error      string              `json:"error"`
+		Message    string              `json:"message"`
+		Violations []PasswordViolation `json:"violations"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error != "password_policy" || len(resp.Violations) != 2 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if v := resp.Violations[0]; v.Code != ViolationTooShort || v.Params["min"] != 10.0 || v.Message != "hasło musi mieć co najmniej 10 znaków" {
+		t.Errorf("Unexpected violation %+v", v)
+	}
+	if resp.Violations[1].Code != ViolationMissingDigit || !strings.Contains(resp.Message, "cyfrę") {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestFeedbackMessagesCoverBothLanguages(t *testing.T) {
+	for code := range feedbackMessages["en"] {
+		if feedbackMessages["pl"][code] == "" {
+			t.Errorf("Missing Polish message for %q", code)
+		}
+	}
+	if len(feedbackMessages["pl"]) != len(feedbackMessages["en"]) {
+		t.Error("Expected the same feedback codes in both languages")
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Password strength estimation in the spirit of zxcvbn. The password is covered with
+// the cheapest sequence of patterns (common words, keyboard walks, repeats, sequences,
+// dates) and unmatched characters, and the score follows from the estimated number of
+// guesses an attacker needs.
+
+const (
+	defaultMinStrengthScore = 3
+	maxStrengthInput        = 100 // longer passwords are scored by their first 100 characters
+	bruteforceLog10         = 1   // 10 guesses per unmatched character
+	minMatchLog10           = 1.7 // 50 guesses for any pattern of two or more characters
+)
+
+// StrengthResult is the estimate for one password.
+type StrengthResult struct {
+	Score        int      `json:"score"` // 0 (too guessable) to 4 (very unguessable)
+	GuessesLog10 float64  `json:"guessesLog10"`
+	Warning      string   `json:"warning,omitempty"` // feedback code
+	Suggestions  []string `json:"suggestions"`       // feedback codes
+}
+
+// StrengthValidator - minimum estimated strength score
+type StrengthValidator struct {
+	MinScore int
+}
+
+func (v *StrengthValidator) minScore() int {
+	if v.MinScore <= 0 || v.MinScore > 4 {
+		return defaultMinStrengthScore
+	}
+	return v.MinScore
+}
+
+func (v *StrengthValidator) Validate(password string) error {
+	return v.ValidateFor(password, PasswordSubject{})
+}
+
+func (v *StrengthValidator) ValidateFor(password string, subject PasswordSubject) error {
+	var inputs []string
+	if subject.Login != "" {
+		inputs = append(inputs, subject.Login)
+	}
+	result := EstimateStrength(password, inputs...)
+	if result.Score < v.minScore() {
+		return policyError([]PasswordViolation{newViolation(ViolationTooWeak, map[string]any{
+			"score":       result.Score,
+			"minScore":    v.minScore(),
+			"warning":     result.Warning,
+			"suggestions": result.Suggestions,
+		})})
+	}
+	return nil
+}
+
+func (v *StrengthValidator) GetName() string {
+	return "strength"
+}
+
+// commonWords are ranked by popularity in leaked password lists.
+var commonWords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+	"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+	"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+	"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars", "klaster",
+	"112233", "george", "computer", "michelle", "jessica", "pepper", "zxcvbn", "555555",
+	"131313", "freedom", "777777", "pass", "maggie", "159753", "aaaaaa", "ginger",
+	"princess", "joshua", "cheese", "amanda", "summer", "love", "ashley", "nicole",
+	"chelsea", "biteme", "matthew", "access", "yankees", "987654321", "dallas", "austin",
+	"thunder", "taylor", "matrix", "admin", "welcome", "login", "secret", "hello",
+	"whatever", "photo", "photos", "picture", "camera", "manager", "photomanager", "winter",
+	"spring", "autumn", "flower", "guest", "user", "root", "test", "google", "internet",
+	"polska", "haslo", "kochanie", "zaq12wsx", "qwerty123", "marcin", "agnieszka", "lato",
+	"zima", "wiosna", "jesien", "slonce", "misiek", "kasia", "monika", "bartek",
+}
+
+var commonWordRanks = func() map[string]int {
+	ranks := map[string]int{}
+	for i, w := range commonWords {
+		ranks[w] = i + 1
+	}
+	return ranks
+}()
+
+var l33tTable = map[rune]rune{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'}
+
+type strengthMatch struct {
+	start, end int // rune positions, end exclusive
+	pattern    string
+	log10      float64
+	// details used for feedback
+	rank      int
+	userInput bool
+	l33t      bool
+	turns     int
+	blockLen  int
+	yearOnly  bool
+}
+
+// EstimateStrength scores the password. userInputs, such as the login, count as the
+// most guessable words.
+func EstimateStrength(password string, userInputs ...string) StrengthResult {
+	runes := []rune(password)
+	if len(runes) > maxStrengthInput {
+		runes = runes[:maxStrengthInput]
+	}
+
+	matches := findStrengthMatches(runes, userInputs)
+	guesses, sequence := cheapestCover(runes, matches)
+
+	result := StrengthResult{GuessesLog10: math.Round(guesses*100) / 100, Suggestions: []string{}}
+	switch {
+	case guesses < 3:
+		result.Score = 0
+	case guesses < 6:
+		result.Score = 1
+	case guesses < 8:
+		result.Score = 2
+	case guesses < 10:
+		result.Score = 3
+	default:
+		result.Score = 4
+	}
+	result.Warning, result.Suggestions = strengthFeedback(runes, result.Score, sequence)
+	return result
+}
+
+func findStrengthMatches(runes []rune, userInputs []string) []strengthMatch {
+	var matches []strengthMatch
+	matches = append(matches, dictionaryMatches(runes, userInputs)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, userInputs)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, dateMatches(runes)...)
+	return matches
+}
+
+// cheapestCover finds the sequence of matches and unmatched characters with the fewest
+// guesses. The order of the parts is unknown to the attacker, hence the factorial.
+func cheapestCover(runes []rune, matches []strengthMatch) (float64, []strengthMatch) {
+	n := len(runes)
+	if n == 0 {
+		return 0, nil
+	}
+	best := make([]float64, n+1)
+	parts := make([]int, n+1)
+	prev := make([]*strengthMatch, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = math.Inf(1)
+	}
+
+	for j := 1; j <= n; j++ {
+		// Unmatched character, merged with unmatched characters before it
+		if cost := best[j-1] + bruteforceLog10; cost < best[j] {
+			best[j], prev[j] = cost, nil
+			parts[j] = parts[j-1]
+			if j == 1 || prev[j-1] != nil {
+				parts[j]++
+			}
+		}
+		for k := range matches {
+			m := &matches[k]
+			if m.end != j {
+				continue
+			}
+			if cost := best[m.start] + m.log10; cost < best[j] {
+				best[j], prev[j] = cost, m
+				parts[j] = parts[m.start] + 1
+			}
+		}
+	}
+
+	var sequence []strengthMatch
+	for j := n; j > 0; {
+		if m := prev[j]; m != nil {
+			sequence = append([]strengthMatch{*m}, sequence...)
+			j = m.start
+		} else {
+			j--
+		}
+	}
+
+	factorial := 0.0
+	for i := 2; i <= parts[n]; i++ {
+		factorial += math.Log10(float64(i))
+	}
+	return best[n] + factorial, sequence
+}
+
+func matchLog10(guesses float64) float64 {
+	return math.Max(math.Log10(guesses), minMatchLog10)
+}
+
+func unl33t(runes []rune) ([]rune, bool) {
+	out := make([]rune, len(runes))
+	changed := false
+	for i, r := range runes {
+		if sub, ok := l33tTable[r]; ok {
+			out[i], changed = sub, true
+		} else {
+			out[i] = r
+		}
+	}
+	return out, changed
+}
+
+// uppercaseVariations counts the capitalizations an attacker would try for a word.
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+	variations := 0.0
+	for i := 1; i <= upper && i <= lower; i++ {
+		variations += binomial(upper+lower, i)
+	}
+	return variations
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func dictionaryMatches(runes []rune, userInputs []string) []strengthMatch {
+	ranks := map[string]int{}
+	for w, r := range commonWordRanks {
+		ranks[w] = r
+	}
+	inputs := map[string]bool{}
+	for i, input := range userInputs {
+		input = strings.ToLower(input)
+		if len([]rune(input)) >= minLoginCheckLength {
+			ranks[input] = i + 1
+			inputs[input] = true
+		}
+	}
+
+	lower := []rune(strings.ToLower(string(runes)))
+	plain, _ := unl33t(lower)
+	var matches []strengthMatch
+	for i := 0; i < len(lower); i++ {
+		for j := i + 3; j <= len(lower); j++ {
+			word := string(lower[i:j])
+			l33t := false
+			rank, found := ranks[word]
+			if !found {
+				word = string(plain[i:j])
+				rank, found = ranks[word]
+				l33t = found
+			}
+			if !found {
+				continue
+			}
+			guesses := float64(rank) * uppercaseVariations(runes[i:j])
+			if l33t {
+				guesses *= 2
+			}
+			matches = append(matches, strengthMatch{
+				start: i, end: j, pattern: "dictionary", log10: matchLog10(guesses),
+				rank: rank, userInput: inputs[word], l33t: l33t,
+			})
+		}
+	}
+	return matches
+}
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+type keyPosition struct{ row, col int }
+
+var keyboardLayout = func() map[rune]keyPosition {
+	layout := map[rune]keyPosition{}
+	for r, row := range keyboardRows {
+		for c, key := range row {
+			layout[key] = keyPosition{r, c}
+		}
+	}
+	return layout
+}()
+
+// keyDirection returns the step between adjacent keys of the staggered layout, each
+// row being shifted half a key right of the row above.
+func keyDirection(a, b rune) (keyPosition, bool) {
+	pa, okA := keyboardLayout[unicode.ToLower(a)]
+	pb, okB := keyboardLayout[unicode.ToLower(b)]
+	if !okA || !okB {
+		return keyPosition{}, false
+	}
+	d := keyPosition{pb.row - pa.row, pb.col - pa.col}
+	switch d {
+	case keyPosition{0, -1}, keyPosition{0, 1}, keyPosition{-1, 0}, keyPosition{-1, 1}, keyPosition{1, -1}, keyPosition{1, 0}:
+		return d, true
+	}
+	return keyPosition{}, false
+}
+
+func keyboardMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes)-2; {
+		j, turns := i+1, 0
+		var last keyPosition
+		for ; j < len(runes); j++ {
+			d, ok := keyDirection(runes[j-1], runes[j])
+			if !ok {
+				break
+			}
+			if j == i+1 || d != last {
+				turns++
+			}
+			last = d
+		}
+		if j-i >= 3 {
+			// starting keys * direction choices per turn * length
+			guesses := float64(len(keyboardLayout)) * math.Pow(4, float64(turns)) * float64(j-i)
+			matches = append(matches, strengthMatch{start: i, end: j, pattern: "keyboard", log10: matchLog10(guesses), turns: turns})
+			i = j - 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+func repeatMatches(runes []rune, userInputs []string) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes); i++ {
+		bestEnd, bestBlock := 0, 0
+		for block := 1; i+2*block <= len(runes); block++ {
+			end := i + block
+			for end+block <= len(runes) && string(runes[end:end+block]) == string(runes[i:i+block]) {
+				end += block
+			}
+			if end-i > bestEnd-i && end-i >= 3 && end > i+block {
+				bestEnd, bestBlock = end, block
+			}
+		}
+		if bestBlock == 0 {
+			continue
+		}
+		blockGuesses := EstimateStrength(string(runes[i:i+bestBlock]), userInputs...).GuessesLog10
+		count := float64((bestEnd - i) / bestBlock)
+		matches = append(matches, strengthMatch{
+			start: i, end: bestEnd, pattern: "repeat",
+			log10: math.Max(blockGuesses+math.Log10(count), minMatchLog10), blockLen: bestBlock,
+		})
+	}
+	return matches
+}
+
+func sequenceClass(r rune) int {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return 1
+	case r >= 'A' && r <= 'Z':
+		return 2
+	case r >= '0' && r <= '9':
+		return 3
+	}
+	return 0
+}
+
+func sequenceMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes)-2; {
+		class := sequenceClass(runes[i])
+		delta := runes[i+1] - runes[i]
+		if class == 0 || sequenceClass(runes[i+1]) != class || (delta != 1 && delta != -1) {
+			i++
+			continue
+		}
+		j := i + 2
+		for j < len(runes) && sequenceClass(runes[j]) == class && runes[j]-runes[j-1] == delta {
+			j++
+		}
+		if j-i < 3 {
+			i++
+			continue
+		}
+
+		start := 26.0
+		if class == 3 {
+			start = 10
+		}
+		if strings.ContainsRune("aAzZ019", runes[i]) {
+			start = 4
+		}
+		if delta < 0 {
+			start *= 2
+		}
+		matches = append(matches, strengthMatch{start: i, end: j, pattern: "sequence", log10: matchLog10(start * float64(j-i))})
+		i = j - 1
+	}
+	return matches
+}
+
+// yearSpace is the number of years an attacker tries around the current one.
+func yearSpace(year int) float64 {
+	return math.Max(math.Abs(float64(year-time.Now().Year())), 20)
+}
+
+func normalizeYear(y int, digits int) int {
+	if digits != 2 {
+		return y
+	}
+	if y > 50 {
+		return 1900 + y
+	}
+	return 2000 + y
+}
+
+func validDate(d, m, y int) bool {
+	return d >= 1 && d <= 31 && m >= 1 && m <= 12 && y >= 1900 && y <= 2099
+}
+
+// parseDate recognizes day, month and year in any common order, with or without a separator.
+func parseDate(s string) (year int, ok bool) {
+	if sep := strings.IndexAny(s, " ./_-"); sep >= 0 {
+		parts := strings.Split(s, string(s[sep]))
+		if len(parts) != 3 {
+			return 0, false
+		}
+		n := make([]int, 3)
+		for i, p := range parts {
+			v, err := strconv.Atoi(p)
+			if err != nil || len(p) == 0 || len(p) > 4 {
+				return 0, false
+			}
+			n[i] = v
+		}
+		orders := [][3]int{{0, 1, 2}, {1, 0, 2}, {2, 1, 0}} // d-m-y, m-d-y, y-m-d
+		for _, o := range orders {
+			y := normalizeYear(n[o[2]], len(parts[o[2]]))
+			if validDate(n[o[0]], n[o[1]], y) {
+				return y, true
+			}
+		}
+		return 0, false
+	}
+
+	splits := map[int][][3]int{ // lengths of day, month, year; a negative year is first
+		6: {{2, 2, 2}, {-2, 2, 2}},
+		8: {{2, 2, 4}, {-4, 2, 2}},
+	}
+	for _, split := range splits[len(s)] {
+		var d, m, y, digits int
+		if split[0] < 0 {
+			digits = -split[0]
+			y, _ = strconv.Atoi(s[:digits])
+			m, _ = strconv.Atoi(s[digits : digits+2])
+			d, _ = strconv.Atoi(s[digits+2:])
+		} else {
+			digits = split[2]
+			d, _ = strconv.Atoi(s[:2])
+			m, _ = strconv.Atoi(s[2:4])
+			y, _ = strconv.Atoi(s[4:])
+		}
+		y = normalizeYear(y, digits)
+		if validDate(d, m, y) || validDate(m, d, y) {
+			return y, true
+		}
+	}
+	return 0, false
+}
+
+func dateMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := range runes {
+		for j := i + 4; j <= len(runes) && j-i <= 10; j++ {
+			s := string(runes[i:j])
+			if strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && !strings.ContainsRune(" ./_-", r) }) >= 0 {
+				break
+			}
+			if j-i == 4 {
+				if y, err := strconv.Atoi(s); err == nil && y >= 1900 && y <= 2099 {
+					matches = append(matches, strengthMatch{start: i, end: j, pattern: "date", log10: matchLog10(yearSpace(y)), yearOnly: true})
+				}
+				continue
+			}
+			if y, ok := parseDate(s); ok {
+				guesses := 365 * yearSpace(y)
+				if strings.ContainsAny(s, " ./_-") {
+					guesses *= 4
+				}
+				matches = append(matches, strengthMatch{start: i, end: j, pattern: "date", log10: matchLog10(guesses)})
+			}
+		}
+	}
+	return matches
+}
+
+// strengthFeedback explains the longest pattern found in a weak password with feedback
+// codes, which are translated by localizeFeedback.
+func strengthFeedback(runes []rune, score int, sequence []strengthMatch) (string, []string) {
+	if len(runes) == 0 {
+		return "", []string{SuggestionUseWords, SuggestionNoSymbolsNeeded}
+	}
+	if score > 2 {
+		return "", []string{}
+	}
+
+	suggestions := []string{SuggestionAddWord}
+	var longest *strengthMatch
+	for i := range sequence {
+		if longest == nil || sequence[i].end-sequence[i].start > longest.end-longest.start {
+			longest = &sequence[i]
+		}
+	}
+	if longest == nil {
+		return "", suggestions
+	}
+
+	warning := ""
+	switch longest.pattern {
+	case "dictionary":
+		word := runes[longest.start:longest.end]
+		switch {
+		case longest.userInput:
+			warning = WarningLoginUsed
+		case longest.start == 0 && longest.end == len(runes) && longest.rank <= 10:
+			warning = WarningTop10Password
+		case longest.start == 0 && longest.end == len(runes):
+			warning = WarningCommonPassword
+		default:
+			warning = WarningSingleWord
+		}
+		if unicode.IsUpper(word[0]) {
+			suggestions = append(suggestions, SuggestionCapitalization)
+		} else if strings.ToUpper(string(word)) == string(word) {
+			suggestions = append(suggestions, SuggestionAllUppercase)
+		}
+		if longest.l33t {
+			suggestions = append(suggestions, SuggestionSubstitutions)
+		}
+	case "keyboard":
+		warning = WarningKeyboardPattern
+		if longest.turns == 1 {
+			warning = WarningStraightRow
+		}
+		suggestions = append(suggestions, SuggestionLongerKeyboard)
+	case "repeat":
+		warning = WarningRepeatedPattern
+		if longest.blockLen == 1 {
+			warning = WarningRepeatedChars
+		}
+		suggestions = append(suggestions, SuggestionAvoidRepeats)
+	case "sequence":
+		warning = WarningSequence
+		suggestions = append(suggestions, SuggestionAvoidSequences)
+	case "date":
+		if longest.yearOnly {
+			warning = WarningRecentYear
+			suggestions = append(suggestions, SuggestionAvoidRecentYears, SuggestionAvoidPersonalYears)
+		} else {
+			warning = WarningDate
+			suggestions = append(suggestions, SuggestionAvoidPersonalDates)
+		}
+	}
+	return warning, suggestions
+}
+
+// HandlePasswordStrength scores a password for live feedback while the user types it.
+func HandlePasswordStrength() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req PasswordStrengthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		var inputs []string
+		if req.Login != "" {
+			inputs = append(inputs, req.Login)
+		}
+		result := EstimateStrength(req.Password, inputs...)
+		lang := preferredLanguage(r)
+		suggestionMessages := make([]string, len(result.Suggestions))
+		for i, code := range result.Suggestions {
+			suggestionMessages[i] = localizeFeedback(lang, code)
+		}
+		resp := map[string]any{
+			"score":              result.Score,
+			"guessesLog10":       result.GuessesLog10,
+			"warning":            result.Warning,
+			"suggestions":        result.Suggestions,
+			"suggestionMessages": suggestionMessages,
+			"acceptable":         true,
+		}
+		if result.Warning != "" {
+			resp["warningMessage"] = localizeFeedback(lang, result.Warning)
+		}
+		if err := ValidatePasswordFor(req.Password, PasswordSubject{Login: req.Login}); err != nil {
+			resp["acceptable"] = false
+			resp["message"] = err.Error()
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) {
+				violations := localizedViolations(r, policyErr.Violations)
+				resp["message"] = (&PolicyError{Violations: violations}).Error()
+				resp["violations"] = violations
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
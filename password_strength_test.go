@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEstimateStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		score    int
+		warning  string
+	}{
+		{"password", 0, WarningTop10Password},
+		{"p@ssw0rd", 0, WarningTop10Password},
+		{"qwertyuiop", 0, WarningCommonPassword},
+		{"wsxcde", 1, WarningKeyboardPattern},
+		{"aaaaaaa", 0, WarningRepeatedChars},
+		{"abcabcabc", 0, WarningRepeatedPattern},
+		{"987654", 0, WarningSequence},
+		{"1990", 0, WarningRecentYear},
+		{"12.05.1990", 1, WarningDate},
+		{"alice1990", 1, WarningLoginUsed},
+		{"xK9#mQ2v", 3, ""},
+		{"correcthorsebatterystaple", 4, ""},
+	}
+	for _, c := range cases {
+		r := EstimateStrength(c.password, "alice")
+		if r.Score != c.score {
+			t.Errorf("%q: expected score %d, got %d (%.2f)", c.password, c.score, r.Score, r.GuessesLog10)
+		}
+		if r.Warning != c.warning {
+			t.Errorf("%q: expected warning %q, got %q", c.password, c.warning, r.Warning)
+		}
+		if r.Score <= 2 && len(r.Suggestions) == 0 {
+			t.Errorf("%q: expected suggestions for a weak password", c.password)
+		}
+	}
+
+	if r := EstimateStrength("P@ssw0rd"); len(r.Suggestions) != 3 || r.Suggestions[1] != SuggestionCapitalization || r.Suggestions[2] != SuggestionSubstitutions {
+		t.Errorf("Expected capitalization and substitution suggestions, got %v", r.Suggestions)
+	}
+	if a, b := EstimateStrength("alice1990"), EstimateStrength("alice1990", "alice"); a.GuessesLog10 <= b.GuessesLog10 {
+		t.Errorf("Expected the login to make the password weaker, got %.2f and %.2f", a.GuessesLog10, b.GuessesLog10)
+	}
+	EstimateStrength(strings.Repeat("ab1", 200)) // long input stays bounded
+}
+
+func TestRegisterReturnsStrengthFeedback(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "strength", MinScore: 3}})
+	t.Cleanup(func() { globalPasswordValidator = nil })
+
+	_, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/register", HandleRegister(db))
+	mux.HandleFunc("/api/password-strength", HandlePasswordStrength())
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"login":"carol","password":"carol2024"}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var feedback struct {
+		Error      string              `json:"error"`
+		Violations []PasswordViolation `json:"violations"`
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected weak password to be rejected, got %d", rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&feedback); err != nil {
+		t.Fatalf("Expected JSON feedback: %v", err)
+	}
+	if feedback.Error != "password_policy" || len(feedback.Violations) != 1 || feedback.Violations[0].Code != ViolationTooWeak {
+		t.Fatalf("Unexpected feedback %+v", feedback)
+	}
+	params := feedback.Violations[0].Params
+	if params["minScore"] != 3.0 || params["score"].(float64) >= 3 || params["warning"] == "" || len(params["suggestions"].([]any)) == 0 {
+		t.Errorf("Unexpected strength feedback %v", params)
+	}
+
+	if code := (cookieJar{}).do(mux, "POST", "/api/register", `{"login":"carol","password":"tulip77garden"}`); code != http.StatusOK {
+		t.Errorf("Expected strong password to be accepted, got %d", code)
+	}
+
+	var strength map[string]any
+	if code := (cookieJar{}).postJSON(mux, "/api/password-strength", `{"password":"Carol!1990","login":"carol"}`, &strength); code != http.StatusOK {
+		t.Fatalf("Strength check failed with %d", code)
+	}
+	if strength["acceptable"] != false || strength["warning"] == "" {
+		t.Errorf("Unexpected strength response %v", strength)
+	}
+
+	// Feedback is sent as codes with messages in the language of the request
+	req = httptest.NewRequest("POST", "/api/password-strength", strings.NewReader(`{"password":"1990"}`))
+	req.Header.Set("Accept-Language", "pl-PL,pl;q=0.9")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	strength = nil
+	json.NewDecoder(rec.Body).Decode(&strength)
+	if strength["warning"] != WarningRecentYear || strength["warningMessage"] != feedbackMessages["pl"][WarningRecentYear] {
+		t.Errorf("Expected Polish feedback for the warning code, got %v", strength)
+	}
+	if messages, _ := strength["suggestionMessages"].([]any); len(messages) == 0 || messages[0] != feedbackMessages["pl"][SuggestionAddWord] {
+		t.Errorf("Expected Polish suggestions, got %v", strength["suggestionMessages"])
+	}
+	if code := (cookieJar{}).postJSON(mux, "/api/password-strength", `{"password":"tulip77garden"}`, &strength); code != http.StatusOK || strength["acceptable"] != true {
+		t.Errorf("Expected strong password to be acceptable, got %d %v", code, strength)
+	}
+}
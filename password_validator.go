@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"regexp"
-	"strings"
 	"unicode"
 )
 
@@ -28,7 +27,7 @@ type EasyValidator struct{}
 
 func (v *EasyValidator) Validate(password string) error {
 	if len(password) < 3 {
-		return fmt.Errorf("password must be at least 3 characters long")
+		return policyError([]PasswordViolation{newViolation(ViolationTooShort, map[string]any{"min": 3})})
 	}
 	return nil
 }
@@ -41,8 +40,9 @@ func (v *EasyValidator) GetName() string {
 type MediumValidator struct{}
 
 func (v *MediumValidator) Validate(password string) error {
+	var violations []PasswordViolation
 	if len(password) < 6 {
-		return fmt.Errorf("password must be at least 6 characters long")
+		violations = append(violations, newViolation(ViolationTooShort, map[string]any{"min": 6}))
 	}
 
 	hasLetter := false
@@ -58,14 +58,14 @@ func (v *MediumValidator) Validate(password string) error {
 	}
 
 	if !hasLetter {
-		return fmt.Errorf("password must contain at least one letter")
+		violations = append(violations, newViolation(ViolationMissingLetter, nil))
 	}
 
 	if !hasDigit {
-		return fmt.Errorf("password must contain at least one digit")
+		violations = append(violations, newViolation(ViolationMissingDigit, nil))
 	}
 
-	return nil
+	return policyError(violations)
 }
 
 func (v *MediumValidator) GetName() string {
@@ -76,8 +76,9 @@ func (v *MediumValidator) GetName() string {
 type RestrictValidator struct{}
 
 func (v *RestrictValidator) Validate(password string) error {
+	var violations []PasswordViolation
 	if len(password) < 8 {
-		return fmt.Errorf("password must be at least 8 characters long")
+		violations = append(violations, newViolation(ViolationTooShort, map[string]any{"min": 8}))
 	}
 
 	hasUpper := false
@@ -100,26 +101,20 @@ func (v *RestrictValidator) Validate(password string) error {
 		}
 	}
 
-	var errors []string
-
 	if !hasUpper {
-		errors = append(errors, "at least one uppercase letter")
+		violations = append(violations, newViolation(ViolationMissingUppercase, nil))
 	}
 	if !hasLower {
-		errors = append(errors, "at least one lowercase letter")
+		violations = append(violations, newViolation(ViolationMissingLowercase, nil))
 	}
 	if !hasDigit {
-		errors = append(errors, "at least one digit")
+		violations = append(violations, newViolation(ViolationMissingDigit, nil))
 	}
 	if !hasSpecial {
-		errors = append(errors, "at least one special character")
-	}
-
-	if len(errors) > 0 {
-		return fmt.Errorf("password must contain: %s", strings.Join(errors, ", "))
+		violations = append(violations, newViolation(ViolationMissingSpecial, nil))
 	}
 
-	return nil
+	return policyError(violations)
 }
 
 func (v *RestrictValidator) GetName() string {
@@ -138,16 +133,16 @@ type CustomValidator struct {
 }
 
 func (v *CustomValidator) Validate(password string) error {
+	var violations []PasswordViolation
+
 	if v.MinLength > 0 && len(password) < v.MinLength {
-		return fmt.Errorf("password must be at least %d characters long", v.MinLength)
+		violations = append(violations, newViolation(ViolationTooShort, map[string]any{"min": v.MinLength}))
 	}
 
 	if v.MaxLength > 0 && len(password) > v.MaxLength {
-		return fmt.Errorf("password must be at most %d characters long", v.MaxLength)
+		violations = append(violations, newViolation(ViolationTooLong, map[string]any{"max": v.MaxLength}))
 	}
 
-	var errors []string
-
 	if v.RequireUpper {
 		hasUpper := false
 		for _, char := range password {
@@ -157,7 +152,7 @@ func (v *CustomValidator) Validate(password string) error {
 			}
 		}
 		if !hasUpper {
-			errors = append(errors, "at least one uppercase letter")
+			violations = append(violations, newViolation(ViolationMissingUppercase, nil))
 		}
 	}
 
@@ -170,7 +165,7 @@ func (v *CustomValidator) Validate(password string) error {
 			}
 		}
 		if !hasLower {
-			errors = append(errors, "at least one lowercase letter")
+			violations = append(violations, newViolation(ViolationMissingLowercase, nil))
 		}
 	}
 
@@ -183,7 +178,7 @@ func (v *CustomValidator) Validate(password string) error {
 			}
 		}
 		if !hasDigit {
-			errors = append(errors, "at least one digit")
+			violations = append(violations, newViolation(ViolationMissingDigit, nil))
 		}
 	}
 
@@ -196,7 +191,7 @@ func (v *CustomValidator) Validate(password string) error {
 			}
 		}
 		if !hasSpecial {
-			errors = append(errors, "at least one special character")
+			violations = append(violations, newViolation(ViolationMissingSpecial, nil))
 		}
 	}
 
@@ -209,15 +204,11 @@ func (v *CustomValidator) Validate(password string) error {
 			}
 		}
 		if !v.regexCompiled.MatchString(password) {
-			errors = append(errors, fmt.Sprintf("password must match pattern: %s", v.Regex))
+			violations = append(violations, newViolation(ViolationPatternMismatch, map[string]any{"pattern": v.Regex}))
 		}
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("password must contain: %s", strings.Join(errors, ", "))
-	}
-
-	return nil
+	return policyError(violations)
 }
 
 func (v *CustomValidator) GetName() string {
@@ -229,7 +220,18 @@ func GetPasswordValidator(cfg *Config) PasswordValidator {
 		return &NoValidationValidator{}
 	}
 
-	switch cfg.Password.Mode {
+	if len(cfg.Password.Policy) > 0 {
+		policy := &PasswordPolicy{}
+		for _, mode := range cfg.Password.Policy {
+			policy.Validators = append(policy.Validators, validatorForMode(cfg.Password, mode))
+		}
+		return policy
+	}
+	return validatorForMode(cfg.Password, cfg.Password.Mode)
+}
+
+func validatorForMode(cfg *PasswordConfig, mode string) PasswordValidator {
+	switch mode {
 	case "no-validation":
 		return &NoValidationValidator{}
 	case "easy":
@@ -239,10 +241,12 @@ func GetPasswordValidator(cfg *Config) PasswordValidator {
 	case "restrict":
 		return &RestrictValidator{}
 	case "custom":
-		if cfg.Password.Custom != nil {
-			return cfg.Password.Custom
+		if cfg.Custom != nil {
+			return cfg.Custom
 		}
 		return &NoValidationValidator{}
+	case "strength":
+		return &StrengthValidator{MinScore: cfg.MinScore}
 	default:
 		return &NoValidationValidator{}
 	}
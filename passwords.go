@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"time"
+)
+
+// Password change by the user, password reset by an admin and self-service reset with
+// single-use tokens sent by the Notifier.
+
+const (
+	defaultResetTokenMinutes = 60
+	defaultResetLimit        = 3
+	resetLimitWindow         = time.Hour
+)
+
+var (
+	ErrInvalidEmail      = errors.New("invalid email address")
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+)
+
+func (m MailConfig) ResetTokenTTL() time.Duration {
+	if m.ResetTokenMinutes <= 0 {
+		return defaultResetTokenMinutes * time.Minute
+	}
+	return time.Duration(m.ResetTokenMinutes) * time.Minute
+}
+
+func (m MailConfig) resetLimit() int {
+	if m.ResetLimit <= 0 {
+		return defaultResetLimit
+	}
+	return m.ResetLimit
+}
+
+// validateEmail accepts a bare address, without a display name.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// SetUserPassword stores a new password of the user. mustChange forces the user to
+// change it on the next login.
+func SetUserPassword(db *sql.DB, userID int64, password string, mustChange bool) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := storePassword(tx, userID, hash, mustChange); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeOtherSessions logs the user out everywhere except the given session.
+func RevokeOtherSessions(db *sql.DB, userID int64, sessionID string) error {
+	_, err := db.Exec(`UPDATE sessions SET revoked = 1 WHERE userID = ? AND ID != ?`, userID, sessionID)
+	return err
+}
+
+// CreatePasswordReset issues a reset token for the user. Earlier tokens stop working.
+func CreatePasswordReset(cfg *Config, db *sql.DB, userID int64) (string, time.Time, error) {
+	if _, err := db.Exec(`DELETE FROM password_resets WHERE userID = ?`, userID); err != nil {
+		return "", time.Time{}, err
+	}
+	token := randomToken(32)
+	expires := time.Now().UTC().Add(cfg.Mail.ResetTokenTTL())
+	_, err := db.Exec(`INSERT INTO password_resets (tokenHash, userID, expiresAt, used) VALUES (?, ?, ?, 0)`,
+		hashToken(token), userID, expires.Format(sessionTimeLayout))
+	return token, expires, err
+}
+
+// PasswordResetUserID returns the user a valid reset token was issued for.
+func PasswordResetUserID(db *sql.DB, token string) (int64, error) {
+	var userID int64
+	err := db.QueryRow(`SELECT userID FROM password_resets WHERE tokenHash = ? AND used = 0 AND expiresAt > ?`,
+		hashToken(token), time.Now().UTC().Format(sessionTimeLayout)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, err
+}
+
+// ResetPassword sets a new password with a reset token. The token is used up and all
+// sessions of the user are revoked.
+func ResetPassword(db *sql.DB, token, password string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	now := time.Now().UTC().Format(sessionTimeLayout)
+	err = tx.QueryRow(`SELECT userID FROM password_resets WHERE tokenHash = ? AND used = 0 AND expiresAt > ?`,
+		hashToken(token), now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE password_resets SET used = 1 WHERE userID = ?`, userID); err != nil {
+		return err
+	}
+	if err := storePassword(tx, userID, hash, false); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked = 1 WHERE userID = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HandleChangePassword changes the password of the logged in user after checking the
+// old one. Other sessions of the user are logged out. Wrong old passwords are throttled
+// like failed logins.
+func HandleChangePassword(db *sql.DB, limiter *LoginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		principal := PrincipalFrom(r.Context())
+		attempt, wait, err := limiter.ReservePasswordCheck(principal.ID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyRequests(w, wait, "Too many password attempts, try again later")
+			return
+		}
+		dbU, found := FindUser(db, &User{Login: principal.Login})
+		if !found || !LoginUser(dbU.Password, req.OldPassword) {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+		attempt.Succeed()
+
+		if req.NewPassword == req.OldPassword {
+			http.Error(w, "New password must differ from the old one", http.StatusBadRequest)
+			return
+		}
+		subject, err := LoadPasswordSubject(db, principal.ID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := ValidatePasswordFor(req.NewPassword, subject); err != nil {
+			writePasswordError(w, r, err)
+			return
+		}
+
+		if err := SetUserPassword(db, principal.ID, req.NewPassword, false); err != nil {
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+		if err := RevokeOtherSessions(db, principal.ID, principal.SessionID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password changed"})
+	}
+}
+
+// HandleAdminResetPassword sets a temporary password the user has to change on the
+// next login. The user is logged out everywhere.
+func HandleAdminResetPassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req AdminResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Like bans, only users who manage roles may reset the password of someone who does
+		var userID int64
+		var role string
+		if err := db.QueryRow("SELECT ID, role FROM users WHERE login = ?", req.Login).Scan(&userID, &role); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		targetPerms, err := RolePermissions(db, role)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if targetPerms[PermManageRoles] && !PrincipalFrom(r.Context()).Can(PermManageRoles) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		subject, err := LoadPasswordSubject(db, userID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := ValidatePasswordFor(req.Password, subject); err != nil {
+			writePasswordError(w, r, err)
+			return
+		}
+		if err := SetUserPassword(db, userID, req.Password, true); err != nil {
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+		if err := RevokeUserSessions(db, userID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"login":   req.Login,
+			"message": "Password reset, the user has to change it on next login",
+		})
+	}
+}
+
+// HandleRequestPasswordReset sends a reset token to the email address of the user. The
+// response is the same whether the account exists or not, and it does not wait for the
+// email to be sent.
+func HandleRequestPasswordReset(cfg *Config, db *sql.DB, notifier Notifier, limiter *LoginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if notifier == nil {
+			http.Error(w, "Password reset is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req PasswordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Counted for unknown logins too, so the limit does not tell which accounts exist
+		wait, err := limiter.AllowPasswordReset(clientIP(r), req.Login, cfg.Mail)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyRequests(w, wait, "Too many password reset requests, try again later")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If the account has an email address, a reset link has been sent",
+		})
+
+		// The account is looked up and the email sent after the response, so the response
+		// time does not tell which accounts exist either
+		go sendPasswordReset(cfg, db, notifier, req.Login)
+	}
+}
+
+// sendPasswordReset issues a reset token for the login and sends it to the email address
+// of the user. Unknown and banned logins and users without an address are skipped.
+func sendPasswordReset(cfg *Config, db *sql.DB, notifier Notifier, login string) {
+	var userID int64
+	var email sql.NullString
+	err := db.QueryRow(`SELECT ID, email FROM users WHERE login = ? AND isBanned = 0`, login).Scan(&userID, &email)
+	if err == sql.ErrNoRows || err == nil && email.String == "" {
+		return
+	}
+	if err == nil {
+		var token string
+		var expires time.Time
+		token, expires, err = CreatePasswordReset(cfg, db, userID)
+		if err == nil {
+			err = notifier.SendPasswordReset(email.String, login, token, expires)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Password reset for %s failed: %v\n", login, err)
+	}
+}
+
+// HandleConfirmPasswordReset sets the new password with a token from the reset email.
+func HandleConfirmPasswordReset(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req PasswordResetConfirmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		userID, err := PasswordResetUserID(db, req.Token)
+		if err == ErrInvalidResetToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		subject, err := LoadPasswordSubject(db, userID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := ValidatePasswordFor(req.NewPassword, subject); err != nil {
+			writePasswordError(w, r, err)
+			return
+		}
+
+		switch err := ResetPassword(db, req.Token, req.NewPassword); err {
+		case nil:
+		case ErrInvalidResetToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password changed"})
+	}
+}
+
+// HandleChangeEmail sets the email address used for password reset.
+func HandleChangeEmail(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ChangeEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Email != "" {
+			if err := validateEmail(req.Email); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if _, err := db.Exec(`UPDATE users SET email = ?, emailVerified = 0 WHERE ID = ?`, nullString(req.Email), PrincipalFrom(r.Context()).ID); err != nil {
+			http.Error(w, "Failed to update email", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"email": req.Email, "message": "Email updated"})
+	}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type resetMessage struct {
+	to, login, token string
+}
+
+// recordingNotifier collects the messages the reset handler sends in the background.
+type recordingNotifier struct {
+	sent chan resetMessage
+}
+
+func newRecordingNotifier() *recordingNotifier {
+	return &recordingNotifier{sent: make(chan resetMessage, 16)}
+}
+
+func (n *recordingNotifier) SendPasswordReset(to, login, token string, expires time.Time) error {
+	n.sent <- resetMessage{to: to, login: login, token: token}
+	return nil
+}
+
+// next waits for the next message sent by the handler.
+func (n *recordingNotifier) next(t *testing.T) resetMessage {
+	t.Helper()
+	select {
+	case m := <-n.sent:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a reset message")
+		return resetMessage{}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "easy"}})
+	cfg, db, mux := testSessionServer(t)
+	clock := &fakeClock{now: time.Now()}
+	mux.HandleFunc("/api/change-password", AuthMiddlewarePasswordChange(cfg, db, HandleChangePassword(db, NewLoginLimiter(db, cfg.Login, clock))))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	laptop, phone := cookieJar{}, cookieJar{}
+	laptop.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+	phone.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+
+	if code := laptop.do(mux, "POST", "/api/change-password", `{"oldPassword":"wrong","newPassword":"newpass"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong old password to be rejected, got %d", code)
+	}
+	clock.Advance(time.Minute)
+	if code := laptop.do(mux, "POST", "/api/change-password", `{"oldPassword":"pass","newPassword":"newpass"}`); code != http.StatusOK {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	if code := laptop.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected current session to stay logged in, got %d", code)
+	}
+	if code := phone.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected other sessions to be logged out, got %d", code)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"newpass"}`); code != http.StatusOK {
+		t.Errorf("Expected login with the new password, got %d", code)
+	}
+}
+
+func TestChangePasswordThrottle(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "easy"}})
+	cfg, db, mux := testSessionServer(t)
+	clock := &fakeClock{now: time.Now()}
+	mux.HandleFunc("/api/change-password", AuthMiddlewarePasswordChange(cfg, db, HandleChangePassword(db, NewLoginLimiter(db, cfg.Login, clock))))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+	RegisterUser(db, &User{Login: "other", Password: "pass"})
+
+	user, other := cookieJar{}, cookieJar{}
+	user.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+	other.do(mux, "POST", "/api/login", `{"login":"other","password":"pass"}`)
+
+	if code := user.do(mux, "POST", "/api/change-password", `{"oldPassword":"guess","newPassword":"newpass"}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected wrong old password to be rejected, got %d", code)
+	}
+	if code := user.do(mux, "POST", "/api/change-password", `{"oldPassword":"pass","newPassword":"newpass"}`); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the next attempt to wait, got %d", code)
+	}
+	for i := 1; i < cfg.Login.maxFailures(); i++ {
+		clock.Advance(time.Minute)
+		user.do(mux, "POST", "/api/change-password", `{"oldPassword":"guess","newPassword":"newpass"}`)
+	}
+	clock.Advance(time.Minute)
+	if code := user.do(mux, "POST", "/api/change-password", `{"oldPassword":"pass","newPassword":"newpass"}`); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the user to be locked out, got %d", code)
+	}
+	if code := other.do(mux, "POST", "/api/change-password", `{"oldPassword":"pass","newPassword":"newpass"}`); code != http.StatusOK {
+		t.Errorf("Expected other users not to be affected, got %d", code)
+	}
+
+	clock.Advance(cfg.Login.lockout())
+	if code := user.do(mux, "POST", "/api/change-password", `{"oldPassword":"pass","newPassword":"newpass"}`); code != http.StatusOK {
+		t.Errorf("Expected the password change after the lockout, got %d", code)
+	}
+	var failures int
+	if db.QueryRow(`SELECT COUNT(*) FROM failed_logins WHERE subject LIKE 'password:%'`).Scan(&failures); failures != 0 {
+		t.Error("Expected a correct password to clear the failures")
+	}
+}
+
+func TestAdminResetForcesPasswordChange(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "easy"}})
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/change-password", AuthMiddlewarePasswordChange(cfg, db, HandleChangePassword(db, NewLoginLimiter(db, cfg.Login, nil))))
+	mux.HandleFunc("/api/reset-password", RequirePermission(cfg, db, PermResetPasswords, HandleAdminResetPassword(db)))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	user := cookieJar{}
+	user.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+	if code := user.do(mux, "POST", "/api/reset-password", `{"login":"testadmin","password":"x"}`); code != http.StatusForbidden {
+		t.Errorf("Expected user not to reset passwords, got %d", code)
+	}
+
+	admin := cookieJar{}
+	admin.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+	if code := admin.do(mux, "POST", "/api/reset-password", `{"login":"nobody","password":"temp"}`); code != http.StatusNotFound {
+		t.Errorf("Expected unknown user to give 404, got %d", code)
+	}
+	if code := admin.do(mux, "POST", "/api/reset-password", `{"login":"user","password":"temp"}`); code != http.StatusOK {
+		t.Fatalf("Reset failed with %d", code)
+	}
+	if code := user.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions of the user to be revoked, got %d", code)
+	}
+
+	var login struct {
+		MustChange bool `json:"mustChangePassword"`
+	}
+	user = cookieJar{}
+	user.postJSON(mux, "/api/login", `{"login":"user","password":"temp"}`, &login)
+	if !login.MustChange {
+		t.Error("Expected login to report the required password change")
+	}
+	if status, code := authErrorCode(mux, user, "GET", "/api/me", ""); status != http.StatusForbidden || code != "password_change_required" {
+		t.Errorf("Expected password_change_required, got %d %q", status, code)
+	}
+	if code := user.do(mux, "POST", "/api/change-password", `{"oldPassword":"temp","newPassword":"mine"}`); code != http.StatusOK {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	if code := user.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected access after the password change, got %d", code)
+	}
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	InitPasswordValidator(&Config{Password: &PasswordConfig{Mode: "easy"}})
+	cfg, db, mux := testSessionServer(t)
+	notifier := newRecordingNotifier()
+	mux.HandleFunc("/api/password-reset/request", HandleRequestPasswordReset(cfg, db, notifier, NewLoginLimiter(db, cfg.Login, nil)))
+	mux.HandleFunc("/api/password-reset/confirm", HandleConfirmPasswordReset(db))
+	RegisterUser(db, &User{Login: "user", Password: "pass", Email: "user@example.com"})
+
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/request", `{"login":"nobody"}`); code != http.StatusAccepted {
+		t.Errorf("Expected unknown login to look the same, got %d", code)
+	}
+
+	session := cookieJar{}
+	session.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/request", `{"login":"user"}`); code != http.StatusAccepted {
+		t.Fatalf("Reset request failed with %d", code)
+	}
+	// The unknown login was requested first, so its message would arrive first
+	msg := notifier.next(t)
+	if msg.to != "user@example.com" || msg.token == "" {
+		t.Fatalf("Expected reset message to the user, got %+v", msg)
+	}
+
+	// Requesting again invalidates the earlier token
+	first := msg.token
+	(cookieJar{}).do(mux, "POST", "/api/password-reset/request", `{"login":"user"}`)
+	msg = notifier.next(t)
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/confirm", `{"token":"`+first+`","newPassword":"newpass"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected superseded token to be rejected, got %d", code)
+	}
+
+	confirm := `{"token":"` + msg.token + `","newPassword":"newpass"}`
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/confirm", confirm); code != http.StatusOK {
+		t.Fatalf("Reset failed with %d", code)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/confirm", confirm); code != http.StatusBadRequest {
+		t.Errorf("Expected used token to be rejected, got %d", code)
+	}
+	if code := session.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions to be revoked by the reset, got %d", code)
+	}
+	if code := (cookieJar{}).do(mux, "POST", "/api/login", `{"login":"user","password":"newpass"}`); code != http.StatusOK {
+		t.Errorf("Expected login with the new password, got %d", code)
+	}
+
+	// Expired tokens are rejected
+	(cookieJar{}).do(mux, "POST", "/api/password-reset/request", `{"login":"user"}`)
+	msg = notifier.next(t)
+	db.Exec(`UPDATE password_resets SET expiresAt = ?`, time.Now().UTC().Add(-time.Minute).Format(sessionTimeLayout))
+	if code := (cookieJar{}).do(mux, "POST", "/api/password-reset/confirm", `{"token":"`+msg.token+`","newPassword":"other"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected expired token to be rejected, got %d", code)
+	}
+}
+
+func TestPasswordResetThrottle(t *testing.T) {
+	cfg, db, mux := testSessionServer(t)
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	notifier := newRecordingNotifier()
+	mux.HandleFunc("/api/password-reset/request", HandleRequestPasswordReset(cfg, db, notifier, NewLoginLimiter(db, cfg.Login, clock)))
+	RegisterUser(db, &User{Login: "user", Password: "pass", Email: "user@example.com"})
+
+	request := func(ip, login string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/password-reset/request", strings.NewReader(`{"login":"`+login+`"}`))
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < cfg.Mail.resetLimit(); i++ {
+		if rec := request("10.0.0.1", "user"); rec.Code != http.StatusAccepted {
+			t.Fatalf("Request %d: expected 202, got %d", i+1, rec.Code)
+		}
+		notifier.next(t)
+	}
+	if rec := request("10.0.0.2", "user"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("Expected the login to be throttled from any IP, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if len(notifier.sent) != 0 {
+		t.Error("Expected no message for a throttled request")
+	}
+
+	// One IP asking for many logins is throttled as well
+	for i := 0; i < cfg.Mail.resetLimit()*defaultIPFailureFactor-cfg.Mail.resetLimit(); i++ {
+		request("10.0.0.1", "nobody"+strconv.Itoa(i))
+	}
+	if rec := request("10.0.0.1", "someone"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the IP to be throttled, got %d", rec.Code)
+	}
+
+	clock.Advance(time.Hour)
+	if rec := request("10.0.0.1", "user"); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected requests after the window, got %d", rec.Code)
+	}
+	notifier.next(t)
+}
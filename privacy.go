@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+var ErrMalformedImage = errors.New("image structure cannot be parsed")
+
+// Privacy policies applied to photos served to users other than the owner
+const (
+	PrivacyNone             = "none"
+	PrivacyStripLocation    = "strip-location"
+	PrivacyStripIdentifying = "strip-identifying"
+)
+
+// Device-identifying tags of IFD0 and the Exif IFD
+var deviceTags = []uint16{
+	0x010F, // Make
+	0x0110, // Model
+	0x0131, // Software
+	0x013B, // Artist
+	0x013C, // HostComputer
+	0x927C, // MakerNote
+	0xA420, // ImageUniqueID
+	0xA430, // CameraOwnerName
+	0xA431, // BodySerialNumber
+	0xA433, // LensMake
+	0xA434, // LensModel
+	0xA435, // LensSerialNumber
+}
+
+func (p PhotosConfig) PrivacyPolicy() string {
+	switch p.Privacy {
+	case PrivacyNone, PrivacyStripLocation:
+		return p.Privacy
+	default:
+		return PrivacyStripIdentifying
+	}
+}
+
+// readIFDStrict is readIFD for scrubbing: the offset must point at an entry table that
+// fits in the data, otherwise the tags it holds cannot be found and removed.
+func (t *tiffReader) readIFDStrict(offset uint32) (map[uint16]tiffEntry, error) {
+	if offset < 8 || uint64(offset)+2 > uint64(len(t.b)) {
+		return nil, ErrMalformedImage
+	}
+	n := uint64(t.order.Uint16(t.b[offset:]))
+	if uint64(offset)+2+n*12 > uint64(len(t.b)) {
+		return nil, ErrMalformedImage
+	}
+	return t.readIFD(offset), nil
+}
+
+// scrubTIFF removes the configured tags from a TIFF structure in place. Removed values
+// are zeroed and the GPS IFD is emptied, so all offsets in the file stay valid. A
+// structure whose IFDs cannot be read is rejected with ErrMalformedImage.
+func scrubTIFF(b []byte, policy string) error {
+	t, err := newTIFFReader(b)
+	if err != nil {
+		return ErrMalformedImage
+	}
+
+	ifd0, err := t.readIFDStrict(t.firstIFD())
+	if err != nil {
+		return err
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		off, ok := t.uint(e)
+		if !ok {
+			return ErrMalformedImage
+		}
+		gps, err := t.readIFDStrict(off)
+		if err != nil {
+			return err
+		}
+		for _, ge := range gps {
+			clear(ge.data)
+		}
+		n := uint64(t.order.Uint16(b[off:]))
+		clear(b[off : uint64(off)+2+n*12])
+	}
+
+	if policy != PrivacyStripIdentifying {
+		return nil
+	}
+
+	ifds := []map[uint16]tiffEntry{ifd0}
+	if e, ok := ifd0[tagExifIFD]; ok {
+		off, ok := t.uint(e)
+		if !ok {
+			return ErrMalformedImage
+		}
+		exif, err := t.readIFDStrict(off)
+		if err != nil {
+			return err
+		}
+		ifds = append(ifds, exif)
+	}
+	for _, ifd := range ifds {
+		for _, tag := range deviceTags {
+			if e, ok := ifd[tag]; ok {
+				clear(e.data)
+			}
+		}
+	}
+	return nil
+}
+
+func isXMPSegment(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/")) ||
+		bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xmp/extension/"))
+}
+
+// sanitizeJPEG scrubs the Exif segment and drops XMP (APP1) and IPTC (APP13) segments,
+// which can carry the same location and device information. An Exif segment that cannot
+// be scrubbed is dropped as a whole. The whole file is parsed, including segments after
+// each scan; a file that cannot be parsed is rejected rather than copied, and anything
+// after the EOI marker is dropped.
+func sanitizeJPEG(b []byte, policy string) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:2]...)
+
+	pos := 2
+	for {
+		if pos+2 > len(b) || b[pos] != 0xFF {
+			return nil, ErrMalformedImage
+		}
+		// Markers may be preceded by any number of fill bytes
+		for pos+1 < len(b) && b[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+2 > len(b) {
+			return nil, ErrMalformedImage
+		}
+		marker := b[pos+1]
+		if marker == 0xD9 {
+			return append(out, 0xFF, 0xD9), nil
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			out = append(out, b[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		if pos+4 > len(b) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(b[pos+2:]))
+		if length < 2 || pos+2+length > len(b) {
+			return nil, ErrMalformedImage
+		}
+		seg := b[pos : pos+2+length]
+		payload := seg[4:]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			seg = bytes.Clone(seg)
+			if scrubTIFF(seg[10:], policy) != nil {
+				continue
+			}
+		case marker == 0xE1 && isXMPSegment(payload), marker == 0xED:
+			continue
+		}
+		out = append(out, seg...)
+
+		if marker == 0xDA {
+			// Entropy-coded data ends at the first marker other than a stuffed zero
+			// byte or a restart marker
+			start := pos
+			for {
+				if pos+1 >= len(b) {
+					return nil, ErrMalformedImage
+				}
+				if b[pos] == 0xFF && b[pos+1] != 0x00 && (b[pos+1] < 0xD0 || b[pos+1] > 0xD7) {
+					break
+				}
+				pos++
+			}
+			out = append(out, b[start:pos]...)
+		}
+	}
+}
+
+// isMetadataTextChunk reports whether a PNG text chunk holds an XMP packet or a raw
+// Exif/XMP/IPTC profile as written by ImageMagick and exiftool.
+func isMetadataTextChunk(typ string, data []byte) bool {
+	if typ != "tEXt" && typ != "zTXt" && typ != "iTXt" {
+		return false
+	}
+	keyword, _, _ := bytes.Cut(data, []byte{0})
+	return string(keyword) == "XML:com.adobe.xmp" || bytes.HasPrefix(keyword, []byte("Raw profile type "))
+}
+
+// sanitizePNG drops the eXIf chunk and text chunks carrying metadata profiles. Files with
+// truncated chunks are rejected and data after IEND is dropped.
+func sanitizePNG(b []byte) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:8]...)
+
+	pos := 8
+	for {
+		if pos+12 > len(b) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(b[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(b) {
+			return nil, ErrMalformedImage
+		}
+		typ := string(b[pos+4 : pos+8])
+		data := b[pos+8 : pos+8+length]
+
+		if typ != "eXIf" && !isMetadataTextChunk(typ, data) {
+			out = append(out, b[pos:end]...)
+		}
+		pos = end
+		if typ == "IEND" {
+			return out, nil
+		}
+	}
+}
+
+// GIF application extensions kept by sanitizeGIF; all others, like XMP, are dropped
+var gifApplications = []string{"NETSCAPE2.0", "ANIMEXTS1.0", "ICCRGBG1012"}
+
+// skipGIFSubBlocks returns the position after the data sub-blocks starting at pos.
+func skipGIFSubBlocks(b []byte, pos int) (int, error) {
+	for {
+		if pos >= len(b) {
+			return 0, ErrMalformedImage
+		}
+		n := int(b[pos])
+		pos += 1 + n
+		if n == 0 {
+			return pos, nil
+		}
+	}
+}
+
+// sanitizeGIF drops comment extensions and application extensions other than the
+// animation and color profile ones, which can carry XMP metadata. Files with truncated
+// blocks are rejected and data after the trailer is dropped.
+func sanitizeGIF(b []byte) ([]byte, error) {
+	if len(b) < 13 {
+		return nil, ErrMalformedImage
+	}
+	pos := 13
+	if b[10]&0x80 != 0 {
+		pos += 3 << (b[10]&0x07 + 1)
+	}
+	if pos > len(b) {
+		return nil, ErrMalformedImage
+	}
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:pos]...)
+
+	for {
+		if pos >= len(b) {
+			return nil, ErrMalformedImage
+		}
+		start := pos
+		switch b[pos] {
+		case 0x3B:
+			return append(out, 0x3B), nil
+		case 0x2C:
+			if pos+10 > len(b) {
+				return nil, ErrMalformedImage
+			}
+			flags := b[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data sub-blocks
+			end, err := skipGIFSubBlocks(b, pos+1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b[start:end]...)
+			pos = end
+		case 0x21:
+			if pos+2 > len(b) {
+				return nil, ErrMalformedImage
+			}
+			label := b[pos+1]
+			end, err := skipGIFSubBlocks(b, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			keep := label != 0xFE && label != 0xFF
+			if label == 0xFF && pos+3 < end {
+				n := int(b[pos+2])
+				keep = slices.Contains(gifApplications, string(b[pos+3:min(pos+3+n, end)]))
+			}
+			if keep {
+				out = append(out, b[start:end]...)
+			}
+			pos = end
+		default:
+			return nil, ErrMalformedImage
+		}
+	}
+}
+
+// SanitizeImage returns a copy of the image data with location (and, depending on the
+// policy, device-identifying) metadata removed. Pixel data is never modified. Images
+// whose structure cannot be parsed are rejected with ErrMalformedImage.
+func SanitizeImage(b []byte, policy string) ([]byte, error) {
+	if policy == PrivacyNone {
+		return b, nil
+	}
+
+	switch {
+	case len(b) >= 4 && b[0] == 0xFF && b[1] == 0xD8:
+		return sanitizeJPEG(b, policy)
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return sanitizePNG(b)
+	case bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")):
+		out := bytes.Clone(b)
+		if err := scrubTIFF(out, policy); err != nil {
+			return nil, err
+		}
+		return out, nil
+	case bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a")):
+		return sanitizeGIF(b)
+	}
+	return b, nil
+}
+
+// SanitizeMetadata hides the metadata fields removed from the files by the policy.
+func SanitizeMetadata(md *PhotoMetadata, policy string) *PhotoMetadata {
+	if policy == PrivacyNone {
+		return md
+	}
+	out := *md
+	out.Latitude, out.Longitude, out.Altitude = nil, nil, nil
+	if policy == PrivacyStripIdentifying {
+		out.CameraMake, out.CameraModel, out.LensModel = "", "", ""
+	}
+	return &out
+}
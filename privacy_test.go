@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestSanitizeJPEG(t *testing.T) {
+	original := testJPEGWithEXIF(t, testEXIFTIFF())
+
+	clean, err := SanitizeImage(original, PrivacyStripIdentifying)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	md, err := ParseEXIF(clean)
+	if err != nil {
+		t.Fatalf("Expected Exif segment to be kept, got: %v", err)
+	}
+	if md.Latitude != nil || md.Longitude != nil {
+		t.Error("Expected GPS data to be removed")
+	}
+	if md.CameraMake != "" || md.CameraModel != "" || md.LensModel != "" {
+		t.Errorf("Expected device tags to be removed, got %+v", md)
+	}
+	if md.CaptureDate == "" || md.Orientation != 6 {
+		t.Errorf("Expected capture date and orientation to be kept, got %+v", md)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(clean)); err != nil {
+		t.Errorf("Sanitized JPEG does not decode: %v", err)
+	}
+
+	// The original must stay untouched
+	if md, _ := ParseEXIF(original); md.Latitude == nil || md.CameraMake != "Canon" {
+		t.Error("Expected original data to be unchanged")
+	}
+
+	clean, _ = SanitizeImage(original, PrivacyStripLocation)
+	md, _ = ParseEXIF(clean)
+	if md.Latitude != nil || md.CameraMake != "Canon" {
+		t.Errorf("Expected only location to be removed, got %+v", md)
+	}
+
+	if clean, _ := SanitizeImage(original, PrivacyNone); !bytes.Equal(clean, original) {
+		t.Error("Expected no changes with privacy disabled")
+	}
+}
+
+func TestSanitizeJPEGFailsClosed(t *testing.T) {
+	original := testJPEGWithEXIF(t, testEXIFTIFF())
+
+	// A broken segment length in front of the Exif segment must not let it through
+	broken := bytes.Clone(original)
+	binary.BigEndian.PutUint16(broken[4:], 1)
+	if _, err := SanitizeImage(broken, PrivacyStripLocation); !errors.Is(err, ErrMalformedImage) {
+		t.Errorf("Expected ErrMalformedImage for an unparsable segment, got %v", err)
+	}
+
+	if _, err := SanitizeImage(original[:len(original)-2], PrivacyStripLocation); !errors.Is(err, ErrMalformedImage) {
+		t.Errorf("Expected ErrMalformedImage for a truncated file, got %v", err)
+	}
+
+	// Exif data behind the first scan is scrubbed too, and trailing data is dropped
+	eoi := len(original) - 2
+	payload := append([]byte("Exif\x00\x00"), testEXIFTIFF()...)
+	tail := append(bytes.Clone(original[:eoi]), 0xFF, 0xE1, 0, 0)
+	binary.BigEndian.PutUint16(tail[eoi+2:], uint16(len(payload)+2))
+	tail = append(tail, payload...)
+	tail = append(tail, 0xFF, 0xD9)
+	tail = append(tail, "trailing"...)
+	clean, err := SanitizeImage(tail, PrivacyStripLocation)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	if bytes.Contains(clean, []byte("trailing")) {
+		t.Error("Expected data after EOI to be dropped")
+	}
+	if md, _ := ParseTIFFMetadata(clean[bytes.LastIndex(clean, []byte("Exif\x00\x00"))+6:]); md == nil || md.Latitude != nil {
+		t.Error("Expected GPS data after the scan to be removed")
+	}
+}
+
+func TestSanitizeJPEGDropsUnparsableExif(t *testing.T) {
+	// An IFD0 offset past the end of the data hides the GPS IFD from the scrubber
+	tiff := testEXIFTIFF()
+	binary.LittleEndian.PutUint32(tiff[4:], uint32(len(tiff)+100))
+	original := testJPEGWithEXIF(t, tiff)
+
+	clean, err := SanitizeImage(original, PrivacyStripLocation)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	if bytes.Contains(clean, []byte("Exif\x00\x00")) {
+		t.Error("Expected the unparsable Exif segment to be dropped")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(clean)); err != nil {
+		t.Errorf("Sanitized JPEG does not decode: %v", err)
+	}
+
+	if _, err := SanitizeImage(tiff, PrivacyStripLocation); !errors.Is(err, ErrMalformedImage) {
+		t.Errorf("Expected ErrMalformedImage for an unparsable TIFF file, got %v", err)
+	}
+}
+
+func TestSanitizePNG(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	b := buf.Bytes()
+
+	// Insert an eXIf chunk right after IHDR
+	tiff := testEXIFTIFF()
+	chunk := make([]byte, 8, 12+len(tiff))
+	binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+	copy(chunk[4:], "eXIf")
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(b[8:]))
+	withExif := append(append(append([]byte{}, b[:ihdrEnd]...), chunk...), b[ihdrEnd:]...)
+
+	clean, err := SanitizeImage(withExif, PrivacyStripLocation)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	if bytes.Contains(clean, []byte("eXIf")) {
+		t.Error("Expected eXIf chunk to be removed")
+	}
+	if !bytes.Equal(clean, b) {
+		t.Error("Expected remaining chunks to be unchanged")
+	}
+}
+
+func TestSanitizePNGDropsRawProfiles(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	b := buf.Bytes()
+
+	pngChunk := func(typ string, data string) []byte {
+		c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		c = append(append(c, typ...), data...)
+		return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+	}
+	title := pngChunk("tEXt", "Title\x00Holidays")
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(b[8:]))
+	withProfiles := append([]byte{}, b[:ihdrEnd]...)
+	withProfiles = append(withProfiles, pngChunk("tEXt", "Raw profile type exif\x00\nexif\n   12\n4d4d002a")...)
+	withProfiles = append(withProfiles, pngChunk("zTXt", "Raw profile type xmp\x00\x00compressed")...)
+	withProfiles = append(withProfiles, title...)
+	withProfiles = append(withProfiles, b[ihdrEnd:]...)
+
+	clean, err := SanitizeImage(withProfiles, PrivacyStripLocation)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	if bytes.Contains(clean, []byte("Raw profile type")) {
+		t.Error("Expected raw profile chunks to be removed")
+	}
+	if !bytes.Contains(clean, title) {
+		t.Error("Expected other text chunks to be kept")
+	}
+	if _, err := png.Decode(bytes.NewReader(clean)); err != nil {
+		t.Errorf("Sanitized PNG does not decode: %v", err)
+	}
+}
+
+func TestSanitizeGIF(t *testing.T) {
+	var buf bytes.Buffer
+	gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9), nil)
+	b := buf.Bytes()
+
+	// Insert an XMP application extension and a comment in front of the image
+	xmp := []byte{0x21, 0xFF, 11}
+	xmp = append(xmp, "XMP DataXMP"...)
+	xmp = append(xmp, 10)
+	xmp = append(xmp, "<x:xmpmeta"...)
+	xmp = append(xmp, 0)
+	comment := append([]byte{0x21, 0xFE, 6}, "Gdansk\x00"...)
+	loop := append([]byte{0x21, 0xFF, 11}, "NETSCAPE2.0"...)
+	loop = append(loop, 3, 1, 0, 0, 0)
+
+	// Header, logical screen descriptor and the global color table
+	body := 13 + 3<<(b[10]&0x07+1)
+	withXMP := append([]byte{}, b[:body]...)
+	withXMP = append(withXMP, xmp...)
+	withXMP = append(withXMP, comment...)
+	withXMP = append(withXMP, loop...)
+	withXMP = append(withXMP, b[body:]...)
+
+	clean, err := SanitizeImage(withXMP, PrivacyStripLocation)
+	if err != nil {
+		t.Fatalf("Failed to sanitize: %v", err)
+	}
+	if bytes.Contains(clean, []byte("XMP DataXMP")) || bytes.Contains(clean, []byte("Gdansk")) {
+		t.Error("Expected XMP and comment extensions to be removed")
+	}
+	if !bytes.Contains(clean, loop) {
+		t.Error("Expected the animation extension to be kept")
+	}
+	if _, err := gif.Decode(bytes.NewReader(clean)); err != nil {
+		t.Errorf("Sanitized GIF does not decode: %v", err)
+	}
+
+	if _, err := SanitizeImage(withXMP[:body+10], PrivacyStripLocation); !errors.Is(err, ErrMalformedImage) {
+		t.Errorf("Expected ErrMalformedImage for a truncated GIF, got %v", err)
+	}
+}
+
+func TestSanitizeMetadata(t *testing.T) {
+	md, _ := ParseTIFFMetadata(testEXIFTIFF())
+
+	clean := SanitizeMetadata(md, PrivacyStripIdentifying)
+	if clean.Latitude != nil || clean.CameraModel != "" {
+		t.Errorf("Expected location and device fields to be hidden, got %+v", clean)
+	}
+	if md.Latitude == nil {
+		t.Error("Expected original metadata to be unchanged")
+	}
+
+	if got := (PhotosConfig{}).PrivacyPolicy(); got != PrivacyStripIdentifying {
+		t.Errorf("Expected strip-identifying as default policy, got %s", got)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Brute-force protection of the login. Failed attempts are counted per client IP and
+// per login in the failed_logins table. Each failure blocks further attempts with an
+// exponentially growing delay, and after max_failures the key is locked out.
+
+const (
+	defaultMaxFailures      = 5
+	defaultIPFailureFactor  = 4
+	defaultLockoutMinutes   = 15
+	defaultBaseDelaySeconds = 1
+)
+
+// Clock returns the current time. Tests replace it to move time forward.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (l LoginConfig) maxFailures() int {
+	if l.MaxFailures <= 0 {
+		return defaultMaxFailures
+	}
+	return l.MaxFailures
+}
+
+func (l LoginConfig) ipMaxFailures() int {
+	if l.IPMaxFailures <= 0 {
+		return l.maxFailures() * defaultIPFailureFactor
+	}
+	return l.IPMaxFailures
+}
+
+func (l LoginConfig) lockout() time.Duration {
+	if l.LockoutMinutes <= 0 {
+		return defaultLockoutMinutes * time.Minute
+	}
+	return time.Duration(l.LockoutMinutes) * time.Minute
+}
+
+func (l LoginConfig) baseDelay() time.Duration {
+	if l.BaseDelaySeconds <= 0 {
+		return defaultBaseDelaySeconds * time.Second
+	}
+	return time.Duration(l.BaseDelaySeconds) * time.Second
+}
+
+// LoginLimiter throttles login attempts.
+type LoginLimiter struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	cfg   LoginConfig
+	clock Clock
+}
+
+func NewLoginLimiter(db *sql.DB, cfg LoginConfig, clock Clock) *LoginLimiter {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &LoginLimiter{db: db, cfg: cfg, clock: clock}
+}
+
+func ipKey(ip string) string          { return "ip:" + ip }
+func loginKey(login string) string    { return "login:" + login }
+func passwordKey(userID int64) string { return "password:" + strconv.FormatInt(userID, 10) }
+
+// clientIP returns the address of the connection. Forwarding headers are not trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginCounter is the failed_logins row of a key.
+type loginCounter struct {
+	subject     string
+	found       bool
+	failures    int
+	lastFailure string
+	lockedUntil string
+}
+
+func readLoginCounter(tx *sql.Tx, key string) (loginCounter, error) {
+	c := loginCounter{subject: key}
+	err := tx.QueryRow(`SELECT failures, lastFailureAt, lockedUntil FROM failed_logins WHERE subject = ?`, key).
+		Scan(&c.failures, &c.lastFailure, &c.lockedUntil)
+	switch {
+	case err == nil:
+		c.found = true
+	case err != sql.ErrNoRows:
+		return c, err
+	}
+	return c, nil
+}
+
+// blockedFor returns how long the key has to wait before the next attempt.
+func (c loginCounter) blockedFor(now time.Time) time.Duration {
+	until, err := time.Parse(sessionTimeLayout, c.lockedUntil)
+	if !c.found || err != nil || !until.After(now) {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// LoginAttempt is an attempt reserved by LoginLimiter.Reserve. It already counts as a
+// failure, so an attempt the caller never resolves keeps counting.
+type LoginAttempt struct {
+	limiter  *LoginLimiter
+	clear    string // key whose failures a successful attempt removes
+	at       string
+	previous []loginCounter
+	reserved []int // failures of each key after the reservation
+}
+
+// limitKey is a failed_logins key with the number of failures that locks it out.
+type limitKey struct {
+	subject string
+	max     int
+}
+
+// Reserve records the attempt as failed before the credentials are checked, so parallel
+// requests cannot all pass the limit before the first failure is stored. It returns how
+// long the client has to wait when the IP or the login is blocked, no attempt is reserved
+// then. The check and the increment run under the limiter mutex in one transaction.
+func (l *LoginLimiter) Reserve(ip, login string) (*LoginAttempt, time.Duration, error) {
+	return l.reserve(loginKey(login),
+		limitKey{ipKey(ip), l.cfg.ipMaxFailures()}, limitKey{loginKey(login), l.cfg.maxFailures()})
+}
+
+// ReservePasswordCheck reserves an attempt to confirm the password of a logged in user,
+// like the old password of a password change. It is counted per user, so a stolen
+// session cannot be used to guess the password.
+func (l *LoginLimiter) ReservePasswordCheck(userID int64) (*LoginAttempt, time.Duration, error) {
+	key := passwordKey(userID)
+	return l.reserve(key, limitKey{key, l.cfg.maxFailures()})
+}
+
+func (l *LoginLimiter) reserve(clear string, keys ...limitKey) (*LoginAttempt, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now().UTC()
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	attempt := &LoginAttempt{limiter: l, clear: clear, at: now.Format(sessionTimeLayout)}
+	var wait time.Duration
+	for _, k := range keys {
+		c, err := readLoginCounter(tx, k.subject)
+		if err != nil {
+			return nil, 0, err
+		}
+		wait = max(wait, c.blockedFor(now))
+		attempt.previous = append(attempt.previous, c)
+	}
+	if wait > 0 {
+		return nil, wait, nil
+	}
+
+	for _, k := range keys {
+		failures, err := l.fail(tx, k.subject, k.max, now)
+		if err != nil {
+			return nil, 0, err
+		}
+		attempt.reserved = append(attempt.reserved, failures)
+	}
+	return attempt, 0, tx.Commit()
+}
+
+// fail increments the failures of the key in one statement and locks it for the delay
+// that follows them. It returns the new number of failures.
+func (l *LoginLimiter) fail(tx *sql.Tx, key string, max int, now time.Time) (int, error) {
+	// Failures older than the lockout period are forgotten
+	cutoff := now.Add(-l.cfg.lockout()).Format(sessionTimeLayout)
+	var failures int
+	err := tx.QueryRow(`INSERT INTO failed_logins (subject, failures, lastFailureAt, lockedUntil) VALUES (?, 1, ?, ?)
+		ON CONFLICT(subject) DO UPDATE SET
+			failures = CASE WHEN lastFailureAt < ? THEN 1 ELSE failures + 1 END,
+			lastFailureAt = excluded.lastFailureAt
+		RETURNING failures`,
+		key, now.Format(sessionTimeLayout), now.Format(sessionTimeLayout), cutoff).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	delay := l.cfg.lockout()
+	if failures < max {
+		delay = l.cfg.baseDelay() << (failures - 1)
+		if delay > l.cfg.lockout() || delay <= 0 {
+			delay = l.cfg.lockout()
+		}
+	}
+	_, err = tx.Exec(`UPDATE failed_logins SET lockedUntil = ? WHERE subject = ?`, now.Add(delay).Format(sessionTimeLayout), key)
+	return failures, err
+}
+
+// Cancel takes back the reservation of an attempt that did not fail, like a correct
+// password waiting for the second factor. Counters changed by other attempts since the
+// reservation only lose this attempt, their lockout stays. Cancelling twice has no effect.
+func (a *LoginAttempt) Cancel() error {
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a.previous == nil {
+		return nil
+	}
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, prev := range a.previous {
+		c, err := readLoginCounter(tx, prev.subject)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !c.found:
+			continue
+		case c.failures == a.reserved[i] && c.lastFailure == a.at && !prev.found:
+			_, err = tx.Exec(`DELETE FROM failed_logins WHERE subject = ?`, prev.subject)
+		case c.failures == a.reserved[i] && c.lastFailure == a.at:
+			// Nothing else happened since the reservation
+			_, err = tx.Exec(`UPDATE failed_logins SET failures = ?, lastFailureAt = ?, lockedUntil = ? WHERE subject = ?`,
+				prev.failures, prev.lastFailure, prev.lockedUntil, prev.subject)
+		default:
+			_, err = tx.Exec(`UPDATE failed_logins SET failures = MAX(failures - 1, 0) WHERE subject = ?`, prev.subject)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.previous = nil
+	return nil
+}
+
+// Succeed clears the failures of the login or user. The counter of the IP is only
+// restored to its state before the attempt, so one valid account cannot be used to reset it.
+func (a *LoginAttempt) Succeed() error {
+	if err := a.Cancel(); err != nil {
+		return err
+	}
+	_, err := a.limiter.db.Exec(`DELETE FROM failed_logins WHERE subject = ?`, a.clear)
+	return err
+}
+
+// Unlock removes the lockout of the login.
+func (l *LoginLimiter) Unlock(login string) error {
+	_, err := l.db.Exec(`DELETE FROM failed_logins WHERE subject = ?`, loginKey(login))
+	return err
+}
+
+func resetIPKey(ip string) string       { return "reset-ip:" + ip }
+func resetLoginKey(login string) string { return "reset-login:" + login }
+
+// countInWindow counts an event of the key in a fixed window starting with its first
+// event, in one statement. It returns how long the key has to wait once more than
+// limit events happened in the window.
+func (l *LoginLimiter) countInWindow(key string, limit int, window time.Duration) (time.Duration, error) {
+	now := l.clock.Now().UTC()
+	var count int
+	var windowEnd string
+	err := l.db.QueryRow(`INSERT INTO failed_logins (subject, failures, lastFailureAt, lockedUntil) VALUES (?, 1, ?, ?)
+		ON CONFLICT(subject) DO UPDATE SET
+			failures = CASE WHEN lockedUntil <= excluded.lastFailureAt THEN 1 ELSE failures + 1 END,
+			lastFailureAt = excluded.lastFailureAt,
+			lockedUntil = CASE WHEN lockedUntil <= excluded.lastFailureAt THEN excluded.lockedUntil ELSE lockedUntil END
+		RETURNING failures, lockedUntil`,
+		key, now.Format(sessionTimeLayout), now.Add(window).Format(sessionTimeLayout)).Scan(&count, &windowEnd)
+	if err != nil {
+		return 0, err
+	}
+	until, err := time.Parse(sessionTimeLayout, windowEnd)
+	if err != nil || count <= limit {
+		return 0, err
+	}
+	return until.Sub(now), nil
+}
+
+// AllowPasswordReset counts a reset request for the login and the client IP. Requests
+// above the limit have to wait, so nobody can flood a user with emails or keep
+// invalidating the token they are about to use.
+func (l *LoginLimiter) AllowPasswordReset(ip, login string, cfg MailConfig) (time.Duration, error) {
+	wait, err := l.countInWindow(resetIPKey(ip), cfg.resetLimit()*defaultIPFailureFactor, resetLimitWindow)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	return l.countInWindow(resetLoginKey(login), cfg.resetLimit(), resetLimitWindow)
+}
+
+// writeTooManyRequests answers with 429 and the number of seconds to wait.
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// writeTooManyAttempts answers with 429 and the number of seconds to wait.
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	writeTooManyRequests(w, wait, "Too many login attempts, try again later")
+}
+
+// HandleUnlockAccount clears the failed login attempts of a user.
+func HandleUnlockAccount(db *sql.DB, limiter *LoginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req UnlockAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Login) == "" {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Looked up by login alone, accounts created through OIDC have no password
+		var userID int64
+		err := db.QueryRow(`SELECT ID FROM users WHERE login = ?`, req.Login).Scan(&userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := limiter.Unlock(req.Login); err != nil {
+			http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"login":   req.Login,
+			"message": "Account unlocked",
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func loginFrom(mux *http.ServeMux, ip, login, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"login":"`+login+`","password":"`+password+`"}`))
+	req.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginBackoffAndLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	_, _, mux, _ := testLoginServer(t, clock)
+
+	// Each failure doubles the delay: 1s, 2s, 4s, 8s, then 15 minutes of lockout
+	for i, delay := range []int{1, 2, 4, 8} {
+		if rec := loginFrom(mux, "10.0.0.1", "testadmin", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+		rec := loginFrom(mux, "10.0.0.1", "testadmin", "testpass")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != strconv.Itoa(delay) {
+			t.Fatalf("Attempt %d: expected 429 with Retry-After %d, got %d %q", i+1, delay, rec.Code, rec.Header().Get("Retry-After"))
+		}
+		clock.Advance(time.Duration(delay) * time.Second)
+	}
+
+	loginFrom(mux, "10.0.0.1", "testadmin", "wrong")
+	clock.Advance(time.Minute)
+	rec := loginFrom(mux, "10.0.0.2", "testadmin", "testpass")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "840" {
+		t.Fatalf("Expected locked account from another IP, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	clock.Advance(15 * time.Minute)
+	if rec := loginFrom(mux, "10.0.0.2", "testadmin", "testpass"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected login after lockout, got %d", rec.Code)
+	}
+
+	// A successful login clears the failures of the account
+	if rec := loginFrom(mux, "10.0.0.2", "testadmin", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected counter to restart, got %d", rec.Code)
+	}
+	clock.Advance(time.Second)
+	if rec := loginFrom(mux, "10.0.0.2", "testadmin", "testpass"); rec.Code != http.StatusOK {
+		t.Errorf("Expected login after first delay, got %d", rec.Code)
+	}
+}
+
+func TestLoginThrottlePerIP(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	cfg, db, mux, _ := testLoginServer(t, clock)
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	// One IP guessing passwords of many logins, waiting out each delay
+	for i := 0; i < cfg.Login.ipMaxFailures(); i++ {
+		clock.Advance(cfg.Login.lockout())
+		if rec := loginFrom(mux, "10.0.0.1", "guess"+strconv.Itoa(i), "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if rec := loginFrom(mux, "10.0.0.1", "user", "pass"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected IP to be locked out, got %d", rec.Code)
+	}
+	if rec := loginFrom(mux, "10.0.0.9", "user", "pass"); rec.Code != http.StatusOK {
+		t.Errorf("Expected other IPs to log in, got %d", rec.Code)
+	}
+}
+
+func TestUnlockAccount(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	cfg, db, mux, limiter := testLoginServer(t, clock)
+	mux.HandleFunc("/api/unlock-account", RequirePermission(cfg, db, PermBanUsers, HandleUnlockAccount(db, limiter)))
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	admin := cookieJar{}
+	admin.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+
+	for i := 0; i < cfg.Login.maxFailures(); i++ {
+		loginFrom(mux, "10.0.0.1", "user", "wrong")
+		clock.Advance(time.Minute)
+	}
+	if rec := loginFrom(mux, "10.0.0.2", "user", "pass"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected account to be locked, got %d", rec.Code)
+	}
+
+	user := cookieJar{}
+	if code := user.do(mux, "POST", "/api/unlock-account", `{"login":"user"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous unlock to be refused, got %d", code)
+	}
+	if code := admin.do(mux, "POST", "/api/unlock-account", `{"login":"nobody"}`); code != http.StatusNotFound {
+		t.Errorf("Expected unknown user to give 404, got %d", code)
+	}
+	if code := admin.do(mux, "POST", "/api/unlock-account", `{"login":"user"}`); code != http.StatusOK {
+		t.Fatalf("Unlock failed with %d", code)
+	}
+	if rec := loginFrom(mux, "10.0.0.2", "user", "pass"); rec.Code != http.StatusOK {
+		t.Errorf("Expected login after unlock, got %d", rec.Code)
+	}
+
+	// Accounts created through OIDC have no password
+	db.Exec(`INSERT INTO users (login, password, isAdmin, isBanned) VALUES ('sso', NULL, 0, 0)`)
+	if code := admin.do(mux, "POST", "/api/unlock-account", `{"login":"sso"}`); code != http.StatusOK {
+		t.Errorf("Expected account without a password to be unlocked, got %d", code)
+	}
+}
+
+func TestLoginReservationIsAtomic(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: filepath.Join(t.TempDir(), "test.db")},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := NewLoginLimiter(db, cfg.Login, clock)
+
+	// Parallel attempts cannot all pass before the first one is recorded
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, _, err := limiter.Reserve("10.0.0.1", "testadmin")
+			if err != nil {
+				t.Errorf("Reserve failed: %v", err)
+			}
+			if attempt != nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 1 {
+		t.Errorf("Expected one attempt to pass, got %d", reserved)
+	}
+
+	// A cancelled attempt leaves the counters as they were
+	clock.Advance(time.Second)
+	attempt, wait, _ := limiter.Reserve("10.0.0.1", "testadmin")
+	if attempt == nil {
+		t.Fatalf("Expected attempt after the delay, got wait %v", wait)
+	}
+	attempt.Cancel()
+	attempt.Cancel()
+	var failures int
+	db.QueryRow(`SELECT failures FROM failed_logins WHERE subject = ?`, loginKey("testadmin")).Scan(&failures)
+	if failures != 1 {
+		t.Errorf("Expected cancelled attempt not to count, got %d failures", failures)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+// Default longest-edge sizes (in pixels) of the renditions generated for every photo.
+var defaultRenditionSizes = map[string]int{
+	"thumb":  160,
+	"small":  480,
+	"medium": 1024,
+	"large":  2048,
+}
+
+func (p PhotosConfig) Sizes() map[string]int {
+	if len(p.RenditionSizes) == 0 {
+		return defaultRenditionSizes
+	}
+	return p.RenditionSizes
+}
+
+// renditionKey stores the rendition next to the original: login/a.jpg -> login/a.thumb.jpg.
+// GIF sources are re-encoded as PNG.
+func renditionKey(original, size, format string) string {
+	ext := path.Ext(original)
+	base := strings.TrimSuffix(original, ext)
+	if format == "jpeg" {
+		if ext == "" {
+			ext = ".jpg"
+		}
+	} else {
+		ext = ".png"
+	}
+	return fmt.Sprintf("%s.%s%s", base, size, ext)
+}
+
+// resizeImage scales src down so that its longest edge is at most maxDim, averaging
+// every source pixel covered by a destination pixel. Images that already fit are returned as is.
+func resizeImage(src image.Image, maxDim int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if maxDim <= 0 || (sw <= maxDim && sh <= maxDim) {
+		return src
+	}
+
+	dw, dh := maxDim, maxDim
+	if sw >= sh {
+		dh = max(1, sh*maxDim/sw)
+	} else {
+		dw = max(1, sw*maxDim/sh)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := y * sh / dh
+		y1 := max(y0+1, (y+1)*sh/dh)
+		for x := 0; x < dw; x++ {
+			x0 := x * sw / dw
+			x1 := max(x0+1, (x+1)*sw/dw)
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					px := row[sx*4 : sx*4+4]
+					r += uint32(px[0])
+					g += uint32(px[1])
+					bl += uint32(px[2])
+					a += uint32(px[3])
+					n++
+				}
+			}
+
+			off := y*dst.Stride + x*4
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(bl / n)
+			dst.Pix[off+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func writeRendition(store PhotoStore, key string, img image.Image, format string) error {
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return err
+		}
+		return store.Put(key, &buf, "image/jpeg")
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return store.Put(key, &buf, "image/png")
+}
+
+// GenerateRenditions decodes the original photo and stores every configured rendition
+// in the photo_renditions table, replacing any previous ones.
+func GenerateRenditions(cfg *Config, db *sql.DB, store PhotoStore, photoID int64, key string, original io.Reader) error {
+	src, format, err := image.Decode(original)
+	if err != nil {
+		return err
+	}
+
+	for size, maxDim := range cfg.Photos.Sizes() {
+		img := resizeImage(src, maxDim)
+		rkey := renditionKey(key, size, format)
+		if err := writeRendition(store, rkey, img, format); err != nil {
+			return err
+		}
+
+		_, err := db.Exec(`INSERT OR REPLACE INTO photo_renditions (photoID, size, imagePath, width, height) VALUES (?, ?, ?, ?, ?)`,
+			photoID, size, rkey, img.Bounds().Dx(), img.Bounds().Dy())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindRendition returns the storage key of the requested rendition of a photo.
+func FindRendition(db *sql.DB, photoID int64, size string) (string, bool) {
+	var key string
+	err := db.QueryRow(`SELECT imagePath FROM photo_renditions WHERE photoID = ? AND size = ?`, photoID, size).Scan(&key)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// DeleteRenditions removes rendition files and rows of a photo.
+func DeleteRenditions(db *sql.DB, store PhotoStore, photoID int64) {
+	rows, err := db.Query(`SELECT imagePath FROM photo_renditions WHERE photoID = ?`, photoID)
+	if err == nil {
+		var keys []string
+		for rows.Next() {
+			var key string
+			rows.Scan(&key)
+			keys = append(keys, key)
+		}
+		rows.Close()
+		for _, key := range keys {
+			store.Delete(key)
+		}
+	}
+	db.Exec(`DELETE FROM photo_renditions WHERE photoID = ?`, photoID)
+}
+
+// BackfillRenditions generates renditions for photos uploaded before the pipeline existed.
+// Photos that cannot be decoded are skipped. It returns the number of processed photos.
+func BackfillRenditions(cfg *Config, db *sql.DB, store PhotoStore) (int, error) {
+	rows, err := db.Query(`
+		SELECT p.ID, p.imagePath
+		FROM photos p
+		WHERE NOT EXISTS (SELECT 1 FROM photo_renditions r WHERE r.photoID = p.ID)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		id  int64
+		key string
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		rows.Scan(&p.id, &p.key)
+		list = append(list, p)
+	}
+	rows.Close()
+
+	done := 0
+	for _, p := range list {
+		data, _, err := readObject(store, p.key)
+		if err == nil {
+			err = GenerateRenditions(cfg, db, store, p.id, p.key, bytes.NewReader(data))
+		}
+		if err != nil {
+			fmt.Printf("Rendition backfill failed for photo %d: %v\n", p.id, err)
+			continue
+		}
+		done++
+	}
+	return done, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPNG(t *testing.T, path string, w, h int) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	img := resizeImage(src, 100)
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+		t.Errorf("Expected 100x50, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	// No upscaling
+	img = resizeImage(src, 1000)
+	if img.Bounds().Dx() != 400 || img.Bounds().Dy() != 200 {
+		t.Errorf("Expected original size, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
+
+func TestRenditionKey(t *testing.T) {
+	if k := renditionKey("user/a.jpg", "thumb", "jpeg"); k != "user/a.thumb.jpg" {
+		t.Errorf("Unexpected jpeg rendition key %s", k)
+	}
+	if k := renditionKey("user/a.gif", "small", "gif"); k != "user/a.small.png" {
+		t.Errorf("Unexpected gif rendition key %s", k)
+	}
+}
+
+func TestBackfillRenditions(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Photos: PhotosConfig{
+			Directory:      dir,
+			RenditionSizes: map[string]int{"thumb": 32, "large": 128},
+		},
+		Admin: AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	store, _ := NewLocalPhotoStore(dir)
+	writeTestPNG(t, filepath.Join(dir, "photo.png"), 256, 64)
+	res, err := db.Exec("INSERT INTO photos (imagePath, imageIsPublic, userID) VALUES ('photo.png', 0, 1)")
+	if err != nil {
+		t.Fatalf("Failed to insert photo: %v", err)
+	}
+	photoID, _ := res.LastInsertId()
+
+	n, err := BackfillRenditions(cfg, db, store)
+	if err != nil {
+		t.Fatalf("BackfillRenditions failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 processed photo, got %d", n)
+	}
+
+	thumb, ok := FindRendition(db, photoID, "thumb")
+	if !ok {
+		t.Fatal("Expected thumb rendition")
+	}
+	f, err := os.Open(filepath.Join(dir, thumb))
+	if err != nil {
+		t.Fatalf("Rendition file missing: %v", err)
+	}
+	conf, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode rendition: %v", err)
+	}
+	if conf.Width != 32 || conf.Height != 8 {
+		t.Errorf("Expected 32x8 thumb, got %dx%d", conf.Width, conf.Height)
+	}
+
+	// Already processed photos are skipped
+	n, _ = BackfillRenditions(cfg, db, store)
+	if n != 0 {
+		t.Errorf("Expected no photos to backfill, got %d", n)
+	}
+
+	DeleteRenditions(db, store, photoID)
+	if _, err := store.Stat(thumb); err != ErrObjectNotFound {
+		t.Error("Expected rendition file to be removed")
+	}
+}
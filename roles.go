@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+const (
+	PermListUsers      = "list_users"
+	PermBanUsers       = "ban_users"
+	PermHidePhotos     = "hide_photos"
+	PermViewAllPhotos  = "view_all_photos"
+	PermManageRoles    = "manage_roles"
+	PermResetPasswords = "reset_passwords"
+)
+
+// defaultRoles are created on startup. Permissions added to the database by hand are kept.
+var defaultRoles = map[string][]string{
+	RoleUser:      {},
+	RoleModerator: {PermListUsers, PermBanUsers, PermHidePhotos, PermViewAllPhotos},
+	RoleAdmin:     {PermListUsers, PermBanUsers, PermHidePhotos, PermViewAllPhotos, PermManageRoles, PermResetPasswords},
+}
+
+var (
+	ErrUnknownRole = errors.New("unknown role")
+	ErrLastAdmin   = errors.New("cannot remove the last admin")
+)
+
+// initRoles creates the role tables, the default roles and moves users from the
+// isAdmin flag, which is no longer read, to roles.
+func initRoles(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY
+	);
+
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role, permission),
+		FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for role, perms := range defaultRoles {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO roles (name) VALUES (?)`, role); err != nil {
+			return err
+		}
+		for _, perm := range perms {
+			if _, err := db.Exec(`INSERT OR IGNORE INTO role_permissions (role, permission) VALUES (?, ?)`, role, perm); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := addColumnIfMissing(db, "users", "role", "TEXT"); err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE users SET role = CASE WHEN isAdmin != 0 THEN 'admin' ELSE 'user' END WHERE role IS NULL`)
+	return err
+}
+
+// RolePermissions returns the permission set of a role.
+func RolePermissions(db *sql.DB, role string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT permission FROM role_permissions WHERE role = ?`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perms := map[string]bool{}
+	for rows.Next() {
+		var perm string
+		if err := rows.Scan(&perm); err != nil {
+			return nil, err
+		}
+		perms[perm] = true
+	}
+	return perms, rows.Err()
+}
+
+func permissionList(perms map[string]bool) []string {
+	list := []string{}
+	for perm := range perms {
+		list = append(list, perm)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Can reports whether the role of the principal grants the permission.
+func (p *Principal) Can(permission string) bool {
+	return p != nil && p.Permissions[permission]
+}
+
+// RequirePermission authenticates the request and refuses users whose role lacks the permission.
+func RequirePermission(cfg *Config, db *sql.DB, permission string, next http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleware(cfg, db, func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFrom(r.Context())
+		if p.MFARequired {
+			writeAuthError(w, ErrMFARequired)
+			return
+		}
+		if !p.Can(permission) {
+			writeAuthError(w, ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetUserRole changes the role of a user. The last admin that is not banned cannot be demoted.
+func SetUserRole(db *sql.DB, login, role string) error {
+	var exists int
+	db.QueryRow(`SELECT COUNT(*) FROM roles WHERE name = ?`, role).Scan(&exists)
+	if exists == 0 {
+		return ErrUnknownRole
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow(`SELECT role FROM users WHERE login = ?`, login).Scan(&current); err != nil {
+		return err
+	}
+	if current == RoleAdmin && role != RoleAdmin {
+		var admins int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ? AND isBanned = 0`, RoleAdmin).Scan(&admins); err != nil {
+			return err
+		}
+		if admins <= 1 {
+			return ErrLastAdmin
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET role = ? WHERE login = ?`, role, login); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HandleManageRole promotes or demotes a user.
+func HandleManageRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ManageRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		switch err := SetUserRole(db, req.Login, req.Role); err {
+		case nil:
+		case ErrUnknownRole:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case ErrLastAdmin:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case sql.ErrNoRows:
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		default:
+			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"login":   req.Login,
+			"role":    req.Role,
+			"message": "Role updated",
+		})
+	}
+}
+
+// HandleGetRoles lists the roles with their permissions.
+func HandleGetRoles(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT name FROM roles ORDER BY name`)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			names = append(names, name)
+		}
+		rows.Close()
+
+		roles := []RoleResponse{}
+		for _, name := range names {
+			perms, err := RolePermissions(db, name)
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			roles = append(roles, RoleResponse{Name: name, Permissions: permissionList(perms)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roles)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetUserRole(t *testing.T) {
+	_, db, _ := testSessionServer(t)
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+
+	if err := SetUserRole(db, "testadmin", RoleUser); err != ErrLastAdmin {
+		t.Errorf("Expected last admin to be protected, got %v", err)
+	}
+	if err := SetUserRole(db, "user", "superuser"); err != ErrUnknownRole {
+		t.Errorf("Expected unknown role to be rejected, got %v", err)
+	}
+	if err := SetUserRole(db, "user", RoleAdmin); err != nil {
+		t.Fatalf("Promotion failed: %v", err)
+	}
+	if err := SetUserRole(db, "testadmin", RoleModerator); err != nil {
+		t.Errorf("Expected demotion with another admin left to succeed, got %v", err)
+	}
+
+	// A banned admin does not count
+	db.Exec(`UPDATE users SET role = 'admin', isBanned = 1 WHERE login = 'testadmin'`)
+	if err := SetUserRole(db, "user", RoleUser); err != ErrLastAdmin {
+		t.Errorf("Expected last active admin to be protected, got %v", err)
+	}
+
+	p, err := LoadPrincipal(db, 2)
+	if err != nil || !p.Can(PermManageRoles) || p.Can("unknown") {
+		t.Errorf("Unexpected permissions %+v, %v", p, err)
+	}
+}
+
+func TestModeratorPermissions(t *testing.T) {
+	cfg, db, mux := testSessionServer(t)
+	mux.HandleFunc("/api/users", RequirePermission(cfg, db, PermListUsers, HandleGetUsers(db)))
+	mux.HandleFunc("/api/manage-ban", RequirePermission(cfg, db, PermBanUsers, HandleManageBanStatus(db)))
+	mux.HandleFunc("/api/manage-role", RequirePermission(cfg, db, PermManageRoles, HandleManageRole(db)))
+	mux.HandleFunc("/api/toggle-public", AuthMiddleware(cfg, db, HandleTogglePhotoPublic(cfg, db)))
+	mux.HandleFunc("/api/photos/", HandleGetPhotos(cfg, db, nil))
+
+	RegisterUser(db, &User{Login: "mod", Password: "pass"})
+	RegisterUser(db, &User{Login: "user", Password: "pass"})
+	SetUserRole(db, "mod", RoleModerator)
+	db.Exec(`INSERT INTO photos (imagePath, originalName, imageIsPublic, userID) VALUES ('a', 'a.jpg', 1, 3), ('b', 'b.jpg', 0, 3)`)
+
+	mod, user := cookieJar{}, cookieJar{}
+	mod.do(mux, "POST", "/api/login", `{"login":"mod","password":"pass"}`)
+	user.do(mux, "POST", "/api/login", `{"login":"user","password":"pass"}`)
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	mod.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var listed []UserResponse
+	json.NewDecoder(rec.Body).Decode(&listed)
+	if rec.Code != http.StatusOK || len(listed) != 2 {
+		t.Errorf("Expected moderator to list the two non-admin users, got %d %+v", rec.Code, listed)
+	}
+	for _, u := range listed {
+		if u.Role == RoleAdmin {
+			t.Errorf("Expected admins not to be listed, got %+v", u)
+		}
+	}
+	if code := user.do(mux, "GET", "/api/users", ""); code != http.StatusForbidden {
+		t.Errorf("Expected user not to list users, got %d", code)
+	}
+	if code := mod.do(mux, "POST", "/api/manage-role", `{"login":"mod","role":"admin"}`); code != http.StatusForbidden {
+		t.Errorf("Expected moderator not to manage roles, got %d", code)
+	}
+	if code := mod.do(mux, "POST", "/api/manage-ban", `{"login":"testadmin","banned":1}`); code != http.StatusForbidden {
+		t.Errorf("Expected moderator not to ban an admin, got %d", code)
+	}
+
+	// Moderators can hide photos of others, but not publish them
+	if code := mod.do(mux, "POST", "/api/toggle-public", `{"id":2,"public":1}`); code != http.StatusForbidden {
+		t.Errorf("Expected moderator not to publish a photo, got %d", code)
+	}
+	if code := mod.do(mux, "POST", "/api/toggle-public", `{"id":1,"public":0}`); code != http.StatusOK {
+		t.Errorf("Expected moderator to hide a photo, got %d", code)
+	}
+	if code := user.do(mux, "POST", "/api/toggle-public", `{"id":1,"public":1}`); code != http.StatusOK {
+		t.Errorf("Expected owner to publish the photo again, got %d", code)
+	}
+
+	var page struct {
+		Total int `json:"total"`
+	}
+	if code := mod.getJSON(mux, "/api/photos/user", &page); code != http.StatusOK {
+		t.Fatalf("Listing failed with %d", code)
+	}
+	if page.Total != 2 {
+		t.Errorf("Expected moderator to see private photos, got %d", page.Total)
+	}
+	cookieJar{}.getJSON(mux, "/api/photos/user", &page)
+	if page.Total != 1 {
+		t.Errorf("Expected anonymous user to see public photos only, got %d", page.Total)
+	}
+
+	admin := cookieJar{}
+	admin.do(mux, "POST", "/api/login", `{"login":"testadmin","password":"testpass"}`)
+	if code := admin.do(mux, "POST", "/api/manage-role", `{"login":"testadmin","role":"user"}`); code != http.StatusConflict {
+		t.Errorf("Expected last admin demotion to conflict, got %d", code)
+	}
+	if code := admin.do(mux, "POST", "/api/manage-role", `{"login":"user","role":"moderator"}`); code != http.StatusOK {
+		t.Errorf("Expected promotion to succeed, got %d", code)
+	}
+	if code := user.do(mux, "GET", "/api/users", ""); code != http.StatusOK {
+		t.Errorf("Expected promoted user to list users with the same token, got %d", code)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTags           = 20
+	maxTagLength      = 50
+	maxTitleLength    = 200
+	maxDescLength     = 2000
+	defaultSearchSize = 20
+	maxSearchSize     = 100
+)
+
+// initSearchIndex creates the photos_fts full-text index. SQLite builds without FTS5
+// (go-sqlite3 needs the sqlite_fts5 build tag) fall back to LIKE matching in SearchPhotos,
+// the server only starts with such a build when search.allow_like_fallback is set.
+func initSearchIndex(db *sql.DB) error {
+	if hasSearchIndex(db) {
+		return nil
+	}
+	_, err := db.Exec(`CREATE VIRTUAL TABLE photos_fts USING fts5(title, description, tags, filename)`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			return nil
+		}
+		return err
+	}
+
+	// Index photos uploaded before the index existed
+	_, err = db.Exec(`
+		INSERT INTO photos_fts (rowid, title, description, tags, filename)
+		SELECT p.ID, p.title, p.description,
+			COALESCE((SELECT group_concat(tag, ' ') FROM photo_tags t WHERE t.photoID = p.ID), ''),
+			COALESCE(p.originalName, '')
+		FROM photos p`)
+	return err
+}
+
+// fts5Available reports whether the SQLite library was compiled with FTS5.
+func fts5Available(db *sql.DB) bool {
+	var used bool
+	err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used)
+	return err == nil && used
+}
+
+func hasSearchIndex(db *sql.DB) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'photos_fts'`).Scan(&n)
+	return n > 0
+}
+
+// indexPhoto refreshes the full-text entry of a photo, removing it when the photo is gone.
+func indexPhoto(db *sql.DB, photoID int64) error {
+	if !hasSearchIndex(db) {
+		return nil
+	}
+	if _, err := db.Exec(`DELETE FROM photos_fts WHERE rowid = ?`, photoID); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO photos_fts (rowid, title, description, tags, filename)
+		SELECT p.ID, p.title, p.description,
+			COALESCE((SELECT group_concat(tag, ' ') FROM photo_tags t WHERE t.photoID = p.ID), ''),
+			COALESCE(p.originalName, '')
+		FROM photos p WHERE p.ID = ?`, photoID)
+	return err
+}
+
+// normalizeTags lowercases and deduplicates tags. Tags are single words of letters,
+// digits, '-' and '_'.
+func normalizeTags(tags []string) ([]string, bool) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, false
+		}
+		for _, c := range tag {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+				return nil, false
+			}
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out, len(out) <= maxTags
+}
+
+// SetPhotoDetails replaces the title, description and tags of a photo.
+func SetPhotoDetails(db *sql.DB, photoID int64, title, description string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE photos SET title = ?, description = ? WHERE ID = ?`, title, description, photoID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM photo_tags WHERE photoID = ?`, photoID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(`INSERT INTO photo_tags (photoID, tag) VALUES (?, ?)`, photoID, tag); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return indexPhoto(db, photoID)
+}
+
+// GetPhotoTags returns the tags of a photo in alphabetical order.
+func GetPhotoTags(db *sql.DB, photoID int64) []string {
+	tags := []string{}
+	rows, err := db.Query(`SELECT tag FROM photo_tags WHERE photoID = ? ORDER BY tag`, photoID)
+	if err != nil {
+		return tags
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func validatePhotoDetails(req *PhotoDetailsRequest) (string, bool) {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Title) > maxTitleLength || len(req.Description) > maxDescLength {
+		return "Title or description too long", false
+	}
+	tags, ok := normalizeTags(req.Tags)
+	if !ok {
+		return "Invalid tags", false
+	}
+	req.Tags = tags
+	return "", true
+}
+
+// HandleUpdatePhotoDetails sets the title, description and tags of an own photo.
+func HandleUpdatePhotoDetails(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := PrincipalFrom(r.Context()).ID
+
+		var req PhotoDetailsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if msg, ok := validatePhotoDetails(&req); !ok {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		var ownerID int64
+		err := db.QueryRow(`SELECT userID FROM photos WHERE ID = ?`, req.ID).Scan(&ownerID)
+		if err != nil || ownerID != userID {
+			http.Error(w, "Forbidden or not found", http.StatusForbidden)
+			return
+		}
+
+		if err := SetPhotoDetails(db, req.ID, req.Title, req.Description, req.Tags); err != nil {
+			http.Error(w, "Failed to update photo", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "Photo updated",
+			"id":      req.ID,
+			"tags":    req.Tags,
+		})
+	}
+}
+
+// ftsQuery turns user input into an FTS5 query matching every word as a prefix.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchPhotos finds photos matching the query and carrying every given tag among the
+// viewer's own photos and public photos of users that are not banned.
+func SearchPhotos(db *sql.DB, viewerID int64, q string, tags []string, limit, offset int) ([]SearchResult, int, error) {
+	from := `FROM photos p JOIN users u ON p.userID = u.ID`
+	where := []string{`(p.userID = ? OR (p.imageIsPublic = 1 AND u.isBanned = 0))`}
+	args := []any{viewerID}
+	order := `p.ID DESC`
+
+	if strings.TrimSpace(q) != "" {
+		if hasSearchIndex(db) {
+			from += ` JOIN photos_fts f ON f.rowid = p.ID`
+			where = append(where, `photos_fts MATCH ?`)
+			args = append(args, ftsQuery(q))
+			order = `f.rank, p.ID DESC`
+		} else {
+			for _, word := range strings.Fields(q) {
+				pattern := "%" + escapeLike(word) + "%"
+				where = append(where, `(p.title LIKE ? ESCAPE '\' OR p.description LIKE ? ESCAPE '\' OR p.originalName LIKE ? ESCAPE '\'
+					OR EXISTS (SELECT 1 FROM photo_tags t WHERE t.photoID = p.ID AND t.tag LIKE ? ESCAPE '\'))`)
+				args = append(args, pattern, pattern, pattern, pattern)
+			}
+		}
+	}
+	for _, tag := range tags {
+		where = append(where, `EXISTS (SELECT 1 FROM photo_tags t WHERE t.photoID = p.ID AND t.tag = ?)`)
+		args = append(args, tag)
+	}
+	cond := ` WHERE ` + strings.Join(where, ` AND `)
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) `+from+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT p.ID, u.login, p.originalName, p.title, p.description, p.imageIsPublic,
+			COALESCE((SELECT group_concat(tag, ',') FROM photo_tags t WHERE t.photoID = p.ID), '')
+		`+from+cond+` ORDER BY `+order+` LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		var imageIsPublic int
+		var tagList string
+		if err := rows.Scan(&res.ID, &res.User, &res.Filename, &res.Title, &res.Description, &imageIsPublic, &tagList); err != nil {
+			return nil, 0, err
+		}
+		res.Public = imageIsPublic != 0
+		res.Tags = []string{}
+		if tagList != "" {
+			res.Tags = strings.Split(tagList, ",")
+		}
+		results = append(results, res)
+	}
+	return results, total, rows.Err()
+}
+
+// HandleSearch serves /api/search?q=...&tag=...&limit=...&offset=...
+// Anonymous callers only search public photos.
+func HandleSearch(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		tags, ok := normalizeTags(query["tag"])
+		if !ok {
+			http.Error(w, "Invalid tags", http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultSearchSize
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxSearchSize {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		offset := 0
+		if v := query.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
+
+		viewerID, _ := requestUserID(cfg, db, r)
+		results, total, err := SearchPhotos(db, viewerID, query.Get("q"), tags, limit, offset)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"items":  results,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	}
+}
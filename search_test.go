@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, ok := normalizeTags([]string{" Beach", "beach", "", "sea_side", "góry"})
+	if !ok || len(tags) != 3 || tags[0] != "beach" || tags[1] != "sea_side" || tags[2] != "góry" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+	if _, ok := normalizeTags([]string{"two words"}); ok {
+		t.Error("Expected tag with a space to be rejected")
+	}
+}
+
+func TestSearchPhotos(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		JWT:      JWTConfig{SecretKey: "test_secret_key_for_jwt", TimeoutMinutes: 15},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	if fts5Available(db) != hasSearchIndex(db) {
+		t.Fatalf("Expected the full-text index exactly when FTS5 is available (FTS5: %v)", fts5Available(db))
+	}
+	RegisterUser(db, &User{Login: "other", Password: "pass"})
+	RegisterUser(db, &User{Login: "banned", Password: "pass"})
+	db.Exec(`UPDATE users SET isBanned = 1 WHERE login = 'banned'`)
+
+	db.Exec(`INSERT INTO photos (imagePath, originalName, imageIsPublic, userID) VALUES
+		('a', 'sunset.jpg', 0, 1),
+		('b', 'IMG_1.jpg', 1, 2),
+		('c', 'IMG_2.jpg', 0, 2),
+		('d', 'IMG_3.jpg', 1, 3)`)
+	SetPhotoDetails(db, 1, "Sunset at the beach", "", []string{"beach", "holiday"})
+	SetPhotoDetails(db, 2, "Beach volleyball", "Match on the beach", []string{"beach", "sport"})
+	SetPhotoDetails(db, 3, "Private beach", "", []string{"beach"})
+	SetPhotoDetails(db, 4, "Beach of a banned user", "", []string{"beach"})
+
+	ids := func(results []SearchResult) []int64 {
+		var out []int64
+		for _, r := range results {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+
+	// Own photos and public photos of other users, never private or banned ones
+	results, total, err := SearchPhotos(db, 1, "beach", nil, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchPhotos failed: %v", err)
+	}
+	if total != 2 || len(results) != 2 {
+		t.Errorf("Expected photos 1 and 2, got %v", ids(results))
+	}
+
+	results, _, _ = SearchPhotos(db, 1, "volley", nil, 10, 0)
+	if len(results) != 1 || results[0].ID != 2 || results[0].User != "other" {
+		t.Errorf("Expected prefix match on photo 2, got %v", ids(results))
+	}
+
+	results, _, _ = SearchPhotos(db, 1, "", []string{"beach", "holiday"}, 10, 0)
+	if len(results) != 1 || results[0].ID != 1 || len(results[0].Tags) != 2 {
+		t.Errorf("Expected tag filter to match photo 1, got %+v", results)
+	}
+
+	results, _, _ = SearchPhotos(db, 1, "sunset.jpg", nil, 10, 0)
+	if len(results) != 1 || results[0].ID != 1 {
+		t.Errorf("Expected filename match, got %v", ids(results))
+	}
+
+	results, total, _ = SearchPhotos(db, 1, "beach", nil, 1, 1)
+	if total != 2 || len(results) != 1 {
+		t.Errorf("Expected second page with one of two results, got %d of %d", len(results), total)
+	}
+
+	// Anonymous search only sees public photos
+	req := httptest.NewRequest("GET", "/api/search?q=beach", nil)
+	rec := httptest.NewRecorder()
+	HandleSearch(cfg, db)(rec, req)
+	var body struct {
+		Items []SearchResult `json:"items"`
+		Total int            `json:"total"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusOK || body.Total != 1 || body.Items[0].ID != 2 {
+		t.Errorf("Expected only photo 2 for anonymous search, got %d %+v", rec.Code, body)
+	}
+
+	store, _ := NewLocalPhotoStore(t.TempDir())
+	DeletePhoto(db, store, 2)
+	results, _, _ = SearchPhotos(db, 1, "volleyball", nil, 10, 0)
+	if len(results) != 0 {
+		t.Errorf("Expected deleted photo to leave the index, got %v", ids(results))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Every login opens a session. The session ID is carried as the jti claim of the
+// short-lived access token (jwt cookie), the long-lived refresh token (refresh_token
+// cookie) is "<session ID>.<secret>" and the secret is replaced on every refresh.
+
+const (
+	refreshCookie      = "refresh_token"
+	defaultRefreshDays = 30
+	sessionTimeLayout  = "2006-01-02T15:04:05Z"
+)
+
+var (
+	ErrInvalidSession = errors.New("invalid or expired session")
+	ErrTokenReuse     = errors.New("refresh token reused, session revoked")
+)
+
+func (j JWTConfig) RefreshTimeout() time.Duration {
+	if j.RefreshDays <= 0 {
+		return defaultRefreshDays * 24 * time.Hour
+	}
+	return time.Duration(j.RefreshDays) * 24 * time.Hour
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession opens a session for the user and returns its ID and refresh token.
+func CreateSession(cfg *Config, db *sql.DB, userID int64, userAgent string) (string, string, error) {
+	now := time.Now().UTC()
+	db.Exec(`DELETE FROM sessions WHERE userID = ? AND expiresAt < ?`, userID, now.Format(sessionTimeLayout))
+
+	id := randomToken(16)
+	secret := randomToken(32)
+	_, err := db.Exec(`INSERT INTO sessions (ID, userID, refreshHash, userAgent, createdAt, lastUsedAt, expiresAt, revoked) VALUES (?, ?, ?, ?, ?, ?, ?, 0)`,
+		id, userID, hashToken(secret), userAgent, now.Format(sessionTimeLayout), now.Format(sessionTimeLayout),
+		now.Add(cfg.JWT.RefreshTimeout()).Format(sessionTimeLayout))
+	if err != nil {
+		return "", "", err
+	}
+	return id, id + "." + secret, nil
+}
+
+// SessionActive reports whether the session exists, belongs to the user and was not
+// revoked or expired.
+func SessionActive(db *sql.DB, sessionID string, userID int64) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE ID = ? AND userID = ? AND revoked = 0 AND expiresAt > ?`,
+		sessionID, userID, time.Now().UTC().Format(sessionTimeLayout)).Scan(&n)
+	return n > 0
+}
+
+// RotateSession checks the refresh token and replaces its secret. Presenting an old
+// secret means the token was copied, the whole session is revoked then.
+func RotateSession(cfg *Config, db *sql.DB, refreshToken string) (string, int64, string, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return "", 0, "", ErrInvalidSession
+	}
+
+	var userID int64
+	var hash, expiresAt string
+	var revoked int
+	err := db.QueryRow(`SELECT userID, refreshHash, expiresAt, revoked FROM sessions WHERE ID = ?`, id).Scan(&userID, &hash, &expiresAt, &revoked)
+	if err != nil || revoked != 0 {
+		return "", 0, "", ErrInvalidSession
+	}
+	now := time.Now().UTC()
+	if expiresAt <= now.Format(sessionTimeLayout) {
+		return "", 0, "", ErrInvalidSession
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(secret))) != 1 {
+		RevokeSession(db, id)
+		return "", 0, "", ErrTokenReuse
+	}
+
+	newSecret := randomToken(32)
+	res, err := db.Exec(`UPDATE sessions SET refreshHash = ?, lastUsedAt = ? WHERE ID = ? AND refreshHash = ?`,
+		hashToken(newSecret), now.Format(sessionTimeLayout), id, hash)
+	if err != nil {
+		return "", 0, "", err
+	}
+	// A concurrent refresh with the same token already rotated it
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", 0, "", ErrInvalidSession
+	}
+	return id, userID, id + "." + newSecret, nil
+}
+
+// VerifyRefreshToken returns the session of a refresh token whose secret is current,
+// without rotating it. A wrong secret does not revoke the session here.
+func VerifyRefreshToken(db *sql.DB, refreshToken string) (string, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return "", ErrInvalidSession
+	}
+	var hash string
+	err := db.QueryRow(`SELECT refreshHash FROM sessions WHERE ID = ? AND revoked = 0`, id).Scan(&hash)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(secret))) != 1 {
+		return "", ErrInvalidSession
+	}
+	return id, nil
+}
+
+func RevokeSession(db *sql.DB, sessionID string) error {
+	_, err := db.Exec(`UPDATE sessions SET revoked = 1 WHERE ID = ?`, sessionID)
+	return err
+}
+
+// RevokeUserSessions logs the user out on every device.
+func RevokeUserSessions(db *sql.DB, userID int64) error {
+	_, err := db.Exec(`UPDATE sessions SET revoked = 1 WHERE userID = ?`, userID)
+	return err
+}
+
+// setAuthCookies sends a new access token for the session together with its refresh
+// token and a new CSRF token, which is also returned.
+func setAuthCookies(w http.ResponseWriter, cfg *Config, userID int64, userLogin, sessionID, refreshToken string) (string, error) {
+	csrfToken := randomToken(32)
+	token, err := GenerateJWT(cfg, userID, userLogin, sessionID, csrfToken)
+	if err != nil {
+		return "", err
+	}
+	c := cfg.Cookies
+	http.SetCookie(w, c.newCookie(jwtCookie, token, "/", 0, true, 0))
+	http.SetCookie(w, c.newCookie(csrfCookie, csrfToken, "/", 0, false, 0))
+	http.SetCookie(w, c.newCookie(refreshCookie, refreshToken, "/api", int(cfg.JWT.RefreshTimeout().Seconds()), true, http.SameSiteStrictMode))
+	return csrfToken, nil
+}
+
+func clearAuthCookies(w http.ResponseWriter, cfg *Config) {
+	c := cfg.Cookies
+	http.SetCookie(w, c.newCookie(jwtCookie, "", "/", -1, true, 0))
+	http.SetCookie(w, c.newCookie(csrfCookie, "", "/", -1, false, 0))
+	http.SetCookie(w, c.newCookie(refreshCookie, "", "/api", -1, true, http.SameSiteStrictMode))
+}
+
+// HandleRefresh reissues the jwt cookie using the refresh token cookie.
+func HandleRefresh(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cookie, err := r.Cookie(cfg.Cookies.cookieName(refreshCookie, "/api"))
+		if err != nil {
+			writeAuthError(w, ErrUnauthenticated)
+			return
+		}
+
+		sessionID, userID, refreshToken, err := RotateSession(cfg, db, cookie.Value)
+		if err != nil {
+			clearAuthCookies(w, cfg)
+			writeAuthError(w, ErrUnauthenticated)
+			return
+		}
+
+		principal, err := LoadPrincipal(db, userID)
+		if err != nil {
+			RevokeSession(db, sessionID)
+			clearAuthCookies(w, cfg)
+			writeAuthError(w, err)
+			return
+		}
+
+		csrfToken, err := setAuthCookies(w, cfg, userID, principal.Login, sessionID, refreshToken)
+		if err != nil {
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "csrfToken": csrfToken})
+	}
+}
+
+// HandleLogout revokes the session of the request, identified by the refresh token
+// or, when it is missing, by the access token. The CSRF token is required, so other
+// sites cannot log users out, and a refresh token only revokes its session when its
+// secret is current.
+func HandleLogout(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := checkCSRFCookie(cfg, r); err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		if cookie, err := r.Cookie(cfg.Cookies.cookieName(refreshCookie, "/api")); err == nil {
+			if id, err := VerifyRefreshToken(db, cookie.Value); err == nil {
+				RevokeSession(db, id)
+			}
+		} else if tokenStr, err := getJWTFromCookie(cfg, r); err == nil {
+			if claims, err := parseJWT(cfg, tokenStr); err == nil {
+				if jti, ok := claims["jti"].(string); ok {
+					RevokeSession(db, jti)
+				}
+			}
+		}
+
+		clearAuthCookies(w, cfg)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+// HandleLogoutAll revokes every session of the logged in user.
+func HandleLogoutAll(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := PrincipalFrom(r.Context()).ID
+		if err := RevokeUserSessions(db, userID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		clearAuthCookies(w, cfg)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
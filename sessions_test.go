@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testSessionServer(t *testing.T) (*Config, *sql.DB, *http.ServeMux) {
+	cfg, db, mux, _ := testLoginServer(t, systemClock{})
+	return cfg, db, mux
+}
+
+// testLoginServer serves the login endpoints with throttling driven by the clock.
+func testLoginServer(t *testing.T, clock Clock) (*Config, *sql.DB, *http.ServeMux, *LoginLimiter) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		JWT:      JWTConfig{SecretKey: "test_secret_key_for_jwt", TimeoutMinutes: 15},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	limiter := NewLoginLimiter(db, cfg.Login, clock)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", HandleLogin(cfg, db, limiter))
+	mux.HandleFunc("/api/login/mfa", HandleLoginMFA(cfg, db, limiter))
+	mux.HandleFunc("/api/refresh", HandleRefresh(cfg, db))
+	mux.HandleFunc("/api/logout", HandleLogout(cfg, db))
+	mux.HandleFunc("/api/logout-all", AuthMiddleware(cfg, db, HandleLogoutAll(cfg, db)))
+	mux.HandleFunc("/api/me", AuthMiddleware(cfg, db, func(w http.ResponseWriter, r *http.Request) {}))
+	return cfg, db, mux, limiter
+}
+
+// cookieJar keeps the cookies set by responses, like a browser would.
+type cookieJar map[string]string
+
+// attach adds the cookies to the request and, like the frontend, repeats the CSRF token
+// in the header.
+func (j cookieJar) attach(req *http.Request) {
+	for name, value := range j {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+		if strings.HasSuffix(name, csrfCookie) {
+			req.Header.Set(CSRFHeader, value)
+		}
+	}
+}
+
+func (j cookieJar) do(mux *http.ServeMux, method, url, body string) int {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	j.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(j, c.Name)
+		} else {
+			j[c.Name] = c.Value
+		}
+	}
+	return rec.Code
+}
+
+func (j cookieJar) getJSON(mux *http.ServeMux, url string, out any) int {
+	req := httptest.NewRequest("GET", url, nil)
+	j.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	json.NewDecoder(rec.Body).Decode(out)
+	return rec.Code
+}
+
+func (j cookieJar) clone() cookieJar {
+	c := cookieJar{}
+	for k, v := range j {
+		c[k] = v
+	}
+	return c
+}
+
+func TestSessionRefreshAndLogout(t *testing.T) {
+	_, _, mux := testSessionServer(t)
+	login := `{"login":"testadmin","password":"testpass"}`
+
+	jar := cookieJar{}
+	if code := jar.do(mux, "POST", "/api/login", login); code != http.StatusOK {
+		t.Fatalf("Login failed with %d", code)
+	}
+	if jar["jwt"] == "" || jar[refreshCookie] == "" {
+		t.Fatalf("Expected jwt and refresh cookies, got %v", jar)
+	}
+
+	oldRefresh := jar[refreshCookie]
+	if code := jar.do(mux, "POST", "/api/refresh", ""); code != http.StatusOK {
+		t.Fatalf("Refresh failed with %d", code)
+	}
+	if jar[refreshCookie] == oldRefresh {
+		t.Error("Expected refresh token to be rotated")
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected refreshed token to be accepted, got %d", code)
+	}
+
+	// Replaying the old refresh token revokes the session
+	stolen := cookieJar{refreshCookie: oldRefresh}
+	if code := stolen.do(mux, "POST", "/api/refresh", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected reused refresh token to be rejected, got %d", code)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected access token of revoked session to be rejected, got %d", code)
+	}
+
+	jar = cookieJar{}
+	jar.do(mux, "POST", "/api/login", login)
+
+	// A cross-site form post carries the cookies but not the CSRF header
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	for name, value := range jar {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected logout without the CSRF header to be refused, got %d", rec.Code)
+	}
+
+	// An old refresh secret does not log the session out
+	stale := jar.clone()
+	jar.do(mux, "POST", "/api/refresh", "")
+	stale[csrfCookie] = jar[csrfCookie]
+	if code := stale.do(mux, "POST", "/api/logout", ""); code != http.StatusOK {
+		t.Errorf("Expected logout to answer ok, got %d", code)
+	}
+	if code := jar.do(mux, "GET", "/api/me", ""); code != http.StatusOK {
+		t.Errorf("Expected session to survive a logout with an old refresh token, got %d", code)
+	}
+
+	before := jar.clone()
+	if code := jar.do(mux, "POST", "/api/logout", ""); code != http.StatusOK {
+		t.Fatalf("Logout failed with %d", code)
+	}
+	if _, ok := jar["jwt"]; ok {
+		t.Error("Expected logout to clear the jwt cookie")
+	}
+	if code := before.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected access token to be rejected after logout, got %d", code)
+	}
+	if code := before.do(mux, "POST", "/api/refresh", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected refresh to fail after logout, got %d", code)
+	}
+}
+
+func TestLogoutAllDevices(t *testing.T) {
+	_, _, mux := testSessionServer(t)
+	login := `{"login":"testadmin","password":"testpass"}`
+
+	laptop, phone := cookieJar{}, cookieJar{}
+	laptop.do(mux, "POST", "/api/login", login)
+	phone.do(mux, "POST", "/api/login", login)
+
+	if code := laptop.do(mux, "POST", "/api/logout-all", ""); code != http.StatusOK {
+		t.Fatalf("Logout of all devices failed with %d", code)
+	}
+	if code := phone.do(mux, "GET", "/api/me", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected other device to be logged out, got %d", code)
+	}
+	if code := phone.do(mux, "POST", "/api/refresh", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected other device not to refresh, got %d", code)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrInvalidKey     = errors.New("invalid storage key")
+)
+
+// PhotoStore keeps photo files under slash separated keys, e.g. "login/<key>.jpg".
+type PhotoStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(key string) error
+	Stat(key string) (ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+func NewPhotoStore(cfg *Config) (PhotoStore, error) {
+	switch cfg.Storage.Backend {
+	case "", "local":
+		return NewLocalPhotoStore(cfg.Photos.Directory)
+	case "s3":
+		if cfg.Storage.S3 == nil {
+			return nil, errors.New("storage backend s3 requires the s3 section")
+		}
+		return NewS3PhotoStore(*cfg.Storage.S3), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/") && filepath.IsLocal(filepath.FromSlash(key))
+}
+
+// LocalPhotoStore keeps the files in a directory on the local disk.
+type LocalPhotoStore struct {
+	root string
+}
+
+func NewLocalPhotoStore(root string) (*LocalPhotoStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &LocalPhotoStore{root: root}, nil
+}
+
+func (s *LocalPhotoStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so readers never see partially written photos.
+func (s *LocalPhotoStore) Put(key string, r io.Reader, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalPhotoStore) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalPhotoStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalPhotoStore) Stat(key string) (ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalPhotoStore) List(prefix string) ([]ObjectInfo, error) {
+	var list []ObjectInfo
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		list = append(list, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return list, err
+}
+
+// readObject loads a whole object into memory.
+func readObject(store PhotoStore, key string) ([]byte, ObjectInfo, error) {
+	rc, info, err := store.Get(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return data, info, err
+}
+
+// servePhoto writes a stored photo to the response. When transform is set the
+// content is loaded into memory and served transformed.
+func servePhoto(w http.ResponseWriter, r *http.Request, store PhotoStore, key string, transform func([]byte) ([]byte, error)) error {
+	rc, info, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if rs, ok := rc.(io.ReadSeeker); ok && transform == nil {
+		http.ServeContent(w, r, path.Base(key), info.ModTime, rs)
+		return nil
+	}
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if transform != nil {
+		if data, err = transform(data); err != nil {
+			return err
+		}
+	}
+	http.ServeContent(w, r, path.Base(key), info.ModTime, bytes.NewReader(data))
+	return nil
+}
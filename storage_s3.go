@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3PhotoStore talks to an S3-compatible object storage (AWS S3, MinIO, Ceph, ...)
+// using path-style requests signed with AWS Signature Version 4.
+type S3PhotoStore struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+const defaultS3TimeoutSeconds = 60
+
+func (c S3Config) timeout() time.Duration {
+	if c.TimeoutSeconds <= 0 {
+		return defaultS3TimeoutSeconds * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// NewS3PhotoStore returns a store whose requests give up after the configured timeout,
+// so an unresponsive endpoint cannot hang handlers and background jobs.
+func NewS3PhotoStore(cfg S3Config) *S3PhotoStore {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &S3PhotoStore{cfg: cfg, client: &http.Client{Timeout: cfg.timeout()}, now: time.Now}
+}
+
+// awsURIEncode percent-encodes everything except the RFC 3986 unreserved characters,
+// as required by the canonical request.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *S3PhotoStore) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.cfg.Endpoint, "/"), s.cfg.Bucket, awsURIEncode(s.cfg.Prefix+key, false))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 adds the AWS Signature Version 4 headers to the request. The host, Range and
+// all x-amz-* headers are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3PhotoStore) do(method, rawURL string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signV4(req, sha256Hex(body), s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, s.now())
+	return s.client.Do(req)
+}
+
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func objectInfoFromHeader(key string, h http.Header) ObjectInfo {
+	info := ObjectInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(h.Get("Last-Modified"))
+	return info
+}
+
+// Put buffers the object in memory, the payload hash has to be known before sending.
+func (s *S3PhotoStore) Put(key string, r io.Reader, contentType string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(http.MethodPut, s.objectURL(key), body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3PhotoStore) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	if !validKey(key) {
+		return nil, ObjectInfo{}, ErrInvalidKey
+	}
+	resp, err := s.do(http.MethodGet, s.objectURL(key), nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, ObjectInfo{}, s3Error(resp)
+	}
+	return resp.Body, objectInfoFromHeader(key, resp.Header), nil
+}
+
+func (s *S3PhotoStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	resp, err := s.do(http.MethodDelete, s.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3PhotoStore) Stat(key string) (ObjectInfo, error) {
+	if !validKey(key) {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+	resp, err := s.do(http.MethodHead, s.objectURL(key), nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, s3Error(resp)
+	}
+	return objectInfoFromHeader(key, resp.Header), nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3PhotoStore) List(prefix string) ([]ObjectInfo, error) {
+	var list []ObjectInfo
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.cfg.Prefix+prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := fmt.Sprintf("%s/%s?%s", strings.TrimRight(s.cfg.Endpoint, "/"), s.cfg.Bucket, q.Encode())
+
+		resp, err := s.do(http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			list = append(list, ObjectInfo{Key: strings.TrimPrefix(c.Key, s.cfg.Prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return list, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
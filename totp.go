@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238): SHA-1,
+// 6 digits, 30 second steps, accepting one step of clock drift in either direction.
+
+const (
+	totpDigits         = 6
+	totpPeriod         = 30
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	mfaTokenTTL        = 5 * time.Minute
+	defaultTOTPIssuer  = "PhotoManager"
+	mfaTokenPurpose    = "mfa"
+	recoveryCodeLength = 10
+)
+
+var (
+	ErrMFARequired    = errors.New("two-factor authentication required for this account")
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+	ErrMFAEnabled     = errors.New("two-factor authentication already enabled")
+	ErrMFANotEnabled  = errors.New("two-factor authentication not enabled")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (m MFAConfig) TOTPIssuer() string {
+	if m.Issuer == "" {
+		return defaultTOTPIssuer
+	}
+	return m.Issuer
+}
+
+// totpCode computes the HOTP value (RFC 4226) of the counter.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code is valid for.
+func matchTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(now.Unix() / totpPeriod)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := current + uint64(i)
+		if hmac.Equal([]byte(totpCode(secret, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(issuer, login, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(login)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPEnabled reports whether the user has confirmed a TOTP enrollment.
+func TOTPEnabled(db *sql.DB, userID int64) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM user_totp WHERE userID = ? AND confirmed = 1`, userID).Scan(&n)
+	return n > 0
+}
+
+// BeginTOTPEnrollment stores a new unconfirmed secret for the user and returns it base32 encoded.
+func BeginTOTPEnrollment(db *sql.DB, userID int64) (string, error) {
+	if TOTPEnabled(db, userID) {
+		return "", ErrMFAEnabled
+	}
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := base32NoPad.EncodeToString(raw)
+	_, err := db.Exec(`INSERT OR REPLACE INTO user_totp (userID, secret, confirmed, lastCounter) VALUES (?, ?, 0, 0)`, userID, secret)
+	return secret, err
+}
+
+// verifyTOTP checks the code against the secret of the user. A code is accepted only
+// once, later steps must be used for further logins.
+func verifyTOTP(db *sql.DB, userID int64, code string, now time.Time, confirmed bool) error {
+	var secret string
+	var lastCounter int64
+	err := db.QueryRow(`SELECT secret, lastCounter FROM user_totp WHERE userID = ? AND confirmed = ?`, userID, boolInt(confirmed)).Scan(&secret, &lastCounter)
+	if err != nil {
+		return ErrMFANotEnabled
+	}
+	raw, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := matchTOTP(raw, strings.TrimSpace(code), now)
+	if !ok || int64(counter) <= lastCounter {
+		return ErrInvalidMFACode
+	}
+	res, err := db.Exec(`UPDATE user_totp SET lastCounter = ? WHERE userID = ? AND lastCounter < ?`, counter, userID, counter)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication once the user proves the
+// authenticator app works and returns fresh recovery codes.
+func ConfirmTOTPEnrollment(db *sql.DB, userID int64, code string, now time.Time) ([]string, error) {
+	if TOTPEnabled(db, userID) {
+		return nil, ErrMFAEnabled
+	}
+	if err := verifyTOTP(db, userID, code, now, false); err != nil {
+		return nil, err
+	}
+	codes, err := generateRecoveryCodes(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`UPDATE user_totp SET confirmed = 1 WHERE userID = ?`, userID)
+	return codes, err
+}
+
+// DisableTOTP removes the enrollment and the recovery codes of the user.
+func DisableTOTP(db *sql.DB, userID int64) error {
+	if _, err := db.Exec(`DELETE FROM recovery_codes WHERE userID = ?`, userID); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM user_totp WHERE userID = ?`, userID)
+	return err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user. Only bcrypt hashes
+// are stored, like passwords.
+func generateRecoveryCodes(db *sql.DB, userID int64) ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+	if _, err := db.Exec(`DELETE FROM recovery_codes WHERE userID = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		for j := range raw {
+			raw[j] = alphabet[int(raw[j])%len(alphabet)]
+		}
+		code := string(raw[:5]) + "-" + string(raw[5:])
+
+		hash, err := HashPassword(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(`INSERT INTO recovery_codes (userID, codeHash, used) VALUES (?, ?, 0)`, userID, hash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// useRecoveryCode accepts each recovery code once.
+func useRecoveryCode(db *sql.DB, userID int64, code string) bool {
+	rows, err := db.Query(`SELECT ID, codeHash FROM recovery_codes WHERE userID = ? AND used = 0`, userID)
+	if err != nil {
+		return false
+	}
+	type stored struct {
+		id   int64
+		hash string
+	}
+	var list []stored
+	for rows.Next() {
+		var s stored
+		rows.Scan(&s.id, &s.hash)
+		list = append(list, s)
+	}
+	rows.Close()
+
+	code = normalizeRecoveryCode(code)
+	for _, s := range list {
+		if verifyPasswordHash(s.hash, code) {
+			res, err := db.Exec(`UPDATE recovery_codes SET used = 1 WHERE ID = ? AND used = 0`, s.id)
+			if err != nil {
+				return false
+			}
+			n, _ := res.RowsAffected()
+			return n > 0
+		}
+	}
+	return false
+}
+
+// VerifySecondFactor accepts a current TOTP code or an unused recovery code.
+func VerifySecondFactor(db *sql.DB, userID int64, code string, now time.Time) error {
+	err := verifyTOTP(db, userID, code, now, true)
+	if err == ErrInvalidMFACode && useRecoveryCode(db, userID, code) {
+		return nil
+	}
+	return err
+}
+
+// GenerateMFAToken issues the short-lived token proving the first step of a login, the
+// password or, with sso set, a login through the identity provider. It has no session,
+// so it is never accepted as an access token.
+func GenerateMFAToken(cfg *Config, userID int64, sso bool) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"purpose": mfaTokenPurpose,
+		"exp":     time.Now().Add(mfaTokenTTL).Unix(),
+	}
+	if sso {
+		claims["sso"] = true
+	}
+	return signToken(cfg, claims)
+}
+
+// parseMFAToken returns the user of the token and whether the first step was single sign-on.
+func parseMFAToken(cfg *Config, tokenStr string) (int64, bool, bool) {
+	claims, err := parseJWT(cfg, tokenStr)
+	if err != nil || claims["purpose"] != mfaTokenPurpose {
+		return 0, false, false
+	}
+	userID, ok := claims["user_id"].(float64)
+	sso, _ := claims["sso"].(bool)
+	return int64(userID), sso, ok
+}
+
+// HandleLoginMFA completes a login of a user with two-factor authentication.
+func HandleLoginMFA(cfg *Config, db *sql.DB, limiter *LoginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req MFALoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		userID, sso, ok := parseMFAToken(cfg, req.MFAToken)
+		if !ok {
+			writeAuthError(w, ErrUnauthenticated)
+			return
+		}
+		principal, err := LoadPrincipal(db, userID)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		// Wrong codes count as failed logins, so codes cannot be guessed
+		attempt, wait, err := limiter.Reserve(clientIP(r), principal.Login)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		if err := VerifySecondFactor(db, userID, req.Code, time.Now()); err != nil {
+			http.Error(w, ErrInvalidMFACode.Error(), http.StatusUnauthorized)
+			return
+		}
+		attempt.Succeed()
+
+		completeLogin(w, r, cfg, db, principal, sso)
+	}
+}
+
+// HandleTOTPSetup starts the enrollment and returns the secret for the authenticator app.
+func HandleTOTPSetup(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		principal := PrincipalFrom(r.Context())
+		secret, err := BeginTOTPEnrollment(db, principal.ID)
+		if err == ErrMFAEnabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":     secret,
+			"otpauthUri": totpURI(cfg.MFA.TOTPIssuer(), principal.Login, secret),
+		})
+	}
+}
+
+// HandleTOTPConfirm enables two-factor authentication with a first valid code and
+// returns the recovery codes, which are shown only this once.
+func HandleTOTPConfirm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := ConfirmTOTPEnrollment(db, PrincipalFrom(r.Context()).ID, req.Code, time.Now())
+		switch err {
+		case nil:
+		case ErrMFAEnabled:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case ErrInvalidMFACode, ErrMFANotEnabled:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"message":       "Two-factor authentication enabled",
+			"recoveryCodes": codes,
+		})
+	}
+}
+
+// HandleTOTPDisable turns two-factor authentication off after checking a current code.
+func HandleTOTPDisable(cfg *Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		principal := PrincipalFrom(r.Context())
+		if cfg.MFA.RequireForAdmins && principal.Role == RoleAdmin {
+			http.Error(w, ErrMFARequired.Error(), http.StatusForbidden)
+			return
+		}
+		if err := VerifySecondFactor(db, principal.ID, req.Code, time.Now()); err != nil {
+			http.Error(w, ErrInvalidMFACode.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := DisableTOTP(db, principal.ID); err != nil {
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+	}
+}
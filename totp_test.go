@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, c := range cases {
+		if got := totpCode(secret, uint64(c.unix/totpPeriod)); got != c.code {
+			t.Errorf("At %d expected %s, got %s", c.unix, c.code, got)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	if _, ok := matchTOTP(secret, "081804", now.Add(totpPeriod*time.Second)); !ok {
+		t.Error("Expected code of the previous step to be accepted")
+	}
+	if _, ok := matchTOTP(secret, "081804", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Error("Expected old code to be rejected")
+	}
+}
+
+func currentTOTP(t *testing.T, secret string, now time.Time) string {
+	raw, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Invalid secret: %v", err)
+	}
+	return totpCode(raw, uint64(now.Unix()/totpPeriod))
+}
+
+func (j cookieJar) postJSON(mux *http.ServeMux, url, body string, out any) int {
+	req := httptest.NewRequest("POST", url, strings.NewReader(body))
+	j.attach(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		j[c.Name] = c.Value
+	}
+	json.NewDecoder(rec.Body).Decode(out)
+	return rec.Code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cfg, db, mux, _ := testLoginServer(t, clock)
+	mux.HandleFunc("/api/2fa/setup", AuthMiddleware(cfg, db, HandleTOTPSetup(cfg, db)))
+	mux.HandleFunc("/api/2fa/confirm", AuthMiddleware(cfg, db, HandleTOTPConfirm(db)))
+	login := `{"login":"testadmin","password":"testpass"}`
+
+	jar := cookieJar{}
+	jar.do(mux, "POST", "/api/login", login)
+
+	var setup struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauthUri"`
+	}
+	if code := jar.postJSON(mux, "/api/2fa/setup", "", &setup); code != http.StatusOK {
+		t.Fatalf("Setup failed with %d", code)
+	}
+	if !strings.HasPrefix(setup.URI, "otpauth://totp/PhotoManager:testadmin?") || !strings.Contains(setup.URI, "secret="+setup.Secret) {
+		t.Errorf("Unexpected otpauth URI %q", setup.URI)
+	}
+	if TOTPEnabled(db, 1) {
+		t.Error("Expected 2FA to stay disabled until confirmed")
+	}
+
+	var confirm struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if code := jar.postJSON(mux, "/api/2fa/confirm", `{"code":"000000"}`, &confirm); code != http.StatusBadRequest {
+		t.Errorf("Expected wrong code to be rejected, got %d", code)
+	}
+	// Use the previous step, so the current one is still free for the login below
+	code := currentTOTP(t, setup.Secret, time.Now().Add(-totpPeriod*time.Second))
+	if status := jar.postJSON(mux, "/api/2fa/confirm", `{"code":"`+code+`"}`, &confirm); status != http.StatusOK {
+		t.Fatalf("Confirm failed with %d", status)
+	}
+	if len(confirm.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %v", recoveryCodeCount, confirm.RecoveryCodes)
+	}
+
+	// The password alone no longer logs in
+	var step struct {
+		Status   string `json:"status"`
+		MFAToken string `json:"mfaToken"`
+	}
+	fresh := cookieJar{}
+	fresh.postJSON(mux, "/api/login", login, &step)
+	if step.Status != "mfa_required" || step.MFAToken == "" || fresh["jwt"] != "" {
+		t.Fatalf("Expected pending MFA login, got %+v and cookies %v", step, fresh)
+	}
+	if status := (cookieJar{"jwt": step.MFAToken}).do(mux, "GET", "/api/me", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected MFA token not to be accepted as access token, got %d", status)
+	}
+
+	var result map[string]any
+	if status := fresh.postJSON(mux, "/api/login/mfa", `{"mfaToken":"`+step.MFAToken+`","code":"123"}`, &result); status != http.StatusUnauthorized {
+		t.Errorf("Expected invalid code to be rejected, got %d", status)
+	}
+	if status := fresh.postJSON(mux, "/api/login/mfa", `{"mfaToken":"`+step.MFAToken+`","code":"456"}`, &result); status != http.StatusTooManyRequests {
+		t.Errorf("Expected code guessing to be throttled, got %d", status)
+	}
+	clock.Advance(time.Minute)
+	code = currentTOTP(t, setup.Secret, time.Now())
+	body := `{"mfaToken":"` + step.MFAToken + `","code":"` + code + `"}`
+	if status := fresh.postJSON(mux, "/api/login/mfa", body, &result); status != http.StatusOK {
+		t.Fatalf("MFA login failed with %d", status)
+	}
+	if status := fresh.do(mux, "GET", "/api/me", ""); status != http.StatusOK {
+		t.Errorf("Expected MFA login to set a valid jwt cookie, got %d", status)
+	}
+	if status := (cookieJar{}).postJSON(mux, "/api/login/mfa", body, &result); status != http.StatusUnauthorized {
+		t.Errorf("Expected TOTP code replay to be rejected, got %d", status)
+	}
+	clock.Advance(time.Minute)
+
+	// Recovery codes work once
+	recovery := `{"mfaToken":"` + step.MFAToken + `","code":"` + strings.ToUpper(confirm.RecoveryCodes[0]) + `"}`
+	if status := (cookieJar{}).postJSON(mux, "/api/login/mfa", recovery, &result); status != http.StatusOK {
+		t.Errorf("Expected recovery code to be accepted, got %d", status)
+	}
+	if status := (cookieJar{}).postJSON(mux, "/api/login/mfa", recovery, &result); status != http.StatusUnauthorized {
+		t.Errorf("Expected used recovery code to be rejected, got %d", status)
+	}
+}
+
+func TestMFARequiredForAdmins(t *testing.T) {
+	cfg, db, mux := testSessionServer(t)
+	cfg.MFA.RequireForAdmins = true
+	mux.HandleFunc("/api/users", RequirePermission(cfg, db, PermListUsers, HandleGetUsers(db)))
+	mux.HandleFunc("/api/2fa/setup", AuthMiddleware(cfg, db, HandleTOTPSetup(cfg, db)))
+	mux.HandleFunc("/api/2fa/confirm", AuthMiddleware(cfg, db, HandleTOTPConfirm(db)))
+	mux.HandleFunc("/api/2fa/disable", AuthMiddleware(cfg, db, HandleTOTPDisable(cfg, db)))
+
+	jar := cookieJar{}
+	var login struct {
+		Required    bool     `json:"mfaEnrollmentRequired"`
+		Permissions []string `json:"permissions"`
+	}
+	jar.postJSON(mux, "/api/login", `{"login":"testadmin","password":"testpass"}`, &login)
+	if !login.Required || len(login.Permissions) != 0 {
+		t.Errorf("Expected enrollment to be required, got %+v", login)
+	}
+	if status, code := authErrorCode(mux, jar, "GET", "/api/users", ""); status != http.StatusForbidden || code != "mfa_required" {
+		t.Errorf("Expected mfa_required, got %d %q", status, code)
+	}
+
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	jar.postJSON(mux, "/api/2fa/setup", "", &setup)
+	code := currentTOTP(t, setup.Secret, time.Now())
+	if status := jar.do(mux, "POST", "/api/2fa/confirm", `{"code":"`+code+`"}`); status != http.StatusOK {
+		t.Fatalf("Confirm failed with %d", status)
+	}
+	if status := jar.do(mux, "GET", "/api/users", ""); status != http.StatusOK {
+		t.Errorf("Expected admin with 2FA to list users, got %d", status)
+	}
+	if status := jar.do(mux, "POST", "/api/2fa/disable", `{"code":"`+code+`"}`); status != http.StatusForbidden {
+		t.Errorf("Expected admin not to disable required 2FA, got %d", status)
+	}
+}
@@ -3,6 +3,7 @@ package main
 type User struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // used for password reset
 }
 
 type DBUser struct {
@@ -12,22 +13,27 @@ type DBUser struct {
 }
 
 type Photo struct {
-	Filename string `json:"filename"`
-	Public   bool   `json:"public"`
+	ID         int64  `json:"id"`
+	Filename   string `json:"filename"` // original name, for display only
+	Public     bool   `json:"public"`
+	UploadedAt string `json:"uploadedAt,omitempty"`
 }
 
 type PublicPhoto struct {
-	User     string `json:"user"`
-	Filename string `json:"filename"`
+	User       string `json:"user"`
+	ID         int64  `json:"id"`
+	Filename   string `json:"filename"`
+	UploadedAt string `json:"uploadedAt,omitempty"`
 }
 
 type UpdatePublicRequest struct {
-	Filename string `json:"filename"`
-	Public   int    `json:"public"` // 0 OR 1
+	ID     int64 `json:"id"`
+	Public int   `json:"public"` // 0 OR 1
 }
 
 type UserResponse struct {
 	Login    string `json:"login"`
+	Role     string `json:"role"`
 	IsBanned bool   `json:"isBanned"`
 }
 
@@ -36,3 +42,120 @@ type ManageBanRequest struct {
 	Banned int    `json:"banned"` // 0 = unban, 1 = ban
 }
 
+type Album struct {
+	ID           int64   `json:"id"`
+	Owner        string  `json:"owner"`
+	Name         string  `json:"name"`
+	Public       bool    `json:"public"`
+	CoverPhotoID *int64  `json:"coverPhotoId"`
+	Photos       []Photo `json:"photos,omitempty"`
+}
+
+type APIKey struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"` // first characters of the key, to recognize it
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  string   `json:"expiresAt,omitempty"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`        // read, upload, delete
+	ExpiresInDays int      `json:"expiresInDays"` // 0 for a key that does not expire
+}
+
+type CreateAlbumRequest struct {
+	Name   string `json:"name"`
+	Public int    `json:"public"` // 0 OR 1
+}
+
+// Fields left out of the request are not changed, coverPhotoId 0 clears the cover
+type UpdateAlbumRequest struct {
+	Name         *string `json:"name"`
+	Public       *int    `json:"public"`
+	CoverPhotoID *int64  `json:"coverPhotoId"`
+}
+
+type AlbumPhotoRequest struct {
+	PhotoID int64 `json:"photoId"`
+}
+
+type ReorderAlbumRequest struct {
+	PhotoIDs []int64 `json:"photoIds"`
+}
+
+type PhotoDetailsRequest struct {
+	ID          int64    `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type SearchResult struct {
+	ID          int64    `json:"id"`
+	User        string   `json:"user"`
+	Filename    string   `json:"filename"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Public      bool     `json:"public"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"` // TOTP code or recovery code
+}
+
+type UnlockAccountRequest struct {
+	Login string `json:"login"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type AdminResetPasswordRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"` // temporary password, must be changed on next login
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type PasswordStrengthRequest struct {
+	Password string `json:"password"`
+	Login    string `json:"login"` // optional, passwords containing it score lower
+}
+
+type ExpiredPasswordRequest struct {
+	PasswordToken string `json:"passwordToken"` // from a login with an expired password
+	NewPassword   string `json:"newPassword"`
+}
+
+type ChangeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type ManageRoleRequest struct {
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+type RoleResponse struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
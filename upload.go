@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUploadTooLarge    = errors.New("upload exceeds the size limit")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrImageTooLarge     = errors.New("image dimensions exceed the limit")
+	ErrCorruptImage      = errors.New("image is corrupt")
+)
+
+const (
+	defaultMaxUploadMB = 20
+	defaultMaxPixels   = 50_000_000
+	// Room for the multipart boundaries and the other form fields
+	multipartOverhead = 1 << 20
+)
+
+// Formats that can be decoded with the standard image packages
+var defaultAllowedFormats = []string{"jpeg", "png", "gif"}
+
+func (p PhotosConfig) MaxUploadBytes() int64 {
+	if p.MaxUploadMB <= 0 {
+		return defaultMaxUploadMB << 20
+	}
+	return int64(p.MaxUploadMB) << 20
+}
+
+func (p PhotosConfig) PixelLimit() int {
+	if p.MaxPixels <= 0 {
+		return defaultMaxPixels
+	}
+	return p.MaxPixels
+}
+
+// Validate rejects allowed formats without a registered decoder. tiff, webp and bmp are
+// recognized by detectImageFormat but could not be decoded for the renditions.
+func (p PhotosConfig) Validate() error {
+	for _, f := range p.AllowedFormats {
+		if !slices.Contains(defaultAllowedFormats, f) {
+			return fmt.Errorf("photos: format %q cannot be decoded, allowed formats are %s", f, strings.Join(defaultAllowedFormats, ", "))
+		}
+	}
+	return nil
+}
+
+func (p PhotosConfig) Formats() []string {
+	if len(p.AllowedFormats) == 0 {
+		return defaultAllowedFormats
+	}
+	return p.AllowedFormats
+}
+
+// detectImageFormat recognizes the image format from the magic bytes of the file.
+func detectImageFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "tiff"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(header, []byte("BM")):
+		return "bmp"
+	}
+	return ""
+}
+
+// ValidateImage checks the uploaded file against the configured limits and returns
+// its format. The dimensions are checked before decoding the pixels so oversized
+// images are rejected without allocating memory for them.
+func ValidateImage(cfg *Config, file io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(file, header)
+	format := detectImageFormat(header[:n])
+	if format == "" || !slices.Contains(cfg.Photos.Formats(), format) {
+		return "", ErrUnsupportedFormat
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	conf, decodedFormat, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", ErrUnsupportedFormat
+	}
+	if decodedFormat != format {
+		return "", ErrUnsupportedFormat
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width*conf.Height > cfg.Photos.PixelLimit() {
+		return "", ErrImageTooLarge
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, _, err := image.Decode(file); err != nil {
+		return "", ErrCorruptImage
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	return format, err
+}
+
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// displayFilename strips any directory part sent by the client.
+func displayFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "photo"
+	}
+	return name
+}
+
+func parsePhotoID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil && id > 0
+}
+
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrUploadTooLarge), errors.Is(err, ErrImageTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrCorruptImage):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
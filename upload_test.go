@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testPNGBytes(w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	return buf.Bytes()
+}
+
+func TestValidateImage(t *testing.T) {
+	cfg := &Config{Photos: PhotosConfig{MaxPixels: 1000}}
+
+	format, err := ValidateImage(cfg, bytes.NewReader(testPNGBytes(20, 20)))
+	if err != nil || format != "png" {
+		t.Errorf("Expected valid png, got %q, %v", format, err)
+	}
+
+	if _, err := ValidateImage(cfg, bytes.NewReader([]byte("%PDF-1.7\n..."))); err != ErrUnsupportedFormat {
+		t.Errorf("Expected ErrUnsupportedFormat for PDF, got %v", err)
+	}
+
+	if _, err := ValidateImage(cfg, bytes.NewReader(testPNGBytes(100, 100))); err != ErrImageTooLarge {
+		t.Errorf("Expected ErrImageTooLarge, got %v", err)
+	}
+
+	truncated := testPNGBytes(20, 20)
+	truncated = truncated[:len(truncated)-20]
+	if _, err := ValidateImage(cfg, bytes.NewReader(truncated)); err != ErrCorruptImage {
+		t.Errorf("Expected ErrCorruptImage, got %v", err)
+	}
+
+	cfg.Photos.AllowedFormats = []string{"jpeg"}
+	if _, err := ValidateImage(cfg, bytes.NewReader(testPNGBytes(20, 20))); err != ErrUnsupportedFormat {
+		t.Errorf("Expected png to be rejected by the allowlist, got %v", err)
+	}
+	if err := cfg.Photos.Validate(); err != nil {
+		t.Errorf("Expected jpeg to be a valid format, got %v", err)
+	}
+
+	cfg.Photos.AllowedFormats = []string{"jpeg", "webp"}
+	if err := cfg.Photos.Validate(); err == nil {
+		t.Error("Expected webp to be rejected without a decoder")
+	}
+}
+
+func uploadRequest(t *testing.T, filename string, data []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("photo", filename)
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	fw.Write(data)
+	mw.WriteField("public", "0")
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/add-photo", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	ctx := WithPrincipal(req.Context(), &Principal{ID: 1, Login: "testadmin"})
+	return req.WithContext(ctx)
+}
+
+func TestHandleAddPhotoValidation(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Photos:   PhotosConfig{Directory: t.TempDir(), MaxUploadMB: 1},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	store, _ := NewLocalPhotoStore(cfg.Photos.Directory)
+	handler := HandleAddPhoto(cfg, db, store)
+
+	rec := httptest.NewRecorder()
+	handler(rec, uploadRequest(t, "doc.pdf", []byte("%PDF-1.7\n...")))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for PDF, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, uploadRequest(t, "big.png", make([]byte, 3<<20)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized upload, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, uploadRequest(t, "ok.png", testPNGBytes(20, 20)))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for valid image, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDisplayFilename(t *testing.T) {
+	cases := map[string]string{
+		"photo.jpg":               "photo.jpg",
+		"../../etc/passwd":        "passwd",
+		`C:\Users\me\holiday.png`: "holiday.png",
+		"..":                      "photo",
+	}
+	for in, want := range cases {
+		if got := displayFilename(in); got != want {
+			t.Errorf("displayFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHandleAddPhotoStorageKeys(t *testing.T) {
+	cfg := &Config{
+		Database: DatabaseConfig{File: ":memory:"},
+		Photos:   PhotosConfig{Directory: t.TempDir()},
+		Admin:    AdminConfig{DefaultLogin: "testadmin", DefaultPassword: "testpass"},
+	}
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	store, _ := NewLocalPhotoStore(cfg.Photos.Directory)
+	handler := HandleAddPhoto(cfg, db, store)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, uploadRequest(t, "../same.png", testPNGBytes(20+i, 20)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	rows, err := db.Query(`SELECT imagePath, originalName FROM photos`)
+	if err != nil {
+		t.Fatalf("Failed to query photos: %v", err)
+	}
+	defer rows.Close()
+
+	paths := map[string]bool{}
+	for rows.Next() {
+		var path, name string
+		rows.Scan(&path, &name)
+		if name != "same.png" {
+			t.Errorf("Expected display name same.png, got %s", name)
+		}
+		if !strings.HasPrefix(path, "blobs/") {
+			t.Errorf("Photo stored outside the blob directory: %s", path)
+		}
+		if _, err := store.Stat(path); err != nil {
+			t.Errorf("Stored photo %s missing: %v", path, err)
+		}
+		paths[path] = true
+	}
+	if len(paths) != 2 {
+		t.Errorf("Expected two distinct files, got %v", paths)
+	}
+}